@@ -0,0 +1,204 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/kontext"
+)
+
+var ErrAuditorNotFound = errors.New("auditor not found")
+
+const (
+	LoginEvent       = "login"
+	LoginFailedEvent = "login_failed"
+	DisconnectEvent  = "disconnect"
+	StatementEvent   = "statement"
+)
+
+// Event is a single record in the audit stream.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	User       string    `json:"user,omitempty"`
+	Database   string    `json:"database,omitempty"`
+	ClientAddr string    `json:"client_addr,omitempty"`
+	AuthMethod string    `json:"auth_method,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Class      string    `json:"class,omitempty"`
+	Command    string    `json:"command,omitempty"`
+	Statement  string    `json:"statement,omitempty"`
+	DurationMs float64   `json:"duration_ms,omitempty"`
+}
+
+// sinkErrors are the errors of the sinks that failed to write a record.
+type sinkErrors []error
+
+func (e sinkErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Is reports whether one of the errors matches target.
+func (e sinkErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sink is a destination for audit records.
+type Sink interface {
+	Write(data []byte) error
+	Close() error
+}
+
+// Auditor writes audit events to the configured sinks. It's a no-op if there is no sink.
+type Auditor struct {
+	mtx sync.Mutex
+
+	sinks []Sink
+}
+
+// New creates a new Auditor. Auditing is disabled if c is nil.
+func New(c *config.Audit) (*Auditor, error) {
+	a := &Auditor{}
+	if c == nil {
+		return a, nil
+	}
+
+	if c.Output != nil {
+		f, err := newFileSink(c)
+		if err != nil {
+			return nil, err
+		}
+		a.sinks = append(a.sinks, f)
+	}
+
+	if c.Syslog != nil {
+		s, err := newSyslogSink(c.Syslog)
+		if err != nil {
+			_ = a.Close()
+			return nil, err
+		}
+		a.sinks = append(a.sinks, s)
+	}
+
+	return a, nil
+}
+
+// Enabled returns true if there is at least one sink.
+func (a *Auditor) Enabled() bool {
+	return len(a.sinks) > 0
+}
+
+// Record writes an event to all sinks.
+func (a *Auditor) Record(e *Event) error {
+	if !a.Enabled() {
+		return nil
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	// A failing sink doesn't prevent the others from recording the event.
+	var errs sinkErrors
+	for _, s := range a.sinks {
+		if err := s.Write(data); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// RecordStatement classifies a query and records every statement in it, except
+// the read-only ones.
+func (a *Auditor) RecordStatement(e Event, query string) error {
+	if !a.Enabled() {
+		return nil
+	}
+
+	stmts, err := Classify(query)
+	if err != nil {
+		// Unparsable statements are rejected by PostgreSQL, still keep a record.
+		stmts = []Statement{{Class: UnknownClass, Command: "UNKNOWN"}}
+	}
+
+	for _, stmt := range stmts {
+		if stmt.Class == ReadClass {
+			continue
+		}
+		se := e
+		se.Type = StatementEvent
+		se.Class = stmt.Class
+		se.Command = stmt.Command
+		se.Statement = query
+		if err := a.Record(&se); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes all sinks.
+func (a *Auditor) Close() error {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	var result error
+	for _, s := range a.sinks {
+		if err := s.Close(); err != nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func FromKontext(k *kontext.Kontext) (*Auditor, error) {
+	i := k.Get(kontext.AuditorKey)
+	if i == nil {
+		return nil, ErrAuditorNotFound
+	}
+
+	a, ok := i.(*Auditor)
+	if !ok {
+		return nil, fmt.Errorf("auditor: %w", kontext.ErrInvalidType)
+	}
+
+	return a, nil
+}
@@ -0,0 +1,193 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/kontext"
+	"github.com/stretchr/testify/require"
+)
+
+func readEvents(t *testing.T, filename string) []Event {
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer f.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		events = append(events, e)
+	}
+	require.NoError(t, scanner.Err())
+	return events
+}
+
+func TestAudit_Classify(t *testing.T) {
+	cases := map[string]Statement{
+		"SELECT * FROM users":                                       {Class: ReadClass, Command: "SELECT"},
+		"SELECT * FROM users FOR UPDATE":                            {Class: DMLClass, Command: "SELECT FOR UPDATE"},
+		"SELECT * INTO backup FROM users":                           {Class: DDLClass, Command: "SELECT INTO"},
+		"WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d": {Class: DMLClass, Command: "WITH"},
+		"INSERT INTO users (name) VALUES ('foo')":                   {Class: DMLClass, Command: "INSERT"},
+		"UPDATE users SET name = 'bar'":                             {Class: DMLClass, Command: "UPDATE"},
+		"DELETE FROM users":                                         {Class: DMLClass, Command: "DELETE"},
+		"CREATE TABLE foo (id int)":                                 {Class: DDLClass, Command: "CREATE TABLE"},
+		"DROP TABLE foo":                                            {Class: DDLClass, Command: "DROP TABLE"},
+		"CREATE TRIGGER t AFTER INSERT ON foo EXECUTE FUNCTION f()": {Class: DDLClass, Command: "CreateTrigStmt"},
+		"GRANT SELECT ON users TO reader":                           {Class: DCLClass, Command: "GRANT"},
+		"REVOKE SELECT ON users FROM reader":                        {Class: DCLClass, Command: "REVOKE"},
+		"BEGIN":                                                     {Class: TransactionClass, Command: "BEGIN"},
+		"SET search_path TO public":                                 {Class: UtilityClass, Command: "SET"},
+	}
+
+	for query, expected := range cases {
+		stmts, err := Classify(query)
+		require.NoError(t, err, query)
+		require.Len(t, stmts, 1, query)
+		require.Equal(t, expected, stmts[0], query)
+	}
+
+	stmts, err := Classify("BEGIN; UPDATE users SET name = 'bar'; COMMIT;")
+	require.NoError(t, err)
+	require.Len(t, stmts, 3)
+}
+
+func TestAudit_RecordStatement(t *testing.T) {
+	output := path.Join(t.TempDir(), "audit.log")
+	a, err := New(&config.Audit{Output: &output})
+	require.NoError(t, err)
+	require.True(t, a.Enabled())
+
+	e := Event{User: "dbuser", Database: "postgres", ClientAddr: "127.0.0.1:5555"}
+	require.NoError(t, a.RecordStatement(e, "SELECT * FROM users"))
+	require.NoError(t, a.RecordStatement(e, "DROP TABLE users"))
+	require.NoError(t, a.Record(&Event{Type: LoginFailedEvent, User: "dbuser", AuthMethod: "md5"}))
+	require.NoError(t, a.Close())
+
+	events := readEvents(t, output)
+	require.Len(t, events, 2)
+	require.Equal(t, StatementEvent, events[0].Type)
+	require.Equal(t, DDLClass, events[0].Class)
+	require.Equal(t, "DROP TABLE users", events[0].Statement)
+	require.Equal(t, "dbuser", events[0].User)
+	require.Equal(t, LoginFailedEvent, events[1].Type)
+	require.Equal(t, "md5", events[1].AuthMethod)
+}
+
+func TestAudit_Rotation(t *testing.T) {
+	output := path.Join(t.TempDir(), "audit.log")
+	maxSize, maxBackups := 1, 2
+	a, err := New(&config.Audit{Output: &output, MaxSize: &maxSize, MaxBackups: &maxBackups})
+	require.NoError(t, err)
+
+	statement := "INSERT INTO logs (data) VALUES ('" + strings.Repeat("x", 64*1024) + "')"
+	for i := 0; i < 64; i++ {
+		require.NoError(t, a.RecordStatement(Event{User: "dbuser"}, statement))
+	}
+	require.NoError(t, a.Close())
+
+	for _, name := range []string{output, output + ".1", output + ".2"} {
+		info, err := os.Stat(name)
+		require.NoError(t, err)
+		require.LessOrEqual(t, info.Size(), int64(maxSize*megabyte))
+	}
+	_, err = os.Stat(output + ".3")
+	require.True(t, os.IsNotExist(err))
+}
+
+// countRecords returns the number of records in a file, they may be too long for
+// readEvents.
+func countRecords(t *testing.T, filename string) int {
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	return bytes.Count(data, []byte{'\n'})
+}
+
+func TestAudit_RotationFailure(t *testing.T) {
+	output := path.Join(t.TempDir(), "audit.log")
+	maxSize, maxBackups := 1, 1
+	a, err := New(&config.Audit{Output: &output, MaxSize: &maxSize, MaxBackups: &maxBackups})
+	require.NoError(t, err)
+	defer a.Close()
+
+	// audit.log cannot be renamed to a non-empty directory.
+	require.NoError(t, os.MkdirAll(path.Join(output+".1", "dir"), 0700))
+
+	statement := "INSERT INTO logs (data) VALUES ('" + strings.Repeat("x", megabyte) + "')"
+	require.NoError(t, a.RecordStatement(Event{User: "dbuser"}, statement))
+	require.Error(t, a.RecordStatement(Event{User: "dbuser"}, statement))
+	// The record is still appended to the current file.
+	require.Equal(t, 2, countRecords(t, output))
+
+	// The file is rotated by the next write.
+	require.NoError(t, os.RemoveAll(output+".1"))
+	require.NoError(t, a.RecordStatement(Event{User: "dbuser"}, statement))
+	require.Equal(t, 1, countRecords(t, output))
+	require.Equal(t, 2, countRecords(t, output+".1"))
+}
+
+type failingSink struct{}
+
+func (failingSink) Write([]byte) error { return os.ErrClosed }
+
+func (failingSink) Close() error { return nil }
+
+func TestAudit_Record_FailingSink(t *testing.T) {
+	output := path.Join(t.TempDir(), "audit.log")
+	a, err := New(&config.Audit{Output: &output})
+	require.NoError(t, err)
+	defer a.Close()
+	a.sinks = append([]Sink{failingSink{}}, a.sinks...)
+
+	err = a.Record(&Event{Type: LoginEvent, User: "dbuser"})
+	require.ErrorIs(t, err, os.ErrClosed)
+	// The other sinks record the event.
+	require.Len(t, readEvents(t, output), 1)
+}
+
+func TestAudit_Disabled(t *testing.T) {
+	a, err := New(nil)
+	require.NoError(t, err)
+	require.False(t, a.Enabled())
+	require.NoError(t, a.RecordStatement(Event{}, "DROP TABLE users"))
+	require.NoError(t, a.Close())
+}
+
+func TestAudit_FromKontext(t *testing.T) {
+	ktx := kontext.New()
+	_, err := FromKontext(ktx)
+	require.ErrorIs(t, err, ErrAuditorNotFound)
+
+	ktx.Set(kontext.AuditorKey, struct{}{})
+	_, err = FromKontext(ktx)
+	require.ErrorIs(t, err, kontext.ErrInvalidType)
+
+	a, err := New(nil)
+	require.NoError(t, err)
+	ktx.Set(kontext.AuditorKey, a)
+	extracted, err := FromKontext(ktx)
+	require.NoError(t, err)
+	require.Equal(t, a, extracted)
+}
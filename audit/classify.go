@@ -0,0 +1,209 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"fmt"
+	"strings"
+
+	pg_query "github.com/pganalyze/pg_query_go/v2"
+)
+
+const (
+	ReadClass        = "READ"
+	DMLClass         = "DML"
+	DDLClass         = "DDL"
+	DCLClass         = "DCL"
+	TransactionClass = "TRANSACTION"
+	UtilityClass     = "UTILITY"
+	UnknownClass     = "UNKNOWN"
+)
+
+// Statement is the classification of a single SQL statement.
+type Statement struct {
+	Class   string
+	Command string
+}
+
+func classifySelect(stmt *pg_query.SelectStmt) Statement {
+	if stmt.GetIntoClause() != nil {
+		return Statement{Class: DDLClass, Command: "SELECT INTO"}
+	}
+
+	// WITH x AS (DELETE ... RETURNING *) SELECT * FROM x
+	for _, cte := range stmt.GetWithClause().GetCtes() {
+		query := cte.GetCommonTableExpr().GetCtequery()
+		if query.GetInsertStmt() != nil || query.GetUpdateStmt() != nil || query.GetDeleteStmt() != nil {
+			return Statement{Class: DMLClass, Command: "WITH"}
+		}
+	}
+
+	if len(stmt.GetLockingClause()) > 0 {
+		return Statement{Class: DMLClass, Command: "SELECT FOR UPDATE"}
+	}
+	return Statement{Class: ReadClass, Command: "SELECT"}
+}
+
+func classifyNode(node *pg_query.Node) Statement {
+	switch n := node.GetNode().(type) {
+	case *pg_query.Node_SelectStmt:
+		return classifySelect(n.SelectStmt)
+	case *pg_query.Node_InsertStmt:
+		return Statement{Class: DMLClass, Command: "INSERT"}
+	case *pg_query.Node_UpdateStmt:
+		return Statement{Class: DMLClass, Command: "UPDATE"}
+	case *pg_query.Node_DeleteStmt:
+		return Statement{Class: DMLClass, Command: "DELETE"}
+	case *pg_query.Node_CopyStmt:
+		if n.CopyStmt.GetIsFrom() {
+			return Statement{Class: DMLClass, Command: "COPY FROM"}
+		}
+		return Statement{Class: ReadClass, Command: "COPY TO"}
+	case *pg_query.Node_TruncateStmt:
+		return Statement{Class: DMLClass, Command: "TRUNCATE"}
+	case *pg_query.Node_CallStmt:
+		return Statement{Class: DMLClass, Command: "CALL"}
+	case *pg_query.Node_DoStmt:
+		return Statement{Class: DMLClass, Command: "DO"}
+	case *pg_query.Node_ExecuteStmt:
+		return Statement{Class: DMLClass, Command: "EXECUTE"}
+	case *pg_query.Node_GrantStmt:
+		if n.GrantStmt.GetIsGrant() {
+			return Statement{Class: DCLClass, Command: "GRANT"}
+		}
+		return Statement{Class: DCLClass, Command: "REVOKE"}
+	case *pg_query.Node_GrantRoleStmt:
+		if n.GrantRoleStmt.GetIsGrant() {
+			return Statement{Class: DCLClass, Command: "GRANT ROLE"}
+		}
+		return Statement{Class: DCLClass, Command: "REVOKE ROLE"}
+	case *pg_query.Node_CreateRoleStmt:
+		return Statement{Class: DCLClass, Command: "CREATE ROLE"}
+	case *pg_query.Node_AlterRoleStmt:
+		return Statement{Class: DCLClass, Command: "ALTER ROLE"}
+	case *pg_query.Node_AlterRoleSetStmt:
+		return Statement{Class: DCLClass, Command: "ALTER ROLE SET"}
+	case *pg_query.Node_DropRoleStmt:
+		return Statement{Class: DCLClass, Command: "DROP ROLE"}
+	case *pg_query.Node_AlterDefaultPrivilegesStmt:
+		return Statement{Class: DCLClass, Command: "ALTER DEFAULT PRIVILEGES"}
+	case *pg_query.Node_ReassignOwnedStmt:
+		return Statement{Class: DCLClass, Command: "REASSIGN OWNED"}
+	case *pg_query.Node_DropOwnedStmt:
+		return Statement{Class: DCLClass, Command: "DROP OWNED"}
+	case *pg_query.Node_CreatePolicyStmt:
+		return Statement{Class: DCLClass, Command: "CREATE POLICY"}
+	case *pg_query.Node_AlterPolicyStmt:
+		return Statement{Class: DCLClass, Command: "ALTER POLICY"}
+	case *pg_query.Node_TransactionStmt:
+		return Statement{Class: TransactionClass, Command: transactionCommand(n.TransactionStmt.GetKind())}
+	case *pg_query.Node_ExplainStmt:
+		return classifyNode(n.ExplainStmt.GetQuery())
+	case *pg_query.Node_VariableShowStmt:
+		return Statement{Class: ReadClass, Command: "SHOW"}
+	case *pg_query.Node_VariableSetStmt:
+		return Statement{Class: UtilityClass, Command: "SET"}
+	case *pg_query.Node_CreateStmt:
+		return Statement{Class: DDLClass, Command: "CREATE TABLE"}
+	case *pg_query.Node_CreateTableAsStmt:
+		return Statement{Class: DDLClass, Command: "CREATE TABLE AS"}
+	case *pg_query.Node_AlterTableStmt:
+		return Statement{Class: DDLClass, Command: "ALTER TABLE"}
+	case *pg_query.Node_DropStmt:
+		return Statement{Class: DDLClass, Command: "DROP " + strings.TrimPrefix(n.DropStmt.GetRemoveType().String(), "OBJECT_")}
+	case *pg_query.Node_IndexStmt:
+		return Statement{Class: DDLClass, Command: "CREATE INDEX"}
+	case *pg_query.Node_ViewStmt:
+		return Statement{Class: DDLClass, Command: "CREATE VIEW"}
+	case *pg_query.Node_RenameStmt:
+		return Statement{Class: DDLClass, Command: "ALTER " + strings.TrimPrefix(n.RenameStmt.GetRenameType().String(), "OBJECT_") + " RENAME"}
+	case *pg_query.Node_CreateSchemaStmt:
+		return Statement{Class: DDLClass, Command: "CREATE SCHEMA"}
+	case *pg_query.Node_CreateSeqStmt:
+		return Statement{Class: DDLClass, Command: "CREATE SEQUENCE"}
+	case *pg_query.Node_CreateFunctionStmt:
+		return Statement{Class: DDLClass, Command: "CREATE FUNCTION"}
+	case *pg_query.Node_CreateExtensionStmt:
+		return Statement{Class: DDLClass, Command: "CREATE EXTENSION"}
+	case *pg_query.Node_CreatedbStmt:
+		return Statement{Class: DDLClass, Command: "CREATE DATABASE"}
+	case *pg_query.Node_DropdbStmt:
+		return Statement{Class: DDLClass, Command: "DROP DATABASE"}
+	case *pg_query.Node_CommentStmt:
+		return Statement{Class: DDLClass, Command: "COMMENT"}
+	}
+
+	// Fall back to the name of the parse node: *pg_query.Node_CreateTrigStmt => CreateTrigStmt
+	name := strings.TrimPrefix(typeName(node), "Node_")
+	switch {
+	case strings.HasPrefix(name, "Create"),
+		strings.HasPrefix(name, "Alter"),
+		strings.HasPrefix(name, "Drop"),
+		strings.HasPrefix(name, "Define"),
+		strings.HasPrefix(name, "Import"),
+		strings.HasPrefix(name, "Refresh"):
+		return Statement{Class: DDLClass, Command: name}
+	default:
+		return Statement{Class: UtilityClass, Command: name}
+	}
+}
+
+// typeName returns the name of the node type in a parse node, such as Node_CreateTrigStmt.
+func typeName(node *pg_query.Node) string {
+	name := fmt.Sprintf("%T", node.GetNode())
+	if idx := strings.LastIndexByte(name, '.'); idx >= 0 {
+		return name[idx+1:]
+	}
+	return name
+}
+
+func transactionCommand(kind pg_query.TransactionStmtKind) string {
+	switch kind {
+	case pg_query.TransactionStmtKind_TRANS_STMT_BEGIN, pg_query.TransactionStmtKind_TRANS_STMT_START:
+		return "BEGIN"
+	case pg_query.TransactionStmtKind_TRANS_STMT_COMMIT:
+		return "COMMIT"
+	case pg_query.TransactionStmtKind_TRANS_STMT_ROLLBACK:
+		return "ROLLBACK"
+	case pg_query.TransactionStmtKind_TRANS_STMT_SAVEPOINT:
+		return "SAVEPOINT"
+	case pg_query.TransactionStmtKind_TRANS_STMT_RELEASE:
+		return "RELEASE"
+	case pg_query.TransactionStmtKind_TRANS_STMT_ROLLBACK_TO:
+		return "ROLLBACK TO"
+	case pg_query.TransactionStmtKind_TRANS_STMT_PREPARE:
+		return "PREPARE TRANSACTION"
+	case pg_query.TransactionStmtKind_TRANS_STMT_COMMIT_PREPARED:
+		return "COMMIT PREPARED"
+	case pg_query.TransactionStmtKind_TRANS_STMT_ROLLBACK_PREPARED:
+		return "ROLLBACK PREPARED"
+	default:
+		return "TRANSACTION"
+	}
+}
+
+// Classify parses a query and classifies every statement in it.
+func Classify(query string) ([]Statement, error) {
+	tree, err := pg_query.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Statement
+	for _, raw := range tree.GetStmts() {
+		result = append(result, classifyNode(raw.GetStmt()))
+	}
+	return result, nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package audit
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pgscale/pgscale/config"
+)
+
+const (
+	defaultPerm       = 0600
+	defaultMaxBackups = 5
+	megabyte          = 1024 * 1024
+)
+
+// fileSink appends records to a file. The file is rotated when it exceeds maxSize:
+// audit.log is renamed to audit.log.1, audit.log.1 to audit.log.2 and so on.
+type fileSink struct {
+	path       string
+	perm       os.FileMode
+	maxSize    int64
+	maxBackups int
+	size       int64
+	f          *os.File
+}
+
+func newFileSink(c *config.Audit) (*fileSink, error) {
+	s := &fileSink{
+		path:       *c.Output,
+		perm:       defaultPerm,
+		maxBackups: defaultMaxBackups,
+	}
+	if c.Perm != nil {
+		s.perm = *c.Perm
+	}
+	if c.MaxSize != nil {
+		s.maxSize = int64(*c.MaxSize) * megabyte
+	}
+	if c.MaxBackups != nil {
+		s.maxBackups = *c.MaxBackups
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, s.perm)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	s.f = f
+	s.size = info.Size()
+	return nil
+}
+
+// rotate renames the file to a backup and opens a new one. The records are still
+// appended to the current file if it fails, it's tried again at the next write.
+func (s *fileSink) rotate() error {
+	if err := s.shift(); err != nil {
+		return err
+	}
+
+	current := s.f
+	if err := s.open(); err != nil {
+		return err
+	}
+	_ = current.Close()
+	return nil
+}
+
+// shift renames the file and its backups. It's skipped if the file has been renamed by
+// a rotation that failed to open the new file.
+func (s *fileSink) shift() error {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return nil
+	}
+
+	for i := s.maxBackups - 1; i > 0; i-- {
+		src := fmt.Sprintf("%s.%d", s.path, i)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(src, fmt.Sprintf("%s.%d", s.path, i+1)); err != nil {
+			return err
+		}
+	}
+
+	if s.maxBackups > 0 {
+		if err := os.Rename(s.path, s.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *fileSink) Write(data []byte) error {
+	size := int64(len(data) + 1)
+	var rotateErr error
+	if s.maxSize > 0 && s.size > 0 && s.size+size > s.maxSize {
+		rotateErr = s.rotate()
+	}
+
+	nr, err := s.f.Write(append(data, '\n'))
+	s.size += int64(nr)
+	if err != nil {
+		return err
+	}
+	return rotateErr
+}
+
+func (s *fileSink) Close() error {
+	return s.f.Close()
+}
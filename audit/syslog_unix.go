@@ -0,0 +1,86 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package audit
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+
+	"github.com/pgscale/pgscale/config"
+)
+
+const defaultSyslogTag = "pgscale-audit"
+
+var facilities = map[string]syslog.Priority{
+	"AUTH":     syslog.LOG_AUTH,
+	"AUTHPRIV": syslog.LOG_AUTHPRIV,
+	"DAEMON":   syslog.LOG_DAEMON,
+	"USER":     syslog.LOG_USER,
+	"LOCAL0":   syslog.LOG_LOCAL0,
+	"LOCAL1":   syslog.LOG_LOCAL1,
+	"LOCAL2":   syslog.LOG_LOCAL2,
+	"LOCAL3":   syslog.LOG_LOCAL3,
+	"LOCAL4":   syslog.LOG_LOCAL4,
+	"LOCAL5":   syslog.LOG_LOCAL5,
+	"LOCAL6":   syslog.LOG_LOCAL6,
+	"LOCAL7":   syslog.LOG_LOCAL7,
+}
+
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink(c *config.Syslog) (Sink, error) {
+	facility := syslog.LOG_AUTHPRIV
+	if c.Facility != nil {
+		f, ok := facilities[strings.ToUpper(*c.Facility)]
+		if !ok {
+			return nil, fmt.Errorf("invalid syslog facility: %s", *c.Facility)
+		}
+		facility = f
+	}
+
+	tag := defaultSyslogTag
+	if c.Tag != nil {
+		tag = *c.Tag
+	}
+
+	// Empty network and address connect to the local syslog server.
+	var network, address string
+	if c.Network != nil {
+		network = *c.Network
+	}
+	if c.Address != nil {
+		address = *c.Address
+	}
+
+	w, err := syslog.Dial(network, address, facility|syslog.LOG_NOTICE, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Write(data []byte) error {
+	return s.w.Notice(string(data))
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
@@ -15,6 +15,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -24,6 +25,7 @@ import (
 	"runtime"
 
 	"github.com/buraksezer/olric"
+	"github.com/hashicorp/hcl/v2"
 	"github.com/pgscale/pgscale/cmd/pgscale-server/server"
 	"github.com/sean-/seed"
 )
@@ -36,7 +38,8 @@ Distributed query cache and connection pool middleware for PostgreSQL.
 Options:
   -h, --help       Print this message and exit.
   -v, --version    Print the version number and exit.
-  -c, --config     Set configuration file path.
+  -c, --config     Set configuration file path (.hcl, .json, .yaml or .yml).
+  --check-config   Validate the configuration file and exit.
 
 The Go runtime version %s
 Report bugs to https://github.com/pgscale/pgscale/issues
@@ -47,10 +50,23 @@ Report bugs to https://github.com/pgscale/pgscale/issues
 	}
 }
 
+// printConfigError prints every diagnostic of a configuration error on its own line.
+func printConfigError(err error) {
+	var diags hcl.Diagnostics
+	if errors.As(err, &diags) {
+		for _, diag := range diags {
+			log.Printf("pgscale-server: %s", diag.Error())
+		}
+		return
+	}
+	log.Printf("pgscale-server: %v", err)
+}
+
 type arguments struct {
-	config  string
-	help    bool
-	version bool
+	config      string
+	checkConfig bool
+	help        bool
+	version     bool
 }
 
 var (
@@ -87,6 +103,8 @@ func main() {
 	f.StringVar(&args.config, "config", configFile, "")
 	f.StringVar(&args.config, "c", configFile, "")
 
+	f.BoolVar(&args.checkConfig, "check-config", false, "")
+
 	if err := f.Parse(os.Args[1:]); err != nil {
 		log.Fatalf("pgscale-server: failed to parse flags: %v", err)
 	}
@@ -114,9 +132,19 @@ func main() {
 		args.config = envConfigFile
 	}
 
+	if args.checkConfig {
+		if err = server.CheckConfig(args.config); err != nil {
+			printConfigError(err)
+			os.Exit(1)
+		}
+		log.Printf("pgscale-server: %s is valid", args.config)
+		return
+	}
+
 	s, err := server.New(args.config)
 	if err != nil {
-		log.Fatalf("pgscale-server: %v", err)
+		printConfigError(err)
+		os.Exit(1)
 	}
 
 	if err = s.Start(); err != nil {
@@ -26,6 +26,7 @@ import (
 	"github.com/pgscale/pgscale/config"
 	"github.com/pgscale/pgscale/kontext"
 	"github.com/pgscale/pgscale/pgscale"
+	"github.com/pgscale/pgscale/upgrade"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -46,6 +47,10 @@ func New(configFile string) (*Server, error) {
 		return nil, err
 	}
 
+	if err = upgrade.ApplyOlric(pc); err != nil {
+		return nil, err
+	}
+
 	oc, err := config.MakeOlricConfig(pc)
 	if err != nil {
 		return nil, err
@@ -58,11 +63,94 @@ func New(configFile string) (*Server, error) {
 	}, nil
 }
 
+// CheckConfig loads the configuration file, validates it and builds the Olric
+// configuration without starting anything.
+func CheckConfig(configFile string) error {
+	pc, err := config.New(configFile)
+	if err != nil {
+		return err
+	}
+
+	oc, err := config.MakeOlricConfig(pc)
+	if err != nil {
+		return err
+	}
+
+	if err = oc.Sanitize(); err != nil {
+		return err
+	}
+	return oc.Validate()
+}
+
+func (s *Server) reload() {
+	if s.pgscale == nil {
+		s.log.Printf("[pgscale-server] PgScale is not running yet, configuration cannot be reloaded")
+		return
+	}
+	if err := s.pgscale.Reload(); err != nil {
+		s.log.Printf("[pgscale-server] Failed to reload configuration: %v", err)
+		return
+	}
+	s.log.Printf("[pgscale-server] Configuration has been reloaded")
+}
+
+// upgrade starts a new process with the listeners of the current one. It returns true
+// if the new process is ready to serve and the current one should drain its connections.
+func (s *Server) upgrade() bool {
+	if s.pgscale == nil {
+		s.log.Printf("[pgscale-server] PgScale is not running yet, binary cannot be upgraded")
+		return false
+	}
+
+	// Read the upgrade block from the file, it may be added after start.
+	c, err := config.New(s.config.Filename)
+	if err != nil {
+		s.log.Printf("[pgscale-server] Failed to upgrade binary: %v", err)
+		return false
+	}
+	timeout, err := upgrade.Timeout(c)
+	if err != nil {
+		s.log.Printf("[pgscale-server] Failed to upgrade binary: %v", err)
+		return false
+	}
+	o, err := upgrade.NextOlric(c, &s.config.Olric)
+	if err != nil {
+		s.log.Printf("[pgscale-server] Failed to upgrade binary: %v", err)
+		return false
+	}
+	listeners, err := s.pgscale.Listeners()
+	if err != nil {
+		s.log.Printf("[pgscale-server] Failed to upgrade binary: %v", err)
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err = upgrade.Start(ctx, listeners, o); err != nil {
+		s.log.Printf("[pgscale-server] Failed to upgrade binary: %v", err)
+		return false
+	}
+	s.log.Printf("[pgscale-server] New process is ready, draining client connections")
+	return true
+}
+
 func (s *Server) waitForInterrupt() {
 	shutDownChan := make(chan os.Signal, 1)
-	signal.Notify(shutDownChan, syscall.SIGTERM, syscall.SIGINT)
-	ch := <-shutDownChan
-	s.log.Printf("[pgscale-server] Signal caught: %s", ch.String())
+	signal.Notify(shutDownChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR2)
+	for {
+		ch := <-shutDownChan
+		s.log.Printf("[pgscale-server] Signal caught: %s", ch.String())
+		if ch == syscall.SIGHUP {
+			s.reload()
+			continue
+		}
+		if ch == syscall.SIGUSR2 && !s.upgrade() {
+			continue
+		}
+		break
+	}
+	signal.Ignore(syscall.SIGHUP, syscall.SIGUSR2)
 
 	pgscaleGone := make(chan struct{})
 
@@ -104,9 +192,14 @@ func (s *Server) waitForInterrupt() {
 // Start starts a new PgScale server instance and blocks until the server is closed.
 func (s *Server) Start() error {
 	s.log.Printf("[pgscale-server] pid: %d has been started", os.Getpid())
-	// Wait for SIGTERM or SIGINT
+	// Wait for SIGTERM or SIGINT, SIGHUP reloads the configuration and SIGUSR2 upgrades the binary
 	go s.waitForInterrupt()
 
+	listeners, err := upgrade.Listeners()
+	if err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	callback := func() {
 		defer cancel()
@@ -122,6 +215,7 @@ func (s *Server) Start() error {
 	k := kontext.New()
 	k.Set(kontext.OlricKey, db)
 	k.Set(kontext.ConfigKey, s.config)
+	k.Set(kontext.ListenersKey, listeners)
 
 	g, err := pgscale.New(k)
 	if err != nil {
@@ -129,6 +223,25 @@ func (s *Server) Start() error {
 	}
 	s.pgscale = g
 
+	if upgrade.Inherited() {
+		// Let the old process drain its connections after this one starts to serve.
+		go func() {
+			<-s.pgscale.Started()
+			if err := upgrade.Ready(); err != nil {
+				s.log.Printf("[pgscale-server] Failed to notify the old process: %v", err)
+			}
+		}()
+	}
+
+	// Health and readiness endpoints are available while Olric bootstraps.
+	s.errGr.Go(func() error {
+		if err := s.pgscale.ListenAndServeHTTP(); err != nil {
+			s.log.Printf("[pgscale-server] Failed to run HTTP server: %v", err)
+			return err
+		}
+		return nil
+	})
+
 	s.errGr.Go(func() error {
 		if err = s.olric.Start(); err != nil {
 			s.log.Printf("[pgscale-server] Failed to run Olric: %v", err)
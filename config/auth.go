@@ -22,6 +22,46 @@ const (
 	TrustAuthType       = "trust"
 )
 
+// Optional settings of a user, they override the settings of the database.
+const (
+	QueryTimeoutUserKey   = "query_timeout"
+	MaxResultBytesUserKey = "max_result_bytes"
+)
+
+// AdminDatabase is the database of the admin console. The users in admin_users run the
+// admin commands, such as RELOAD, on it.
+const AdminDatabase = "pgscale"
+
+// DefaultAuthQuery returns the name and the password verifier of a user.
+const DefaultAuthQuery = "SELECT usename, passwd FROM pg_shadow WHERE usename=$1"
+
 type Auth struct {
-	Users map[string]map[string]string `hcl:"users"`
+	Users     map[string]map[string]string `hcl:"users,optional"`
+	AuthFile  *string                      `hcl:"auth_file"`
+	AuthQuery *AuthQuery                   `hcl:"auth_query,block"`
+	// AdminUsers can connect to the admin console, they authenticate like the other
+	// users.
+	AdminUsers []string `hcl:"admin_users,optional"`
+}
+
+// IsAdmin returns true if user is in admin_users.
+func (a *Auth) IsAdmin(user string) bool {
+	for _, admin := range a.AdminUsers {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthQuery looks up the users that are not found in users and auth_file on the
+// backend. It connects to dbname with a dedicated pool, parameters should contain the
+// credentials of a user that's only allowed to run the query. Results are cached in an
+// Olric DMap for cache_ttl.
+type AuthQuery struct {
+	Query      *string           `hcl:"query"`
+	Dbname     string            `hcl:"dbname"`
+	Parameters map[string]string `hcl:"parameters"`
+	MaxConns   *int              `hcl:"max_conns"`
+	CacheTTL   *string           `hcl:"cache_ttl"`
 }
@@ -18,8 +18,12 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 
-	"github.com/hashicorp/hcl/v2/hclsimple"
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
 	"github.com/pgscale/pgscale/kontext"
 )
 
@@ -37,6 +41,9 @@ const (
 )
 
 type Config struct {
+	// Filename is the path of the file that the configuration is loaded from.
+	Filename string
+
 	PgScale PgScale `hcl:"pgscale,block"`
 	Olric   Olric   `hcl:"olric,block"`
 }
@@ -54,16 +61,64 @@ func FromKontext(k *kontext.Kontext) (*Config, error) {
 	return c, nil
 }
 
+// parseFile parses the configuration file with the syntax that's selected by its
+// extension. YAML documents are converted to JSON and decoded with the JSON syntax.
+func parseFile(filename string) (*hcl.File, hcl.Diagnostics) {
+	parser := hclparse.NewParser()
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".hcl":
+		return parser.ParseHCLFile(filename)
+	case ".json":
+		return parser.ParseJSONFile(filename)
+	case ".yaml", ".yml":
+		src, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, hcl.Diagnostics{{
+				Severity: hcl.DiagError,
+				Summary:  "Failed to read file",
+				Detail:   err.Error(),
+				Subject:  &hcl.Range{Filename: filename},
+			}}
+		}
+		data, err := yamlToJSON(src)
+		if err != nil {
+			return nil, hcl.Diagnostics{{
+				Severity: hcl.DiagError,
+				Summary:  "Invalid YAML",
+				Detail:   err.Error(),
+				Subject:  &hcl.Range{Filename: filename},
+			}}
+		}
+		return parser.ParseJSON(data, filename)
+	}
+	return nil, hcl.Diagnostics{{
+		Severity: hcl.DiagError,
+		Summary:  "Unsupported file format",
+		Detail:   "Configuration file must have one of .hcl, .json, .yaml or .yml extensions.",
+		Subject:  &hcl.Range{Filename: filename},
+	}}
+}
+
+// New loads the configuration from an HCL, JSON or YAML file and validates it.
 func New(filename string) (*Config, error) {
 	if _, err := os.Stat(filename); os.IsNotExist(err) {
 		return nil, fmt.Errorf("file does not exist: %s", filename)
 	}
 
+	f, diags := parseFile(filename)
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
 	var c Config
-	err := hclsimple.DecodeFile(filename, nil, &c)
-	if err != nil {
-		return nil, err
+	diags = gohcl.DecodeBody(f.Body, evalContext(filename), &c)
+	if diags.HasErrors() {
+		return nil, diags
 	}
+	c.Filename = filename
 
+	if err := c.validate(f.Body); err != nil {
+		return nil, err
+	}
 	return &c, nil
 }
@@ -15,9 +15,12 @@
 package config
 
 import (
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/pgscale/pgscale/kontext"
+	"github.com/pgscale/pgscale/testutils"
 	"github.com/stretchr/testify/require"
 )
 
@@ -40,3 +43,47 @@ func TestConfig_FromKontext(t *testing.T) {
 	extracted, err := FromKontext(ktx)
 	require.Equal(t, c, extracted)
 }
+
+func TestConfig_Formats(t *testing.T) {
+	expected, err := New(testutils.NewPgScaleConfig(t))
+	require.NoError(t, err)
+
+	for _, format := range []string{"json", "yaml"} {
+		t.Run(format, func(t *testing.T) {
+			c, err := New(testutils.NewPgScaleConfigFormat(t, format))
+			require.NoError(t, err)
+
+			// HCL reads 0644 as a decimal number.
+			require.Equal(t, os.FileMode(0644), c.PgScale.Logging.Perm)
+			c.PgScale.Logging.Perm = expected.PgScale.Logging.Perm
+			c.PgScale.SlowQueryLog.Perm = expected.PgScale.SlowQueryLog.Perm
+
+			c.Filename = expected.Filename
+			require.Equal(t, expected, c)
+		})
+	}
+}
+
+func TestConfig_Formats_Diagnostics(t *testing.T) {
+	data, err := os.ReadFile(testutils.NewPgScaleConfigFormat(t, "yaml"))
+	require.NoError(t, err)
+	data = []byte(strings.Replace(string(data), "policy: statement", "policy: transaction", 1))
+	f, err := testutils.CreateTmpfile(t, "pgscale-server.*.yaml", data)
+	require.NoError(t, err)
+
+	_, err = New(f.Name())
+	diags := diagnostics(t, err)
+	require.Len(t, diags, 1)
+	require.Equal(t, "Invalid connection pool policy", diags[0].Summary)
+	require.Equal(t, f.Name(), diags[0].Subject.Filename)
+	require.Equal(t, 53, diags[0].Subject.Start.Line)
+}
+
+func TestConfig_UnsupportedFormat(t *testing.T) {
+	f, err := testutils.CreateTmpfile(t, "pgscale-server.*.toml", nil)
+	require.NoError(t, err)
+
+	_, err = New(f.Name())
+	diags := diagnostics(t, err)
+	require.Equal(t, "Unsupported file format", diags[0].Summary)
+}
@@ -39,8 +39,8 @@ func keepaliveCondition(name string, field reflect.Value) bool {
 	return strings.EqualFold(name, "KEEPALIVE") && field.Kind() == reflect.Int64
 }
 
-// mapYamlToConfig maps a parsed yaml to related configuration struct.
-// TODO: Use this to create Olric and memberlist config from yaml file.
+// mapYamlToConfig copies the fields of a configuration struct to the Olric struct that
+// has the same field names, duration strings are parsed.
 func mapYamlToConfig(rawDst, rawSrc interface{}) error {
 	dst := reflect.ValueOf(rawDst).Elem()
 	src := reflect.ValueOf(rawSrc).Elem()
@@ -21,11 +21,25 @@ import (
 	olricConfig "github.com/buraksezer/olric/config"
 )
 
+func dmapName(dbname, schema, table string) string {
+	return fmt.Sprintf("%s.%s.%s", dbname, schema, table)
+}
+
 func prepareDMapConfig(c *Config) (*olricConfig.DMaps, error) {
-	ds := olricConfig.DMaps{
-		Custom: make(map[string]olricConfig.DMap),
+	custom, err := dmapConfigs(c)
+	if err != nil {
+		return nil, err
 	}
+	AssignDMapNames(c)
+
+	return &olricConfig.DMaps{
+		Custom: custom,
+	}, nil
+}
 
+// dmapConfigs returns the Olric configuration of every cache table by DMap name.
+func dmapConfigs(c *Config) (map[string]olricConfig.DMap, error) {
+	custom := make(map[string]olricConfig.DMap)
 	for _, db := range c.PgScale.PostgreSQL.Databases {
 		for _, cache := range db.Caches {
 			df := olricConfig.DMaps{}
@@ -115,11 +129,10 @@ func prepareDMapConfig(c *Config) (*olricConfig.DMaps, error) {
 					dm.EvictionPolicy = df.EvictionPolicy
 				}
 
-				table.DMapName = fmt.Sprintf("%s.%s.%s", db.Dbname, cache.Schema, table.Name)
-				ds.Custom[table.DMapName] = dm
+				custom[dmapName(db.Dbname, cache.Schema, table.Name)] = dm
 			}
 		}
 	}
 
-	return &ds, nil
+	return custom, nil
 }
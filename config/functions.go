@@ -0,0 +1,85 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/function"
+)
+
+// envFunc returns the value of an environment variable. The optional second argument
+// is returned if the variable is not set, otherwise it's an error.
+var envFunc = function.New(&function.Spec{
+	Params: []function.Parameter{
+		{Name: "name", Type: cty.String},
+	},
+	VarParam: &function.Parameter{Name: "default", Type: cty.String},
+	Type:     function.StaticReturnType(cty.String),
+	Impl: func(args []cty.Value, _ cty.Type) (cty.Value, error) {
+		if len(args) > 2 {
+			return cty.NilVal, fmt.Errorf("env takes at most one default value")
+		}
+
+		name := args[0].AsString()
+		if value, ok := os.LookupEnv(name); ok {
+			return cty.StringVal(value), nil
+		}
+		if len(args) == 2 {
+			return args[1], nil
+		}
+		return cty.NilVal, fmt.Errorf("environment variable %s is not set", name)
+	},
+})
+
+// fileFunc returns a function that reads a file, such as a secret mounted by an
+// orchestrator. Relative paths are resolved against the directory of the configuration
+// file and the trailing newline is removed.
+func fileFunc(dir string) function.Function {
+	return function.New(&function.Spec{
+		Params: []function.Parameter{
+			{Name: "path", Type: cty.String},
+		},
+		Type: function.StaticReturnType(cty.String),
+		Impl: func(args []cty.Value, _ cty.Type) (cty.Value, error) {
+			path := args[0].AsString()
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return cty.NilVal, err
+			}
+			value := strings.TrimSuffix(string(data), "\n")
+			return cty.StringVal(strings.TrimSuffix(value, "\r")), nil
+		},
+	})
+}
+
+// evalContext returns the functions that are available in the configuration file.
+func evalContext(filename string) *hcl.EvalContext {
+	return &hcl.EvalContext{
+		Functions: map[string]function.Function{
+			"env":  envFunc,
+			"file": fileFunc(filepath.Dir(filename)),
+		},
+	}
+}
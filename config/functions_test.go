@@ -0,0 +1,58 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfig_Functions(t *testing.T) {
+	t.Setenv("PGSCALE_TEST_PASSWORD", "s3cret")
+
+	filename := rewriteConfig(t,
+		`password = "1234"`, `password = env("PGSCALE_TEST_PASSWORD")`,
+		`hash = "558e292c17f2b28142ab3a85d92952fd"`, `hash = file("admin.hash")`,
+		`host = "localhost"`, `host = env("PGSCALE_TEST_HOST", "localhost")`,
+	)
+	// Relative paths are resolved against the directory of the configuration file.
+	hashFile := filepath.Join(filepath.Dir(filename), "admin.hash")
+	require.NoError(t, os.WriteFile(hashFile, []byte("558e292c17f2b28142ab3a85d92952fd\n"), 0600))
+	t.Cleanup(func() {
+		require.NoError(t, os.Remove(hashFile))
+	})
+
+	c, err := New(filename)
+	require.NoError(t, err)
+	require.Equal(t, "s3cret", c.PgScale.Auth.Users["dbuser"]["password"])
+	require.Equal(t, "558e292c17f2b28142ab3a85d92952fd", c.PgScale.Auth.Users["admin"]["hash"])
+	require.Equal(t, "localhost", c.PgScale.PostgreSQL.Databases[0].Parameters["host"])
+}
+
+func TestConfig_Functions_Errors(t *testing.T) {
+	filename := rewriteConfig(t, `password = "1234"`, `password = env("PGSCALE_TEST_UNSET")`)
+	_, err := New(filename)
+	diags := diagnostics(t, err)
+	require.Equal(t, 14, diags[0].Subject.Start.Line)
+	require.Contains(t, diags[0].Detail, "environment variable PGSCALE_TEST_UNSET is not set")
+
+	filename = rewriteConfig(t, `password = "1234"`, `password = file("/nonexistent/secret")`)
+	_, err = New(filename)
+	diags = diagnostics(t, err)
+	require.Contains(t, diags[0].Detail, "no such file or directory")
+}
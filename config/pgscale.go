@@ -16,7 +16,9 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -26,11 +28,31 @@ const (
 )
 
 type PgScale struct {
-	BindAddr   string     `hcl:"bind_addr"`
-	BindPort   string     `hcl:"bind_port"`
-	Auth       Auth       `hcl:"auth,block"`
-	Logging    Logging    `hcl:"logging,block"`
-	PostgreSQL PostgreSQL `hcl:"postgresql,block"`
+	BindAddr           string  `hcl:"bind_addr"`
+	BindPort           string  `hcl:"bind_port"`
+	ShutdownTimeout    *string `hcl:"shutdown_timeout"`
+	MaxClientConn      *int    `hcl:"max_client_conn"`
+	MaxUserConnections *int    `hcl:"max_user_connections"`
+	MaxDBConnections   *int    `hcl:"max_db_connections"`
+	UnixSocketDir      *string `hcl:"unix_socket_dir"`
+	UnixSocketMode     *string `hcl:"unix_socket_mode"`
+	ProxyProtocol      *string `hcl:"proxy_protocol"`
+	// ProxyProtocolTrustedSources are the addresses of the load balancers, the PROXY
+	// protocol headers of the other peers are rejected.
+	ProxyProtocolTrustedSources []string      `hcl:"proxy_protocol_trusted_sources,optional"`
+	ClientLoginTimeout          *string       `hcl:"client_login_timeout"`
+	ClientIdleTimeout           *string       `hcl:"client_idle_timeout"`
+	IdleTransactionTimeout      *string       `hcl:"idle_transaction_timeout"`
+	Auth                        Auth          `hcl:"auth,block"`
+	Logging                     Logging       `hcl:"logging,block"`
+	SlowQueryLog                *SlowQueryLog `hcl:"slow_query_log,block"`
+	Tracing                     *Tracing      `hcl:"tracing,block"`
+	Audit                       *Audit        `hcl:"audit,block"`
+	HTTP                        *HTTP         `hcl:"http,block"`
+	Upgrade                     *Upgrade      `hcl:"upgrade,block"`
+	TLS                         *TLS          `hcl:"tls,block"`
+	Listeners                   []Listener    `hcl:"listener,block"`
+	PostgreSQL                  PostgreSQL    `hcl:"postgresql,block"`
 }
 
 type Logging struct {
@@ -38,24 +60,147 @@ type Logging struct {
 	Verbosity int32       `hcl:"verbosity"`
 	Level     string      `hcl:"level"`
 	Output    string      `hcl:"output"`
+	Format    *string     `hcl:"format"`
+}
+
+// SlowQueryLog configures the sink for statements that exceed the slow_query_threshold
+// of their database. It writes to stderr if the block is omitted.
+type SlowQueryLog struct {
+	Perm   os.FileMode `hcl:"perm"`
+	Output string      `hcl:"output"`
+}
+
+// Tracing configures the OTLP/HTTP exporter for OpenTelemetry spans. Tracing is
+// disabled if the block is omitted.
+type Tracing struct {
+	Endpoint    string             `hcl:"endpoint"`
+	URLPath     *string            `hcl:"url_path"`
+	Insecure    *bool              `hcl:"insecure"`
+	Headers     *map[string]string `hcl:"headers"`
+	ServiceName *string            `hcl:"service_name"`
+	SampleRatio *float64           `hcl:"sample_ratio"`
+}
+
+// Audit configures the audit stream of authentication events and non-SELECT
+// statements. Auditing is disabled if the block is omitted.
+type Audit struct {
+	Output     *string      `hcl:"output"`
+	Perm       *os.FileMode `hcl:"perm"`
+	MaxSize    *int         `hcl:"max_size"`
+	MaxBackups *int         `hcl:"max_backups"`
+	Syslog     *Syslog      `hcl:"syslog,block"`
+}
+
+// HTTP configures the server for health, readiness and cluster endpoints. The server
+// is disabled if the block is omitted. POST /reload requires the admin_token as a bearer
+// token, it's disabled if admin_token is not set.
+type HTTP struct {
+	BindAddr   string  `hcl:"bind_addr"`
+	BindPort   string  `hcl:"bind_port"`
+	AdminToken *string `hcl:"admin_token"`
+}
+
+// Upgrade configures the binary upgrade that's started by SIGUSR2. The new process
+// binds Olric to the alternate ports while the old one is still running, the ports are
+// swapped back at the next upgrade.
+type Upgrade struct {
+	Timeout            *string `hcl:"timeout"`
+	OlricBindPort      int     `hcl:"olric_bind_port"`
+	MemberlistBindPort int     `hcl:"memberlist_bind_port"`
+}
+
+// Modes of the PROXY protocol on the TCP listeners. The header is parsed if it's
+// present in optional mode, the connections without a header are rejected in
+// required mode. Only the peers in proxy_protocol_trusted_sources can send a header.
+const (
+	OptionalProxyProtocol = "optional"
+	RequiredProxyProtocol = "required"
+)
+
+const (
+	PreferTLSMode  = "prefer"
+	RequireTLSMode = "require"
+)
+
+// TLS is the certificate of a client listener. Clients can request TLS if the mode is
+// prefer, the default, and they must use TLS if it's require.
+type TLS struct {
+	CertFile string  `hcl:"cert_file"`
+	KeyFile  string  `hcl:"key_file"`
+	Mode     *string `hcl:"mode"`
+}
+
+// Required returns true if the clients must use TLS.
+func (t *TLS) Required() bool {
+	return t.Mode != nil && *t.Mode == RequireTLSMode
+}
+
+// Listener is a client endpoint in addition to bind_addr:bind_port. Clients of a
+// listener can only connect to its databases, all databases if it's empty. Policy
+// overrides the connection pool policy of the databases.
+type Listener struct {
+	Name      string   `hcl:"name,label"`
+	BindAddr  string   `hcl:"bind_addr"`
+	BindPort  string   `hcl:"bind_port"`
+	Databases []string `hcl:"databases,optional"`
+	Policy    *string  `hcl:"policy"`
+	TLS       *TLS     `hcl:"tls,block"`
+}
+
+// Allows returns true if the clients of the listener can connect to dbname.
+func (l *Listener) Allows(dbname string) bool {
+	if len(l.Databases) == 0 {
+		return true
+	}
+	for _, name := range l.Databases {
+		if name == dbname {
+			return true
+		}
+	}
+	return false
+}
+
+type Syslog struct {
+	Network  *string `hcl:"network"`
+	Address  *string `hcl:"address"`
+	Tag      *string `hcl:"tag"`
+	Facility *string `hcl:"facility"`
 }
 
 type ConnectionPool struct {
-	Policy            string  `hcl:"policy"`
-	MaxConnIdleTime   *string `hcl:"max_conn_idle_time"`
-	MaxConnLifetime   *string `hcl:"max_conn_lifetime"`
-	HealthCheckPeriod *string `hcl:"health_check_period"`
-	MinConns          *int    `hcl:"min_conns"`
-	MaxConns          *int    `hcl:"max_conns"`
+	Policy             string  `hcl:"policy"`
+	MaxConnIdleTime    *string `hcl:"max_conn_idle_time"`
+	MaxConnLifetime    *string `hcl:"max_conn_lifetime"`
+	HealthCheckPeriod  *string `hcl:"health_check_period"`
+	MinConns           *int    `hcl:"min_conns"`
+	MaxConns           *int    `hcl:"max_conns"`
+	QueryWaitTimeout   *string `hcl:"query_wait_timeout"`
+	MaxWaitClients     *int    `hcl:"max_wait_clients"`
+	ReservePoolSize    *int    `hcl:"reserve_pool_size"`
+	ReservePoolTimeout *string `hcl:"reserve_pool_timeout"`
 }
 
 type Database struct {
-	Dbname         string            `hcl:"dbname,label"`
-	Parameters     map[string]string `hcl:"parameters"`
-	ConnectionPool ConnectionPool    `hcl:"connection_pool,block"`
-	LogStatements  bool              `hcl:"log_statements"`
-	ResetQuery     string            `hcl:"reset_query"`
-	Caches         []*Cache          `hcl:"cache,block"`
+	Dbname             string            `hcl:"dbname,label"`
+	Parameters         map[string]string `hcl:"parameters"`
+	ConnectionPool     ConnectionPool    `hcl:"connection_pool,block"`
+	LogStatements      bool              `hcl:"log_statements"`
+	SlowQueryThreshold *string           `hcl:"slow_query_threshold"`
+	ResetQuery         string            `hcl:"reset_query"`
+	PassthroughAuth    *bool             `hcl:"passthrough_auth"`
+	// MaxPassthroughUsers is the number of users that get a pool of a database with
+	// passthrough_auth. Zero means no limit.
+	MaxPassthroughUsers *int     `hcl:"max_passthrough_users"`
+	MaxDBConnections    *int     `hcl:"max_db_connections"`
+	QueryTimeout        *string  `hcl:"query_timeout"`
+	MaxResultBytes      *int     `hcl:"max_result_bytes"`
+	Caches              []*Cache `hcl:"cache,block"`
+}
+
+// Passthrough returns true if the clients of the database authenticate on the backend
+// with their own credentials, instead of the users of PgScale.
+func (d Database) Passthrough() bool {
+	return d.PassthroughAuth != nil && *d.PassthroughAuth
 }
 
 func (d Database) ConnString() string {
@@ -101,6 +246,55 @@ type PostgreSQL struct {
 	Databases []Database `hcl:"database,block"`
 }
 
+// UnixSocketMode parses the octal permissions of the Unix domain socket, such as "0770".
+func UnixSocketMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid unix_socket_mode: %q", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// TrustedSources parses the addresses in proxy_protocol_trusted_sources, a CIDR such
+// as "10.0.0.0/8" or a single IP address.
+func TrustedSources(sources []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, source := range sources {
+		if ip := net.ParseIP(source); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted source: %q", source)
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+// Limit returns the value of an optional connection limit, zero means no limit.
+func Limit(value *int) int {
+	if value == nil {
+		return 0
+	}
+	return *value
+}
+
+// Database returns the database with the given name, or nil if it's not found.
+func (p *PostgreSQL) Database(dbname string) *Database {
+	for i := range p.Databases {
+		if p.Databases[i].Dbname == dbname {
+			return &p.Databases[i]
+		}
+	}
+	return nil
+}
+
 type Table struct {
 	DMapName        string
 	Name            string  `hcl:"name,label"`
@@ -56,3 +56,12 @@ func TestConfig_PgScale(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, testutils.NewPgScaleJSONConfig(t), tmp)
 }
+
+func TestConfig_Listener_Allows(t *testing.T) {
+	l := &Listener{Name: "analytics"}
+	require.True(t, l.Allows("postgres"))
+
+	l.Databases = []string{"somedatabase"}
+	require.True(t, l.Allows("somedatabase"))
+	require.False(t, l.Allows("postgres"))
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// RestartRequiredError is returned by CheckReload if the new configuration changes
+// settings that cannot be applied to a running process.
+type RestartRequiredError struct {
+	Fields []string
+}
+
+func (e *RestartRequiredError) Error() string {
+	return fmt.Sprintf("changes require restart: %s", strings.Join(e.Fields, ", "))
+}
+
+// CheckReload compares the running configuration with a newly loaded one. Users, the
+// auth_file, databases, cache tables and logging verbosity can be changed without restart.
+func CheckReload(running, loaded *Config) error {
+	var fields []string
+	check := func(name string, a, b interface{}) {
+		if !reflect.DeepEqual(a, b) {
+			fields = append(fields, name)
+		}
+	}
+
+	check("pgscale.bind_addr", running.PgScale.BindAddr, loaded.PgScale.BindAddr)
+	check("pgscale.bind_port", running.PgScale.BindPort, loaded.PgScale.BindPort)
+	check("pgscale.unix_socket_dir", running.PgScale.UnixSocketDir, loaded.PgScale.UnixSocketDir)
+	check("pgscale.unix_socket_mode", running.PgScale.UnixSocketMode, loaded.PgScale.UnixSocketMode)
+	check("pgscale.proxy_protocol", running.PgScale.ProxyProtocol, loaded.PgScale.ProxyProtocol)
+	check("pgscale.proxy_protocol_trusted_sources", running.PgScale.ProxyProtocolTrustedSources,
+		loaded.PgScale.ProxyProtocolTrustedSources)
+	check("pgscale.tls", running.PgScale.TLS, loaded.PgScale.TLS)
+	check("pgscale.listener", running.PgScale.Listeners, loaded.PgScale.Listeners)
+	check("pgscale.logging.level", running.PgScale.Logging.Level, loaded.PgScale.Logging.Level)
+	check("pgscale.logging.output", running.PgScale.Logging.Output, loaded.PgScale.Logging.Output)
+	check("pgscale.logging.perm", running.PgScale.Logging.Perm, loaded.PgScale.Logging.Perm)
+	check("pgscale.logging.format", running.PgScale.Logging.Format, loaded.PgScale.Logging.Format)
+	check("pgscale.slow_query_log", running.PgScale.SlowQueryLog, loaded.PgScale.SlowQueryLog)
+	check("pgscale.tracing", running.PgScale.Tracing, loaded.PgScale.Tracing)
+	check("pgscale.auth.auth_query", running.PgScale.Auth.AuthQuery, loaded.PgScale.Auth.AuthQuery)
+	check("pgscale.audit", running.PgScale.Audit, loaded.PgScale.Audit)
+	check("pgscale.http", running.PgScale.HTTP, loaded.PgScale.HTTP)
+	check("pgscale.upgrade", running.PgScale.Upgrade, loaded.PgScale.Upgrade)
+
+	// Olric reads its configuration once, during bootstrap.
+	check("olric", running.Olric, loaded.Olric)
+
+	if len(fields) > 0 {
+		return &RestartRequiredError{Fields: fields}
+	}
+	return nil
+}
+
+// AssignDMapNames sets the name of the DMap that caches every table in the configuration.
+func AssignDMapNames(c *Config) {
+	for _, db := range c.PgScale.PostgreSQL.Databases {
+		for _, cache := range db.Caches {
+			for _, table := range cache.Tables {
+				table.DMapName = dmapName(db.Dbname, cache.Schema, table.Name)
+			}
+		}
+	}
+}
+
+// ChangedDMaps returns the names of the DMaps whose cache tables are added or changed
+// by the loaded configuration. Olric applies DMap settings once, when a DMap is created
+// on a member, so the new settings take effect after restart.
+func ChangedDMaps(running, loaded *Config) ([]string, error) {
+	current, err := dmapConfigs(running)
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := dmapConfigs(loaded)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for name, dm := range next {
+		if cur, ok := current[name]; !ok || !reflect.DeepEqual(cur, dm) {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
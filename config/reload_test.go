@@ -0,0 +1,82 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pgscale/pgscale/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func loadTwice(t *testing.T) (*Config, *Config) {
+	filename := testutils.NewPgScaleConfig(t)
+	running, err := New(filename)
+	require.NoError(t, err)
+	require.Equal(t, filename, running.Filename)
+	_, err = MakeOlricConfig(running)
+	require.NoError(t, err)
+
+	loaded, err := New(filename)
+	require.NoError(t, err)
+	return running, loaded
+}
+
+func TestConfig_CheckReload(t *testing.T) {
+	running, loaded := loadTwice(t)
+
+	loaded.PgScale.Logging.Verbosity = 1
+	loaded.PgScale.Auth.Users["newuser"] = map[string]string{
+		"auth_type": TrustAuthType,
+	}
+	loaded.PgScale.PostgreSQL.Databases = loaded.PgScale.PostgreSQL.Databases[:1]
+	require.NoError(t, CheckReload(running, loaded))
+}
+
+func TestConfig_CheckReload_RestartRequired(t *testing.T) {
+	running, loaded := loadTwice(t)
+
+	loaded.PgScale.BindPort = "7000"
+	loaded.Olric.BindPort = 3330
+	err := CheckReload(running, loaded)
+
+	var restartErr *RestartRequiredError
+	require.True(t, errors.As(err, &restartErr))
+	require.Equal(t, []string{"pgscale.bind_port", "olric"}, restartErr.Fields)
+}
+
+func TestConfig_ChangedDMaps(t *testing.T) {
+	running, loaded := loadTwice(t)
+
+	changed, err := ChangedDMaps(running, loaded)
+	require.NoError(t, err)
+	require.Empty(t, changed)
+
+	ttl := "5m"
+	caches := loaded.PgScale.PostgreSQL.Databases[1].Caches
+	caches[0].Tables[1].TTLDuration = &ttl
+	caches[1].Tables = append(caches[1].Tables, &Table{Name: "orders"})
+
+	changed, err = ChangedDMaps(running, loaded)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"somedatabase.different-schema.orders",
+		"somedatabase.public.users",
+	}, changed)
+
+	AssignDMapNames(loaded)
+	require.Equal(t, "somedatabase.different-schema.orders", caches[1].Tables[1].DMapName)
+}
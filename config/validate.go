@@ -0,0 +1,560 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/zclconf/go-cty/cty"
+)
+
+// validator collects the problems of a decoded configuration as HCL diagnostics. Every
+// problem is addressed by a path such as pgscale, postgresql, database "postgres",
+// connection_pool, policy and the path is resolved to a range in the source file.
+type validator struct {
+	filename string
+	body     hcl.Body
+	diags    hcl.Diagnostics
+}
+
+func block(name, label string) string {
+	return fmt.Sprintf("%s %q", name, label)
+}
+
+// parseStep splits a path step into the block type or attribute name and the block label.
+func parseStep(step string) (string, string) {
+	parsed := strings.SplitN(step, " ", 2)
+	if len(parsed) == 1 {
+		return parsed[0], ""
+	}
+	label, err := strconv.Unquote(parsed[1])
+	if err != nil {
+		return parsed[0], parsed[1]
+	}
+	return parsed[0], label
+}
+
+func findBlock(body hcl.Body, name, label string) *hcl.Block {
+	schema := &hcl.BodySchema{
+		Blocks: []hcl.BlockHeaderSchema{{Type: name}},
+	}
+	if label != "" {
+		schema.Blocks[0].LabelNames = []string{"label"}
+	}
+
+	// Diagnostics are ignored, the body has already been decoded.
+	content, _, _ := body.PartialContent(schema)
+	for _, b := range content.Blocks {
+		if label == "" || b.Labels[0] == label {
+			return b
+		}
+	}
+	return nil
+}
+
+func findAttribute(body hcl.Body, name string) *hcl.Attribute {
+	content, _, _ := body.PartialContent(&hcl.BodySchema{
+		Attributes: []hcl.AttributeSchema{{Name: name}},
+	})
+	return content.Attributes[name]
+}
+
+// locateKey returns the range of the value at keys in an object expression, or the range
+// of the deepest key that exists.
+func locateKey(expr hcl.Expression, keys []string) hcl.Range {
+	for _, key := range keys {
+		pairs, diags := hcl.ExprMap(expr)
+		if diags.HasErrors() {
+			return expr.Range()
+		}
+
+		var found *hcl.KeyValuePair
+		for i := range pairs {
+			k, diags := pairs[i].Key.Value(nil)
+			if diags.HasErrors() || !k.Type().Equals(cty.String) || !k.IsKnown() || k.IsNull() {
+				continue
+			}
+			if k.AsString() == key {
+				found = &pairs[i]
+				break
+			}
+		}
+		if found == nil {
+			return expr.Range()
+		}
+		expr = found.Value
+	}
+	return expr.Range()
+}
+
+// locate returns the range of the item at path, or the range of the deepest enclosing
+// block if the item is missing.
+func (v *validator) locate(path []string) *hcl.Range {
+	if v.body == nil {
+		return &hcl.Range{Filename: v.filename}
+	}
+
+	body := v.body
+	rng := body.MissingItemRange()
+	for i, step := range path {
+		name, label := parseStep(step)
+		// Blocks are looked up first, the JSON syntax cannot tell a block from an object.
+		if b := findBlock(body, name, label); b != nil {
+			rng = b.DefRange
+			body = b.Body
+			continue
+		}
+
+		if attr := findAttribute(body, name); attr != nil && label == "" {
+			r := locateKey(attr.Expr, path[i+1:])
+			return &r
+		}
+		break
+	}
+	return &rng
+}
+
+func (v *validator) errorf(path []string, summary, format string, args ...interface{}) {
+	v.diags = append(v.diags, &hcl.Diagnostic{
+		Severity: hcl.DiagError,
+		Summary:  summary,
+		Detail:   fmt.Sprintf(format, args...),
+		Subject:  v.locate(path),
+	})
+}
+
+func join(path []string, steps ...string) []string {
+	result := make([]string, 0, len(path)+len(steps))
+	result = append(result, path...)
+	return append(result, steps...)
+}
+
+func (v *validator) duration(path []string, value string) {
+	if _, err := time.ParseDuration(value); err != nil {
+		name := path[len(path)-1]
+		v.errorf(path, "Invalid duration",
+			"%s must be a duration such as \"300ms\", \"1m\" or \"2h45m\", got %q.", name, value)
+	}
+}
+
+func (v *validator) optionalDuration(path []string, value *string) {
+	if value != nil {
+		v.duration(path, *value)
+	}
+}
+
+func (v *validator) oneOf(path []string, summary, value string, allowed ...string) {
+	for _, item := range allowed {
+		if value == item {
+			return
+		}
+	}
+
+	quoted := make([]string, len(allowed))
+	for i, item := range allowed {
+		quoted[i] = strconv.Quote(item)
+	}
+	v.errorf(path, summary, "%s must be one of %s, got %q.",
+		path[len(path)-1], strings.Join(quoted, ", "), value)
+}
+
+func (v *validator) port(path []string, value int) {
+	if value < 0 || value > 65535 {
+		v.errorf(path, "Invalid port", "%s must be between 0 and 65535, got %d.", path[len(path)-1], value)
+	}
+}
+
+func (v *validator) portString(path []string, value string) {
+	port, err := strconv.Atoi(value)
+	if err != nil {
+		v.errorf(path, "Invalid port", "%s must be a number, got %q.", path[len(path)-1], value)
+		return
+	}
+	v.port(path, port)
+}
+
+func (v *validator) nonNegative(path []string, value *int) {
+	if value != nil && *value < 0 {
+		v.errorf(path, "Invalid value", "%s cannot be negative, got %d.", path[len(path)-1], *value)
+	}
+}
+
+func (v *validator) logLevel(path []string, value string) {
+	v.oneOf(path, "Invalid log level", strings.ToUpper(value), DebugLog, WarnLog, ErrorLog, InfoLog)
+}
+
+func (v *validator) pgscale(c *PgScale) {
+	path := []string{"pgscale"}
+	v.portString(join(path, "bind_port"), c.BindPort)
+	v.optionalDuration(join(path, "shutdown_timeout"), c.ShutdownTimeout)
+	v.nonNegative(join(path, "max_client_conn"), c.MaxClientConn)
+	v.nonNegative(join(path, "max_user_connections"), c.MaxUserConnections)
+	v.nonNegative(join(path, "max_db_connections"), c.MaxDBConnections)
+	if c.UnixSocketMode != nil {
+		if _, err := UnixSocketMode(*c.UnixSocketMode); err != nil {
+			v.errorf(join(path, "unix_socket_mode"), "Invalid value",
+				"unix_socket_mode must be an octal permission such as \"0770\", got %q.", *c.UnixSocketMode)
+		}
+	}
+	if c.ProxyProtocol != nil {
+		v.oneOf(join(path, "proxy_protocol"), "Invalid PROXY protocol mode", *c.ProxyProtocol,
+			OptionalProxyProtocol, RequiredProxyProtocol)
+		validMode := *c.ProxyProtocol == OptionalProxyProtocol || *c.ProxyProtocol == RequiredProxyProtocol
+		if validMode && len(c.ProxyProtocolTrustedSources) == 0 {
+			v.errorf(join(path, "proxy_protocol"), "Missing trusted sources",
+				"proxy_protocol_trusted_sources must list the addresses of the load balancers.")
+		}
+	}
+	for _, source := range c.ProxyProtocolTrustedSources {
+		if _, err := TrustedSources([]string{source}); err != nil {
+			v.errorf(join(path, "proxy_protocol_trusted_sources"), "Invalid trusted source",
+				"proxy_protocol_trusted_sources must contain CIDRs or IP addresses, got %q.", source)
+		}
+	}
+	v.optionalDuration(join(path, "client_login_timeout"), c.ClientLoginTimeout)
+	v.optionalDuration(join(path, "client_idle_timeout"), c.ClientIdleTimeout)
+	v.optionalDuration(join(path, "idle_transaction_timeout"), c.IdleTransactionTimeout)
+
+	v.auth(join(path, "auth"), &c.Auth)
+
+	logging := join(path, "logging")
+	v.logLevel(join(logging, "level"), c.Logging.Level)
+	if c.Logging.Format != nil {
+		v.oneOf(join(logging, "format"), "Invalid log format", *c.Logging.Format, "text", "json")
+	}
+
+	if c.Tracing != nil {
+		tracing := join(path, "tracing")
+		if c.Tracing.Endpoint == "" {
+			v.errorf(join(tracing, "endpoint"), "Missing endpoint", "endpoint of the OTLP collector cannot be empty.")
+		}
+		if r := c.Tracing.SampleRatio; r != nil && (*r < 0 || *r > 1) {
+			v.errorf(join(tracing, "sample_ratio"), "Invalid sample ratio",
+				"sample_ratio must be between 0 and 1, got %v.", *r)
+		}
+	}
+
+	if c.Audit != nil {
+		audit := join(path, "audit")
+		v.nonNegative(join(audit, "max_size"), c.Audit.MaxSize)
+		v.nonNegative(join(audit, "max_backups"), c.Audit.MaxBackups)
+	}
+
+	if c.HTTP != nil {
+		v.portString(join(path, "http", "bind_port"), c.HTTP.BindPort)
+		if c.HTTP.AdminToken != nil && *c.HTTP.AdminToken == "" {
+			v.errorf(join(path, "http", "admin_token"), "Empty admin token",
+				"admin_token must not be empty, omit it to disable POST /reload.")
+		}
+	}
+
+	if c.TLS != nil {
+		v.tls(join(path, "tls"), c.TLS)
+	}
+	listeners := make(map[string]struct{})
+	for i := range c.Listeners {
+		l := &c.Listeners[i]
+		lp := join(path, block("listener", l.Name))
+		if _, ok := listeners[l.Name]; ok {
+			v.errorf(lp, "Duplicate listener", "listener %q is defined more than once.", l.Name)
+		}
+		listeners[l.Name] = struct{}{}
+		v.listener(lp, l, &c.PostgreSQL)
+	}
+
+	for i := range c.PostgreSQL.Databases {
+		v.database(join(path, "postgresql"), &c.PostgreSQL.Databases[i])
+	}
+
+	seen := make(map[string]struct{})
+	for _, db := range c.PostgreSQL.Databases {
+		if _, ok := seen[db.Dbname]; ok {
+			v.errorf(join(path, "postgresql", block("database", db.Dbname)), "Duplicate database",
+				"database %q is defined more than once.", db.Dbname)
+		}
+		seen[db.Dbname] = struct{}{}
+		if db.Dbname == AdminDatabase && len(c.Auth.AdminUsers) > 0 {
+			v.errorf(join(path, "postgresql", block("database", db.Dbname)), "Reserved database name",
+				"database %q is the admin console of admin_users.", db.Dbname)
+		}
+	}
+}
+
+func (v *validator) tls(path []string, c *TLS) {
+	if c.CertFile == "" {
+		v.errorf(join(path, "cert_file"), "Missing certificate", "cert_file cannot be empty.")
+	}
+	if c.KeyFile == "" {
+		v.errorf(join(path, "key_file"), "Missing private key", "key_file cannot be empty.")
+	}
+	if c.Mode != nil {
+		v.oneOf(join(path, "mode"), "Invalid TLS mode", *c.Mode, PreferTLSMode, RequireTLSMode)
+	}
+}
+
+// listenerName matches the names that can be passed to a new process by upgrade.
+var listenerName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func (v *validator) listener(path []string, l *Listener, pg *PostgreSQL) {
+	if !listenerName.MatchString(l.Name) {
+		v.errorf(path, "Invalid listener name",
+			"listener name can only contain letters, digits, underscores and hyphens, got %q.", l.Name)
+	}
+	v.portString(join(path, "bind_port"), l.BindPort)
+	if l.Policy != nil {
+		v.oneOf(join(path, "policy"), "Invalid connection pool policy", *l.Policy,
+			SessionConnectionPoolPolicy, StatementConnectionPoolPolicy)
+	}
+	for _, name := range l.Databases {
+		if pg.Database(name) == nil {
+			v.errorf(join(path, "databases"), "Unknown database",
+				"database %q of listener %q is not defined.", name, l.Name)
+		}
+	}
+	if l.TLS != nil {
+		v.tls(join(path, "tls"), l.TLS)
+	}
+}
+
+func (v *validator) auth(path []string, c *Auth) {
+	if q := c.AuthQuery; q != nil {
+		query := join(path, "auth_query")
+		if q.Dbname == "" {
+			v.errorf(join(query, "dbname"), "Missing database", "dbname of auth_query cannot be empty.")
+		}
+		v.optionalDuration(join(query, "cache_ttl"), q.CacheTTL)
+		if q.MaxConns != nil && *q.MaxConns < 1 {
+			v.errorf(join(query, "max_conns"), "Invalid value", "max_conns must be at least 1, got %d.", *q.MaxConns)
+		}
+	}
+
+	for name, credentials := range c.Users {
+		user := join(path, "users", name)
+		if value, ok := credentials[QueryTimeoutUserKey]; ok {
+			v.duration(join(user, QueryTimeoutUserKey), value)
+		}
+		if value, ok := credentials[MaxResultBytesUserKey]; ok {
+			if n, err := strconv.Atoi(value); err != nil || n < 0 {
+				v.errorf(join(user, MaxResultBytesUserKey), "Invalid value",
+					"max_result_bytes must be a non-negative integer, got %q.", value)
+			}
+		}
+		authType, ok := credentials["auth_type"]
+		if !ok {
+			v.errorf(user, "Missing authentication method", "user %q has no auth_type.", name)
+			continue
+		}
+
+		switch authType {
+		case TrustAuthType:
+		case PasswordAuthType:
+			if _, ok := credentials["password"]; !ok {
+				v.errorf(user, "Missing password", "user %q has no password.", name)
+			}
+		case MD5AuthType:
+			if _, ok := credentials["hash"]; !ok {
+				v.errorf(user, "Missing password hash", "user %q has no hash.", name)
+			}
+		default:
+			v.oneOf(join(user, "auth_type"), "Invalid authentication method", authType,
+				TrustAuthType, PasswordAuthType, MD5AuthType)
+		}
+	}
+}
+
+func (v *validator) database(path []string, db *Database) {
+	path = join(path, block("database", db.Dbname))
+
+	pool := join(path, "connection_pool")
+	v.oneOf(join(pool, "policy"), "Invalid connection pool policy", db.ConnectionPool.Policy,
+		SessionConnectionPoolPolicy, StatementConnectionPoolPolicy)
+	v.optionalDuration(join(pool, "max_conn_idle_time"), db.ConnectionPool.MaxConnIdleTime)
+	v.optionalDuration(join(pool, "max_conn_lifetime"), db.ConnectionPool.MaxConnLifetime)
+	v.optionalDuration(join(pool, "health_check_period"), db.ConnectionPool.HealthCheckPeriod)
+	v.nonNegative(join(pool, "min_conns"), db.ConnectionPool.MinConns)
+	v.optionalDuration(join(pool, "query_wait_timeout"), db.ConnectionPool.QueryWaitTimeout)
+	v.nonNegative(join(pool, "max_wait_clients"), db.ConnectionPool.MaxWaitClients)
+	v.nonNegative(join(pool, "reserve_pool_size"), db.ConnectionPool.ReservePoolSize)
+	v.optionalDuration(join(pool, "reserve_pool_timeout"), db.ConnectionPool.ReservePoolTimeout)
+	if max := db.ConnectionPool.MaxConns; max != nil {
+		if *max < 1 {
+			v.errorf(join(pool, "max_conns"), "Invalid value", "max_conns must be at least 1, got %d.", *max)
+		}
+		if min := db.ConnectionPool.MinConns; min != nil && *min > *max {
+			v.errorf(join(pool, "min_conns"), "Invalid value",
+				"min_conns cannot be greater than max_conns, got %d > %d.", *min, *max)
+		}
+	}
+
+	v.optionalDuration(join(path, "slow_query_threshold"), db.SlowQueryThreshold)
+	v.nonNegative(join(path, "max_db_connections"), db.MaxDBConnections)
+	v.nonNegative(join(path, "max_passthrough_users"), db.MaxPassthroughUsers)
+	v.optionalDuration(join(path, "query_timeout"), db.QueryTimeout)
+	v.nonNegative(join(path, "max_result_bytes"), db.MaxResultBytes)
+
+	schemas := make(map[string]struct{})
+	for _, cache := range db.Caches {
+		if _, ok := schemas[cache.Schema]; ok {
+			v.errorf(join(path, block("cache", cache.Schema)), "Duplicate cache",
+				"cache %q is defined more than once in database %q.", cache.Schema, db.Dbname)
+		}
+		schemas[cache.Schema] = struct{}{}
+		v.cache(path, cache)
+	}
+}
+
+func (v *validator) evictionPolicy(path []string, value *string) {
+	if value != nil {
+		v.oneOf(path, "Invalid eviction policy", *value, "NONE", "LRU")
+	}
+}
+
+func (v *validator) cache(path []string, cache *Cache) {
+	path = join(path, block("cache", cache.Schema))
+	v.optionalDuration(join(path, "maxIdleDuration"), cache.MaxIdleDuration)
+	v.optionalDuration(join(path, "ttlDuration"), cache.TTLDuration)
+	v.optionalDuration(join(path, "checkEmptyFragmentsInterval"), cache.CheckEmptyFragmentsInterval)
+	v.nonNegative(join(path, "maxKeys"), cache.MaxKeys)
+	v.nonNegative(join(path, "maxInuse"), cache.MaxInuse)
+	v.nonNegative(join(path, "lruSamples"), cache.LRUSamples)
+	v.evictionPolicy(join(path, "evictionPolicy"), cache.EvictionPolicy)
+
+	tables := make(map[string]struct{})
+	for _, table := range cache.Tables {
+		tablePath := join(path, block("table", table.Name))
+		if _, ok := tables[table.Name]; ok {
+			v.errorf(tablePath, "Duplicate table",
+				"table %q is defined more than once in cache %q.", table.Name, cache.Schema)
+		}
+		tables[table.Name] = struct{}{}
+
+		v.optionalDuration(join(tablePath, "max_idle_duration"), table.MaxIdleDuration)
+		v.optionalDuration(join(tablePath, "ttl_duration"), table.TTLDuration)
+		v.nonNegative(join(tablePath, "max_keys"), table.MaxKeys)
+		v.nonNegative(join(tablePath, "max_inuse"), table.MaxInuse)
+		v.nonNegative(join(tablePath, "lru_samples"), table.LRUSamples)
+		v.evictionPolicy(join(tablePath, "eviction_policy"), table.EvictionPolicy)
+	}
+}
+
+func (v *validator) upgrade(c *Config) {
+	if c.PgScale.Upgrade == nil {
+		return
+	}
+
+	path := []string{"pgscale", "upgrade"}
+	u := c.PgScale.Upgrade
+	v.optionalDuration(join(path, "timeout"), u.Timeout)
+
+	v.port(join(path, "olric_bind_port"), u.OlricBindPort)
+	if u.OlricBindPort == c.Olric.BindPort {
+		v.errorf(join(path, "olric_bind_port"), "Invalid port",
+			"olric_bind_port must be different from olric.bind_port, both are %d.", u.OlricBindPort)
+	}
+	v.port(join(path, "memberlist_bind_port"), u.MemberlistBindPort)
+	if u.MemberlistBindPort == c.Olric.Memberlist.BindPort {
+		v.errorf(join(path, "memberlist_bind_port"), "Invalid port",
+			"memberlist_bind_port must be different from olric.memberlist.bind_port, both are %d.",
+			u.MemberlistBindPort)
+	}
+}
+
+func (v *validator) olric(c *Olric) {
+	path := []string{"olric"}
+	v.port(join(path, "bind_port"), c.BindPort)
+	v.oneOf(join(path, "serializer"), "Invalid serializer", c.Serializer, "gob", "json", "msgpack")
+	for name, value := range map[string]string{
+		"keepalive_period":            c.KeepAlivePeriod,
+		"bootstrap_timeout":           c.BootstrapTimeout,
+		"routing_table_push_interval": c.RoutingTablePushInterval,
+	} {
+		if value != "" {
+			v.duration(join(path, name), value)
+		}
+	}
+	if c.Logging.Level != "" {
+		v.logLevel(join(path, "logging", "level"), c.Logging.Level)
+	}
+
+	client := join(path, "client")
+	for name, value := range map[string]string{
+		"dial_timeout":  c.Client.DialTimeout,
+		"read_timeout":  c.Client.ReadTimeout,
+		"write_timeout": c.Client.WriteTimeout,
+		"keep_alive":    c.Client.KeepAlive,
+	} {
+		if value != "" {
+			v.duration(join(client, name), value)
+		}
+	}
+	v.optionalDuration(join(client, "pool_timeout"), c.Client.PoolTimeout)
+
+	memberlist := join(path, "memberlist")
+	v.oneOf(join(memberlist, "environment"), "Invalid environment",
+		strings.ToLower(c.Memberlist.Environment), "local", "lan", "wan")
+	v.port(join(memberlist, "bind_port"), c.Memberlist.BindPort)
+	if c.Memberlist.JoinRetryInterval != "" {
+		v.duration(join(memberlist, "join_retry_interval"), c.Memberlist.JoinRetryInterval)
+	}
+	for name, value := range map[string]*string{
+		"tcp_timeout":             c.Memberlist.TCPTimeout,
+		"push_pull_interval":      c.Memberlist.PushPullInterval,
+		"probe_timeout":           c.Memberlist.ProbeTimeout,
+		"probe_interval":          c.Memberlist.ProbeInterval,
+		"gossip_interval":         c.Memberlist.GossipInterval,
+		"gossip_to_the_dead_time": c.Memberlist.GossipToTheDeadTime,
+	} {
+		v.optionalDuration(join(memberlist, name), value)
+	}
+}
+
+// Validate checks the values that the HCL schema cannot express, such as durations,
+// enumerations and required credentials. It returns hcl.Diagnostics that point to
+// the file and line of every problem.
+func (c *Config) Validate() error {
+	var body hcl.Body
+	if c.Filename != "" {
+		if f, diags := parseFile(c.Filename); !diags.HasErrors() {
+			body = f.Body
+		}
+	}
+	return c.validate(body)
+}
+
+func (c *Config) validate(body hcl.Body) error {
+	v := &validator{filename: c.Filename, body: body}
+	v.pgscale(&c.PgScale)
+	v.upgrade(c)
+	v.olric(&c.Olric)
+	if len(v.diags) == 0 {
+		return nil
+	}
+
+	// Map iteration above is random, keep the diagnostics in file order.
+	sort.SliceStable(v.diags, func(i, j int) bool {
+		a, b := v.diags[i].Subject.Start, v.diags[j].Subject.Start
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return v.diags
+}
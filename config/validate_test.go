@@ -0,0 +1,196 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/pgscale/pgscale/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+// rewriteConfig writes the test configuration with the replacements applied and
+// returns its path.
+func rewriteConfig(t *testing.T, replacements ...string) string {
+	data, err := os.ReadFile(testutils.NewPgScaleConfig(t))
+	require.NoError(t, err)
+
+	f, err := testutils.CreateTmpfile(t, "pgscale-server.*.hcl",
+		[]byte(strings.NewReplacer(replacements...).Replace(string(data))))
+	require.NoError(t, err)
+	return f.Name()
+}
+
+func diagnostics(t *testing.T, err error) hcl.Diagnostics {
+	var diags hcl.Diagnostics
+	require.True(t, errors.As(err, &diags), "expected hcl.Diagnostics, got %v", err)
+	return diags
+}
+
+func TestConfig_Validate(t *testing.T) {
+	c, err := New(testutils.NewPgScaleConfig(t))
+	require.NoError(t, err)
+	require.NoError(t, c.Validate())
+}
+
+func TestConfig_Validate_Diagnostics(t *testing.T) {
+	filename := rewriteConfig(t,
+		`policy              = "statement"`, `policy              = "transaction"`,
+		`max_idle_duration = "60s"`, `max_idle_duration = "60 seconds"`,
+		`serializer = "msgpack"`, `serializer = "yaml"`,
+	)
+	_, err := New(filename)
+	diags := diagnostics(t, err)
+	require.Len(t, diags, 3)
+
+	require.Equal(t, "Invalid connection pool policy", diags[0].Summary)
+	require.Equal(t, `policy must be one of "session", "statement", got "transaction".`, diags[0].Detail)
+	require.Equal(t, filename, diags[0].Subject.Filename)
+	require.Equal(t, 66, diags[0].Subject.Start.Line)
+
+	require.Equal(t, "Invalid duration", diags[1].Summary)
+	require.Equal(t, 100, diags[1].Subject.Start.Line)
+
+	require.Equal(t, "Invalid serializer", diags[2].Summary)
+	require.Equal(t, 126, diags[2].Subject.Start.Line)
+}
+
+func TestConfig_Validate_Users(t *testing.T) {
+	filename := rewriteConfig(t,
+		`auth_type = "password"`, `password_type = "password"`,
+		`auth_type = "md5"`, `auth_type = "md5-hash"`,
+	)
+	_, err := New(filename)
+	diags := diagnostics(t, err)
+	require.Len(t, diags, 2)
+
+	require.Equal(t, "Invalid authentication method", diags[0].Summary)
+	require.Equal(t, 9, diags[0].Subject.Start.Line)
+
+	require.Equal(t, "Missing authentication method", diags[1].Summary)
+	require.Equal(t, `user "dbuser" has no auth_type.`, diags[1].Detail)
+	require.Equal(t, 12, diags[1].Subject.Start.Line)
+}
+
+func TestConfig_Validate_Duplicate(t *testing.T) {
+	filename := rewriteConfig(t, `database "somedatabase"`, `database "postgres"`)
+	_, err := New(filename)
+	diags := diagnostics(t, err)
+	require.Len(t, diags, 1)
+	require.Equal(t, "Duplicate database", diags[0].Summary)
+}
+
+func TestConfig_Validate_ConnectionLimits(t *testing.T) {
+	filename := rewriteConfig(t,
+		`shutdown_timeout = "30s"`, "shutdown_timeout = \"30s\"\nmax_client_conn = -1",
+	)
+	_, err := New(filename)
+	diags := diagnostics(t, err)
+	require.Len(t, diags, 1)
+	require.Equal(t, "Invalid value", diags[0].Summary)
+	require.Equal(t, "max_client_conn cannot be negative, got -1.", diags[0].Detail)
+	require.Equal(t, 5, diags[0].Subject.Start.Line)
+}
+
+func TestConfig_Validate_QueryLimits(t *testing.T) {
+	filename := rewriteConfig(t,
+		`password = "1234"`, "password = \"1234\"\nquery_timeout = \"soon\"",
+	)
+	_, err := New(filename)
+	diags := diagnostics(t, err)
+	require.Len(t, diags, 1)
+	require.Equal(t, "Invalid duration", diags[0].Summary)
+	require.Equal(t, 15, diags[0].Subject.Start.Line)
+}
+
+func TestConfig_Validate_Listeners(t *testing.T) {
+	filename := rewriteConfig(t,
+		`shutdown_timeout = "30s"`, "shutdown_timeout = \"30s\"\n"+
+			"listener \"analytics\" {\nbind_addr = \"127.0.0.1\"\nbind_port = \"6958\"\n"+
+			"databases = [\"reporting\"]\npolicy = \"transaction\"\n}",
+	)
+	_, err := New(filename)
+	diags := diagnostics(t, err)
+	require.Len(t, diags, 2)
+	require.Equal(t, "Unknown database", diags[0].Summary)
+	require.Equal(t, `database "reporting" of listener "analytics" is not defined.`, diags[0].Detail)
+	require.Equal(t, "Invalid connection pool policy", diags[1].Summary)
+}
+
+func TestConfig_Validate_WithoutFile(t *testing.T) {
+	c := &Config{}
+	c.PgScale.BindPort = "6957"
+	c.PgScale.Logging.Level = DebugLog
+	c.Olric.Serializer = "gob"
+	c.Olric.Memberlist.Environment = "local"
+	require.NoError(t, c.Validate())
+
+	c.PgScale.BindPort = "postgres"
+	diags := diagnostics(t, c.Validate())
+	require.Len(t, diags, 1)
+	require.Equal(t, "Invalid port", diags[0].Summary)
+
+	c.PgScale.BindPort = "6957"
+	mode := "v2"
+	c.PgScale.ProxyProtocol = &mode
+	diags = diagnostics(t, c.Validate())
+	require.Len(t, diags, 1)
+	require.Equal(t, "Invalid PROXY protocol mode", diags[0].Summary)
+	require.Equal(t, `proxy_protocol must be one of "optional", "required", got "v2".`, diags[0].Detail)
+
+	mode = OptionalProxyProtocol
+	diags = diagnostics(t, c.Validate())
+	require.Len(t, diags, 1)
+	require.Equal(t, "Missing trusted sources", diags[0].Summary)
+
+	c.PgScale.ProxyProtocolTrustedSources = []string{"10.0.0.0/8", "192.168.1.10", "::1", "lb.local"}
+	diags = diagnostics(t, c.Validate())
+	require.Len(t, diags, 1)
+	require.Equal(t, "Invalid trusted source", diags[0].Summary)
+	require.Equal(t, `proxy_protocol_trusted_sources must contain CIDRs or IP addresses, got "lb.local".`, diags[0].Detail)
+
+	c.PgScale.ProxyProtocolTrustedSources = c.PgScale.ProxyProtocolTrustedSources[:3]
+	require.NoError(t, c.Validate())
+}
+
+func TestConfig_Validate_AdminToken(t *testing.T) {
+	filename := rewriteConfig(t, `bind_port = 6958`, "bind_port = 6958\nadmin_token = \"\"")
+	_, err := New(filename)
+	diags := diagnostics(t, err)
+	require.Len(t, diags, 1)
+	require.Equal(t, "Empty admin token", diags[0].Summary)
+	require.Equal(t, 35, diags[0].Subject.Start.Line)
+}
+
+func TestConfig_Validate_AdminDatabase(t *testing.T) {
+	filename := rewriteConfig(t,
+		`database "somedatabase" {`, `database "pgscale" {`,
+		"  auth {\n", "  auth {\n    admin_users = [\"admin\"]\n",
+	)
+	_, err := New(filename)
+	diags := diagnostics(t, err)
+	require.Len(t, diags, 1)
+	require.Equal(t, "Reserved database name", diags[0].Summary)
+	require.Equal(t, `database "pgscale" is the admin console of admin_users.`, diags[0].Detail)
+
+	// The name is not reserved without admin users.
+	filename = rewriteConfig(t, `database "somedatabase" {`, `database "pgscale" {`)
+	_, err = New(filename)
+	require.NoError(t, err)
+}
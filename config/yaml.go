@@ -0,0 +1,112 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlToJSON converts a YAML document to JSON, so it's decoded with the JSON syntax of
+// HCL. Every value is written on the line where it's in the YAML document, so the
+// diagnostics point to the right line of the original file.
+func yamlToJSON(src []byte) ([]byte, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(src, &doc); err != nil {
+		return nil, err
+	}
+
+	w := &jsonWriter{line: 1}
+	if len(doc.Content) == 0 {
+		// Empty document
+		w.buf.WriteString("{}")
+		return w.buf.Bytes(), nil
+	}
+	if err := w.write(doc.Content[0]); err != nil {
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
+
+type jsonWriter struct {
+	buf  bytes.Buffer
+	line int
+}
+
+// moveTo writes newlines until the output is on the line of n.
+func (w *jsonWriter) moveTo(n *yaml.Node) {
+	for w.line < n.Line {
+		w.buf.WriteByte('\n')
+		w.line++
+	}
+}
+
+func (w *jsonWriter) write(n *yaml.Node) error {
+	w.moveTo(n)
+
+	switch n.Kind {
+	case yaml.AliasNode:
+		return w.write(n.Alias)
+	case yaml.MappingNode:
+		w.buf.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			key, value := n.Content[i], n.Content[i+1]
+			if key.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d: mapping keys must be scalars", key.Line)
+			}
+			w.moveTo(key)
+			data, err := json.Marshal(key.Value)
+			if err != nil {
+				return err
+			}
+			w.buf.Write(data)
+			w.buf.WriteByte(':')
+			if err = w.write(value); err != nil {
+				return err
+			}
+		}
+		w.buf.WriteByte('}')
+	case yaml.SequenceNode:
+		w.buf.WriteByte('[')
+		for i, item := range n.Content {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			if err := w.write(item); err != nil {
+				return err
+			}
+		}
+		w.buf.WriteByte(']')
+	case yaml.ScalarNode:
+		var value interface{}
+		if err := n.Decode(&value); err != nil {
+			return fmt.Errorf("line %d: %w", n.Line, err)
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n.Line, err)
+		}
+		w.buf.Write(data)
+	default:
+		return fmt.Errorf("line %d: unsupported YAML node", n.Line)
+	}
+	return nil
+}
@@ -36,3 +36,19 @@ func TestDMaps_GetOrCreateDMap(t *testing.T) {
 	require.Equal(t, dm, received)
 	require.Len(t, dmaps.m, 1)
 }
+
+func TestDMaps_Versions(t *testing.T) {
+	db := testutils.NewOlricInstance(t)
+	dmaps := New(db)
+
+	names := []string{"postgres.public.users", "postgres.public.profile"}
+	versions, err := dmaps.Versions(names)
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 0}, versions)
+
+	require.NoError(t, dmaps.Bump(names[1:]))
+	require.NoError(t, dmaps.Bump(names[1:]))
+	versions, err = dmaps.Versions(names)
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 2}, versions)
+}
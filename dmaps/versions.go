@@ -0,0 +1,95 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dmaps
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/buraksezer/olric"
+)
+
+// VersionsDMapName is the name of the DMap that keeps the version of every cache table
+// by its DMap name. The versions of the tables are a part of the cache keys, so a
+// result is not served after one of its tables is written.
+const VersionsDMapName = "pgscale.versions"
+
+// Versions returns the versions of the tables. A table that has never been written
+// has version 0.
+func (d *DMaps) Versions(names []string) ([]int, error) {
+	dm, err := d.GetOrCreateDMap(VersionsDMapName)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]int, len(names))
+	for i, name := range names {
+		value, err := dm.Get(name)
+		if errors.Is(err, olric.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		versions[i], err = toVersion(value)
+		if err != nil {
+			return nil, fmt.Errorf("version of %s: %w", name, err)
+		}
+	}
+	return versions, nil
+}
+
+// Bump increments the versions of the tables.
+func (d *DMaps) Bump(names []string) error {
+	dm, err := d.GetOrCreateDMap(VersionsDMapName)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if _, err = dm.Incr(name, 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toVersion converts a value that's written by Incr. Its type depends on the serializer.
+func toVersion(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case int:
+		return v, nil
+	case int8:
+		return int(v), nil
+	case int16:
+		return int(v), nil
+	case int32:
+		return int(v), nil
+	case int64:
+		return int(v), nil
+	case uint8:
+		return int(v), nil
+	case uint16:
+		return int(v), nil
+	case uint32:
+		return int(v), nil
+	case uint64:
+		return int(v), nil
+	case float64:
+		return int(v), nil
+	default:
+		return 0, fmt.Errorf("unexpected type %T", value)
+	}
+}
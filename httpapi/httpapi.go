@@ -0,0 +1,318 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buraksezer/olric"
+	"github.com/buraksezer/olric/stats"
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/kontext"
+	"github.com/pgscale/pgscale/logging"
+	"github.com/pgscale/pgscale/utils"
+)
+
+const readinessTimeout = 5 * time.Second
+
+const bearerPrefix = "Bearer "
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+	StatusFailed      = "failed"
+)
+
+// Checker reports the readiness of the components behind the HTTP server. The result
+// is a map of check names to errors, a nil error means the check has passed.
+type Checker interface {
+	Ready(ctx context.Context) map[string]error
+}
+
+// Reloader applies the configuration file to the running process.
+type Reloader interface {
+	Reload() error
+}
+
+// StatsReporter reports the statistics of the PostgreSQL proxy.
+type StatsReporter interface {
+	Stats() *Stats
+}
+
+type Check struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type Readiness struct {
+	Status string           `json:"status"`
+	Checks map[string]Check `json:"checks"`
+}
+
+type Member struct {
+	Name      string `json:"name"`
+	ID        uint64 `json:"id"`
+	Birthdate int64  `json:"birthdate"`
+}
+
+// Partitions summarizes the partitions owned by this member.
+type Partitions struct {
+	Primary   int `json:"primary"`
+	Backup    int `json:"backup"`
+	Migrating int `json:"migrating"`
+	Entries   int `json:"entries"`
+}
+
+type Cluster struct {
+	Coordinator Member     `json:"coordinator"`
+	Member      Member     `json:"member"`
+	Members     []Member   `json:"members"`
+	Partitions  Partitions `json:"partitions"`
+}
+
+// Connections are the client connections in total, by user and by database. Limits
+// are omitted if they are not set.
+type Connections struct {
+	Total              int            `json:"total"`
+	Users              map[string]int `json:"users"`
+	Databases          map[string]int `json:"databases"`
+	Rejected           uint64         `json:"rejected"`
+	MaxClientConn      int            `json:"max_client_conn,omitempty"`
+	MaxUserConnections int            `json:"max_user_connections,omitempty"`
+	MaxDBConnections   int            `json:"max_db_connections,omitempty"`
+}
+
+type Stats struct {
+	Connections Connections `json:"connections"`
+}
+
+type Server struct {
+	config   *config.Config
+	log      *logging.Logger
+	olric    *olric.Olric
+	checker  Checker
+	reloader Reloader
+	stats    StatsReporter
+	addr     string
+	server   *http.Server
+	listener net.Listener
+	started  chan struct{}
+}
+
+func New(k *kontext.Kontext, checker Checker, reloader Reloader, stats StatsReporter) (*Server, error) {
+	c, err := config.FromKontext(k)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.PgScale.HTTP == nil {
+		return nil, errors.New("http block is missing in the configuration")
+	}
+
+	lg, err := logging.FromKontext(k)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := utils.OlricFromKontext(k)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		config:   c,
+		log:      lg.With(logging.F("component", "http")),
+		olric:    db,
+		checker:  checker,
+		reloader: reloader,
+		stats:    stats,
+		addr:     net.JoinHostPort(c.PgScale.HTTP.BindAddr, c.PgScale.HTTP.BindPort),
+		started:  make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
+	mux.HandleFunc("/cluster", s.cluster)
+	mux.HandleFunc("/reload", s.reload)
+	mux.HandleFunc("/stats", s.statsHandler)
+	s.server = &http.Server{Handler: mux}
+	return s, nil
+}
+
+func (s *Server) writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		s.log.V(3).Printf("[ERROR] Failed to write HTTP response: %v", err)
+	}
+}
+
+func (s *Server) healthz(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, &Check{Status: StatusOK})
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	code := http.StatusOK
+	result := &Readiness{
+		Status: StatusOK,
+		Checks: make(map[string]Check),
+	}
+	for name, err := range s.checker.Ready(ctx) {
+		if err != nil {
+			code = http.StatusServiceUnavailable
+			result.Status = StatusUnavailable
+			result.Checks[name] = Check{Status: StatusUnavailable, Error: err.Error()}
+			continue
+		}
+		result.Checks[name] = Check{Status: StatusOK}
+	}
+	s.writeJSON(w, code, result)
+}
+
+func toMember(m stats.Member) Member {
+	return Member{
+		Name:      m.Name,
+		ID:        m.ID,
+		Birthdate: m.Birthdate,
+	}
+}
+
+func (s *Server) cluster(w http.ResponseWriter, _ *http.Request) {
+	st, err := s.olric.Stats()
+	if err != nil {
+		s.writeJSON(w, http.StatusServiceUnavailable, &Check{Status: StatusUnavailable, Error: err.Error()})
+		return
+	}
+
+	c := &Cluster{
+		Coordinator: toMember(st.ClusterCoordinator),
+		Member:      toMember(st.Member),
+		Partitions: Partitions{
+			Primary: len(st.Partitions),
+			Backup:  len(st.Backups),
+		},
+	}
+	for _, member := range st.ClusterMembers {
+		c.Members = append(c.Members, toMember(member))
+	}
+	sort.Slice(c.Members, func(i, j int) bool {
+		return c.Members[i].Name < c.Members[j].Name
+	})
+	for _, part := range st.Partitions {
+		// Fragments of the partition are still being moved from its previous owners.
+		if len(part.PreviousOwners) > 0 {
+			c.Partitions.Migrating++
+		}
+		c.Partitions.Entries += part.Length
+	}
+	s.writeJSON(w, http.StatusOK, c)
+}
+
+func (s *Server) statsHandler(w http.ResponseWriter, _ *http.Request) {
+	s.writeJSON(w, http.StatusOK, s.stats.Stats())
+}
+
+// authorized returns true if the request carries token as a bearer token.
+func authorized(r *http.Request, token string) bool {
+	header := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(header, bearerPrefix) {
+		return false
+	}
+	given := strings.TrimPrefix(header, bearerPrefix)
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+func (s *Server) reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		s.writeJSON(w, http.StatusMethodNotAllowed, &Check{Status: StatusFailed, Error: "method not allowed"})
+		return
+	}
+
+	token := s.config.PgScale.HTTP.AdminToken
+	if token == nil {
+		s.writeJSON(w, http.StatusForbidden, &Check{Status: StatusFailed, Error: "admin_token is not set"})
+		return
+	}
+	if !authorized(r, *token) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		s.writeJSON(w, http.StatusUnauthorized, &Check{Status: StatusFailed, Error: "unauthorized"})
+		return
+	}
+
+	if err := s.reloader.Reload(); err != nil {
+		s.log.V(2).Printf("[ERROR] Failed to reload configuration: %v", err)
+		code := http.StatusInternalServerError
+		var restartErr *config.RestartRequiredError
+		if errors.As(err, &restartErr) {
+			code = http.StatusConflict
+		}
+		s.writeJSON(w, code, &Check{Status: StatusFailed, Error: err.Error()})
+		return
+	}
+	s.writeJSON(w, http.StatusOK, &Check{Status: StatusOK})
+}
+
+// Started returns a channel that's closed after the listener is bound.
+func (s *Server) Started() <-chan struct{} {
+	return s.started
+}
+
+// Addr returns the address of the listener. It's only valid after the server has started.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Listener returns the listener. It's only valid after the server has started.
+func (s *Server) Listener() net.Listener {
+	return s.listener
+}
+
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts HTTP connections on l, such as a listener that's inherited from another process.
+func (s *Server) Serve(l net.Listener) error {
+	s.listener = l
+	close(s.started)
+
+	s.log.V(1).Printf("[INFO] HTTP server is listening on %s", l.Addr())
+	err := s.server.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
@@ -0,0 +1,231 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/kontext"
+	"github.com/pgscale/pgscale/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+const testAdminToken = "secret"
+
+type checker map[string]error
+
+func (c checker) Ready(_ context.Context) map[string]error {
+	return c
+}
+
+type reloader func() error
+
+func (r reloader) Reload() error {
+	return r()
+}
+
+type statsReporter Stats
+
+func (s *statsReporter) Stats() *Stats {
+	return (*Stats)(s)
+}
+
+func newServer(t *testing.T, c Checker, r Reloader) *Server {
+	return newStatsServer(t, c, r, &statsReporter{})
+}
+
+func newStatsServer(t *testing.T, c Checker, r Reloader, sr StatsReporter) *Server {
+	token := testAdminToken
+	return startServer(t, &token, c, r, sr)
+}
+
+func startServer(t *testing.T, token *string, c Checker, r Reloader, sr StatsReporter) *Server {
+	cfg := &config.Config{}
+	cfg.PgScale.HTTP = &config.HTTP{
+		BindAddr:   "127.0.0.1",
+		BindPort:   "0",
+		AdminToken: token,
+	}
+
+	k := kontext.New()
+	k.Set(kontext.ConfigKey, cfg)
+	k.Set(kontext.LoggerKey, testutils.NewLogger())
+	k.Set(kontext.OlricKey, testutils.NewOlricInstance(t))
+
+	s, err := New(k, c, r, sr)
+	require.NoError(t, err)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.ListenAndServe()
+	}()
+	<-s.Started()
+
+	t.Cleanup(func() {
+		require.NoError(t, s.Shutdown(context.Background()))
+		require.NoError(t, <-errCh)
+	})
+	return s
+}
+
+func get(t *testing.T, s *Server, path string, value interface{}) int {
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", s.Addr(), path))
+	require.NoError(t, err)
+	return decode(t, resp, value)
+}
+
+func post(t *testing.T, s *Server, path, token string, value interface{}) int {
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%s%s", s.Addr(), path), nil)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return decode(t, resp, value)
+}
+
+func decode(t *testing.T, resp *http.Response, value interface{}) int {
+	defer resp.Body.Close()
+
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(value))
+	return resp.StatusCode
+}
+
+func TestHTTPAPI_Healthz(t *testing.T) {
+	s := newServer(t, checker{}, nil)
+
+	var c Check
+	require.Equal(t, http.StatusOK, get(t, s, "/healthz", &c))
+	require.Equal(t, StatusOK, c.Status)
+}
+
+func TestHTTPAPI_Readyz(t *testing.T) {
+	s := newServer(t, checker{
+		"olric":             nil,
+		"listener":          nil,
+		"database.postgres": nil,
+	}, nil)
+
+	var r Readiness
+	require.Equal(t, http.StatusOK, get(t, s, "/readyz", &r))
+	require.Equal(t, StatusOK, r.Status)
+	require.Len(t, r.Checks, 3)
+	require.Equal(t, Check{Status: StatusOK}, r.Checks["database.postgres"])
+}
+
+func TestHTTPAPI_Readyz_Unavailable(t *testing.T) {
+	s := newServer(t, checker{
+		"olric":             nil,
+		"listener":          nil,
+		"database.postgres": errors.New("connection refused"),
+	}, nil)
+
+	var r Readiness
+	require.Equal(t, http.StatusServiceUnavailable, get(t, s, "/readyz", &r))
+	require.Equal(t, StatusUnavailable, r.Status)
+	require.Equal(t, Check{Status: StatusOK}, r.Checks["olric"])
+	require.Equal(t, Check{Status: StatusUnavailable, Error: "connection refused"}, r.Checks["database.postgres"])
+}
+
+func TestHTTPAPI_Cluster(t *testing.T) {
+	s := newServer(t, checker{}, nil)
+
+	var c Cluster
+	require.Equal(t, http.StatusOK, get(t, s, "/cluster", &c))
+	require.Len(t, c.Members, 1)
+	require.Equal(t, c.Member, c.Coordinator)
+	require.Equal(t, c.Member, c.Members[0])
+	require.Greater(t, c.Partitions.Primary, 0)
+	require.Equal(t, 0, c.Partitions.Migrating)
+}
+
+func TestHTTPAPI_Reload(t *testing.T) {
+	var reloaded int
+	s := newServer(t, checker{}, reloader(func() error {
+		reloaded++
+		return nil
+	}))
+
+	var c Check
+	require.Equal(t, http.StatusMethodNotAllowed, get(t, s, "/reload", &c))
+	require.Equal(t, 0, reloaded)
+
+	require.Equal(t, http.StatusOK, post(t, s, "/reload", testAdminToken, &c))
+	require.Equal(t, StatusOK, c.Status)
+	require.Equal(t, 1, reloaded)
+}
+
+func TestHTTPAPI_Reload_Unauthorized(t *testing.T) {
+	var reloaded int
+	s := newServer(t, checker{}, reloader(func() error {
+		reloaded++
+		return nil
+	}))
+
+	var c Check
+	require.Equal(t, http.StatusUnauthorized, post(t, s, "/reload", "", &c))
+	require.Equal(t, http.StatusUnauthorized, post(t, s, "/reload", "wrong", &c))
+	require.Equal(t, StatusFailed, c.Status)
+	require.Equal(t, 0, reloaded)
+
+	// POST /reload is disabled without an admin_token.
+	s = startServer(t, nil, checker{}, reloader(func() error {
+		reloaded++
+		return nil
+	}), &statsReporter{})
+	require.Equal(t, http.StatusForbidden, post(t, s, "/reload", testAdminToken, &c))
+	require.Equal(t, 0, reloaded)
+}
+
+func TestHTTPAPI_Reload_RestartRequired(t *testing.T) {
+	s := newServer(t, checker{}, reloader(func() error {
+		return &config.RestartRequiredError{Fields: []string{"pgscale.bind_port"}}
+	}))
+
+	var c Check
+	require.Equal(t, http.StatusConflict, post(t, s, "/reload", testAdminToken, &c))
+	require.Equal(t, StatusFailed, c.Status)
+	require.Equal(t, "changes require restart: pgscale.bind_port", c.Error)
+}
+
+func TestHTTPAPI_Stats(t *testing.T) {
+	s := newStatsServer(t, checker{}, nil, &statsReporter{
+		Connections: Connections{
+			Total:         3,
+			Users:         map[string]int{"alice": 2, "bob": 1},
+			Databases:     map[string]int{"postgres": 3},
+			Rejected:      1,
+			MaxClientConn: 100,
+		},
+	})
+
+	var st Stats
+	require.Equal(t, http.StatusOK, get(t, s, "/stats", &st))
+	require.Equal(t, 3, st.Connections.Total)
+	require.Equal(t, map[string]int{"alice": 2, "bob": 1}, st.Connections.Users)
+	require.Equal(t, map[string]int{"postgres": 3}, st.Connections.Databases)
+	require.Equal(t, uint64(1), st.Connections.Rejected)
+	require.Equal(t, 100, st.Connections.MaxClientConn)
+	require.Equal(t, 0, st.Connections.MaxUserConnections)
+}
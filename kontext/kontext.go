@@ -20,12 +20,19 @@ import (
 )
 
 const (
-	LoggerKey  = "logger"
-	ConfigKey  = "config"
-	OlricKey   = "olric"
-	DMapsKey   = "dmaps"
-	DBConnKey  = "connpool"
-	SessionKey = "session"
+	LoggerKey       = "logger"
+	ConfigKey       = "config"
+	OlricKey        = "olric"
+	DMapsKey        = "dmaps"
+	DBConnKey       = "connpool"
+	SessionKey      = "session"
+	SlowLogKey      = "slowlog"
+	TracingKey      = "tracing"
+	TraceContextKey = "tracecontext"
+	AuditorKey      = "auditor"
+	ListenersKey    = "listeners"
+	ListenerKey     = "listener"
+	ReloaderKey     = "reloader"
 )
 
 var ErrInvalidType = errors.New("invalid type")
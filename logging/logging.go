@@ -0,0 +1,264 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package logging implements the structured logger of PgScale. It keeps the verbosity
+semantics of flog: log lines are written with V(n).Printf and the level of a line is
+denoted by its prefix, such as [INFO] or [ERROR]. Key/value fields can be attached to
+a logger with With. The output is either free-form text or JSON lines.
+*/
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/logutils"
+	"github.com/pgscale/pgscale/kontext"
+)
+
+var ErrLoggerNotFound = errors.New("logger not found")
+
+const (
+	TextFormat = "text"
+	JSONFormat = "json"
+)
+
+const (
+	DebugLevel = "DEBUG"
+	WarnLevel  = "WARN"
+	ErrorLevel = "ERROR"
+	InfoLevel  = "INFO"
+)
+
+// Field is a key/value pair attached to a log line.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F creates a new Field.
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+type core struct {
+	mtx sync.Mutex
+
+	out         io.Writer
+	std         *log.Logger
+	filter      *logutils.LevelFilter
+	format      string
+	level       int32
+	showLineNum int32
+}
+
+// Logger is a leveled and structured logger. A Logger can be used simultaneously
+// from multiple goroutines.
+type Logger struct {
+	core   *core
+	fields []Field
+}
+
+// New returns a new Logger that writes to out. format is either TextFormat or
+// JSONFormat, minLevel is the minimum level of lines to write.
+func New(out io.Writer, format, minLevel string) (*Logger, error) {
+	switch format {
+	case "":
+		format = TextFormat
+	case TextFormat, JSONFormat:
+	default:
+		return nil, fmt.Errorf("invalid log format: %s", format)
+	}
+
+	filter := &logutils.LevelFilter{
+		Levels: []logutils.LogLevel{
+			DebugLevel,
+			WarnLevel,
+			ErrorLevel,
+			InfoLevel,
+		},
+		MinLevel: logutils.LogLevel(strings.ToUpper(minLevel)),
+		Writer:   out,
+	}
+	return &Logger{
+		core: &core{
+			out:    out,
+			std:    log.New(filter, "", log.LstdFlags),
+			filter: filter,
+			format: format,
+		},
+	}, nil
+}
+
+// SetLevel sets verbosity level.
+func (l *Logger) SetLevel(level int32) {
+	if level < 0 {
+		return
+	}
+	atomic.StoreInt32(&l.core.level, level)
+}
+
+// ShowLineNumber enables line number support if show is bigger than zero.
+func (l *Logger) ShowLineNumber(show int32) {
+	if show < 0 {
+		return
+	}
+	atomic.StoreInt32(&l.core.showLineNum, show)
+}
+
+// With returns a child logger that attaches the given fields to every line. A field
+// overrides the parent's field with the same key.
+func (l *Logger) With(fields ...Field) *Logger {
+	merged := make([]Field, 0, len(l.fields)+len(fields))
+	merged = append(merged, l.fields...)
+	for _, f := range fields {
+		overridden := false
+		for i := range merged {
+			if merged[i].Key == f.Key {
+				merged[i] = f
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			merged = append(merged, f)
+		}
+	}
+	return &Logger{
+		core:   l.core,
+		fields: merged,
+	}
+}
+
+// Verbose is a type that implements Printf with verbosity support.
+type Verbose struct {
+	ok bool
+	l  *Logger
+}
+
+// V reports whether verbosity at the call site is at least the requested level.
+func (l *Logger) V(level int32) Verbose {
+	return Verbose{
+		ok: atomic.LoadInt32(&l.core.level) >= level,
+		l:  l,
+	}
+}
+
+// Ok will return true if this log level is enabled, guarded by the value of verbosity level.
+func (v Verbose) Ok() bool {
+	return v.ok
+}
+
+// Printf writes a log line. Arguments are handled in the manner of fmt.Printf.
+func (v Verbose) Printf(format string, i ...interface{}) {
+	if !v.ok {
+		return
+	}
+
+	var caller string
+	if atomic.LoadInt32(&v.l.core.showLineNum) == 1 {
+		_, fn, line, _ := runtime.Caller(1)
+		caller = fmt.Sprintf("%s:%d", path.Base(fn), line)
+	}
+
+	msg := fmt.Sprintf(format, i...)
+	if v.l.core.format == JSONFormat {
+		v.l.writeJSON(msg, caller)
+		return
+	}
+	v.l.writeText(msg, caller)
+}
+
+func (l *Logger) writeText(msg, caller string) {
+	var b strings.Builder
+	b.WriteString(msg)
+	if caller != "" {
+		b.WriteString(" => ")
+		b.WriteString(caller)
+	}
+	for _, f := range l.fields {
+		b.WriteString(fmt.Sprintf(" %s=%v", f.Key, f.Value))
+	}
+	l.core.std.Print(b.String())
+}
+
+// splitLevel extracts the level prefix, such as [INFO], from a message.
+func splitLevel(msg string) (string, string) {
+	if !strings.HasPrefix(msg, "[") {
+		return InfoLevel, msg
+	}
+	idx := strings.IndexByte(msg, ']')
+	if idx < 0 {
+		return InfoLevel, msg
+	}
+	return msg[1:idx], strings.TrimSpace(msg[idx+1:])
+}
+
+func (l *Logger) writeJSON(msg, caller string) {
+	level, msg := splitLevel(msg)
+	if !l.core.filter.Check([]byte("[" + level + "]")) {
+		return
+	}
+
+	entry := make(map[string]interface{}, len(l.fields)+4)
+	for _, f := range l.fields {
+		if err, ok := f.Value.(error); ok {
+			entry[f.Key] = err.Error()
+			continue
+		}
+		entry[f.Key] = f.Value
+	}
+	entry["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level
+	entry["msg"] = msg
+	if caller != "" {
+		entry["caller"] = caller
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(entry); err != nil {
+		// Don't lose the line.
+		buf.Reset()
+		buf.WriteString(fmt.Sprintf("{\"level\":%q,\"msg\":%q}\n", level, msg))
+	}
+
+	l.core.mtx.Lock()
+	defer l.core.mtx.Unlock()
+	_, _ = l.core.out.Write(buf.Bytes())
+}
+
+func FromKontext(k *kontext.Kontext) (*Logger, error) {
+	i := k.Get(kontext.LoggerKey)
+	if i == nil {
+		return nil, ErrLoggerNotFound
+	}
+
+	l, ok := i.(*Logger)
+	if !ok {
+		return nil, fmt.Errorf("logger: %w", kontext.ErrInvalidType)
+	}
+
+	return l, nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pgscale/pgscale/kontext"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogging_Text(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	l, err := New(buf, TextFormat, InfoLevel)
+	require.NoError(t, err)
+	l.SetLevel(3)
+
+	lg := l.With(F("component", "proxy"), F("user", "dbuser"))
+	lg.V(3).Printf("[INFO] Hello, %s", "world")
+	require.Contains(t, buf.String(), "[INFO] Hello, world component=proxy user=dbuser")
+
+	buf.Reset()
+	lg.V(4).Printf("[INFO] Too verbose")
+	require.Empty(t, buf.String())
+}
+
+func TestLogging_JSON(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	l, err := New(buf, JSONFormat, WarnLevel)
+	require.NoError(t, err)
+	l.SetLevel(3)
+
+	lg := l.With(F("component", "postgresql")).With(F("component", "proxy"), F("duration_ms", 1.5))
+	lg.V(3).Printf("[ERROR] Failed to cache query response: %s", "timeout")
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, "ERROR", entry["level"])
+	require.Equal(t, "Failed to cache query response: timeout", entry["msg"])
+	require.Equal(t, "proxy", entry["component"])
+	require.Equal(t, 1.5, entry["duration_ms"])
+	require.NotEmpty(t, entry["ts"])
+
+	t.Run("Filter by level", func(t *testing.T) {
+		buf.Reset()
+		lg.V(3).Printf("[DEBUG] Client is gone")
+		require.Empty(t, strings.TrimSpace(buf.String()))
+	})
+}
+
+func TestLogging_InvalidFormat(t *testing.T) {
+	_, err := New(bytes.NewBuffer(nil), "xml", InfoLevel)
+	require.Error(t, err)
+}
+
+func TestLogging_FromKontext(t *testing.T) {
+	ktx := kontext.New()
+	_, err := FromKontext(ktx)
+	require.Equal(t, ErrLoggerNotFound, err)
+
+	ktx.Set(kontext.LoggerKey, struct{}{})
+	_, err = FromKontext(ktx)
+	require.ErrorIs(t, err, kontext.ErrInvalidType)
+
+	l, err := New(bytes.NewBuffer(nil), TextFormat, InfoLevel)
+	require.NoError(t, err)
+	ktx.Set(kontext.LoggerKey, l)
+	extracted, err := FromKontext(ktx)
+	require.NoError(t, err)
+	require.Equal(t, l, extracted)
+}
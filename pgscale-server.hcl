@@ -1,6 +1,36 @@
 pgscale {
   bind_addr = "127.0.0.1"
   bind_port = 6957
+  shutdown_timeout = "30s"
+
+  # Clients on the same host can connect to .s.PGSQL.<bind_port> in
+  # unix_socket_dir, such as psql -h /var/run/pgscale. The socket is accessible by
+  # everyone by default.
+  # unix_socket_dir = "/var/run/pgscale"
+  # unix_socket_mode = "0770"
+
+  # Read the client address from the HAProxy PROXY protocol v1/v2 header if PgScale
+  # is behind a TCP load balancer. "optional" accepts the connections without a
+  # header, "required" closes them. The Unix domain socket doesn't use the header.
+  # Only the load balancers in proxy_protocol_trusted_sources can send a header, the
+  # other peers would forge the client address.
+  # proxy_protocol = "required"
+  # proxy_protocol_trusted_sources = ["10.0.0.0/8", "192.168.1.10"]
+
+  # Client connections in total, per user and per database. Clients that exceed a
+  # limit get a too_many_connections error. Zero or unset means no limit, databases
+  # can override max_db_connections.
+  # max_client_conn = 1000
+  # max_user_connections = 100
+  # max_db_connections = 200
+
+  # Clients that don't complete the startup in client_login_timeout (60s by
+  # default) are disconnected, as well as the clients that are idle for longer than
+  # client_idle_timeout, or idle_transaction_timeout in a transaction. The open
+  # transaction is rolled back and the server connection is returned to the pool.
+  # client_login_timeout = "60s"
+  # client_idle_timeout = "1h"
+  # idle_transaction_timeout = "5m"
 
   auth {
     users = {
@@ -11,17 +41,118 @@ pgscale {
       dbuser = {
         auth_type = "password"
         password = "1234"
+        # Users can override query_timeout and max_result_bytes of the databases.
+        # query_timeout = "5m"
+        # max_result_bytes = "104857600"
       }
+      # Secrets can be read from the environment or from a file:
+      # appuser = {
+      #   auth_type = "password"
+      #   password = env("PGSCALE_APPUSER_PASSWORD")
+      # }
+      # reporter = {
+      #   auth_type = "password"
+      #   password = file("/run/secrets/reporter-password")
+      # }
     }
+
+    # Users that are not listed above are looked up in a userlist.txt of PgBouncer,
+    # the file is read again when it's changed.
+    # auth_file = "/etc/pgscale/userlist.txt"
+
+    # Then on the backend, the results are cached on the cluster for cache_ttl. The
+    # md5 and SCRAM-SHA-256 verifiers are supported, the unknown users are cached too.
+    # auth_query {
+    #   query = "SELECT usename, passwd FROM pg_shadow WHERE usename=$1"
+    #   dbname = "postgres"
+    #   parameters = {
+    #     user = "pgscale_auth"
+    #     password = env("PGSCALE_AUTH_PASSWORD")
+    #     host = "localhost"
+    #     port = 5432
+    #   }
+    #   max_conns = 2
+    #   cache_ttl = "1m"
+    # }
+
+    # The admin users connect to the pgscale database, such as with
+    # "psql -h 127.0.0.1 -p 6957 -U admin pgscale", and run RELOAD to reload this
+    # file like SIGHUP.
+    # admin_users = ["admin"]
   }
 
   logging {
     verbosity = 6
     level = "DEBUG"
+    output = "stderr"
+    format = "text"
+    perm = 0644
+  }
+
+  slow_query_log {
     output = "stderr"
     perm = 0644
   }
 
+  # tracing {
+  #   endpoint = "localhost:4318"
+  #   insecure = true
+  #   service_name = "pgscale"
+  #   sample_ratio = 1.0
+  # }
+
+  # audit {
+  #   output = "/var/log/pgscale/audit.log"
+  #   perm = 0600
+  #   max_size = 100 # megabytes
+  #   max_backups = 5
+  #
+  #   syslog {
+  #     facility = "AUTHPRIV"
+  #     tag = "pgscale-audit"
+  #   }
+  # }
+
+  # SIGHUP and the RELOAD command of admin_users reload the configuration file.
+  # POST /reload reloads it over HTTP too, it requires
+  # "Authorization: Bearer <admin_token>" and is disabled if admin_token is not set.
+  http {
+    bind_addr = "127.0.0.1"
+    bind_port = 6958
+    # admin_token = "change-me"
+  }
+
+  # SIGUSR2 starts a new process that inherits the listeners. It joins the Olric
+  # cluster on the alternate ports below before the old process drains and quits.
+  # upgrade {
+  #   timeout = "60s"
+  #   olric_bind_port = 3330
+  #   memberlist_bind_port = 3332
+  # }
+
+  # Clients can request TLS by SSLRequest. mode is "prefer" by default, "require"
+  # rejects the clients that don't request TLS.
+  # tls {
+  #   cert_file = "/etc/pgscale/server.crt"
+  #   key_file = "/etc/pgscale/server.key"
+  #   mode = "prefer"
+  # }
+
+  # Additional endpoints. Clients of a listener can only connect to its databases,
+  # all of them if databases is empty. policy overrides the connection pool policy
+  # of the databases and tls replaces the block above.
+  # listener "analytics" {
+  #   bind_addr = "0.0.0.0"
+  #   bind_port = "6958"
+  #   databases = ["somedatabase"]
+  #   policy = "session"
+  #   tls {
+  #     cert_file = "/etc/pgscale/server.crt"
+  #     key_file = "/etc/pgscale/server.key"
+  #     mode = "require"
+  #   }
+  # }
+
   postgresql {
     database "postgres" {
       parameters = {
@@ -33,6 +164,18 @@ pgscale {
       log_statements = true
       reset_query = "DISCARD ALL"
 
+      # Authenticate the clients on the backend with their own credentials. The
+      # user of the parameters is not used, every user gets a pool.
+      # passthrough_auth = true
+      # Every login is verified on the backend. The number of users that get a pool
+      # is limited by max_passthrough_users, 100 by default and 0 for no limit.
+      # max_passthrough_users = 100
+
+      # The proxy cancels the queries that run longer than query_timeout or return
+      # more than max_result_bytes, and returns an error to the client.
+      # query_timeout = "30s"
+      # max_result_bytes = 10485760
+
       connection_pool {
         policy              = "session"
         max_conns           = 50
@@ -40,6 +183,15 @@ pgscale {
         max_conn_lifetime   = "1h"
         max_conn_idle_time  = "15m"
         health_check_period = "1m"
+
+        # Clients wait for a server connection in FIFO order. query_wait_timeout
+        # is 120s by default, zero disables it. The reserve pool gives extra
+        # connections to the clients that have waited longer than
+        # reserve_pool_timeout.
+        # query_wait_timeout   = "120s"
+        # max_wait_clients     = 100
+        # reserve_pool_size    = 5
+        # reserve_pool_timeout = "5s"
       }
     }
 
@@ -60,6 +212,7 @@ pgscale {
       }
 
       log_statements = true
+      slow_query_threshold = "500ms"
       reset_query = "DISCARD ALL"
 
       cache "public" {
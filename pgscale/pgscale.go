@@ -15,34 +15,46 @@
 package pgscale
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
 	"net"
 	"os"
-	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/buraksezer/olric"
-	"github.com/buraksezer/olric/pkg/flog"
-	"github.com/hashicorp/logutils"
+	"github.com/pgscale/pgscale/audit"
 	"github.com/pgscale/pgscale/config"
 	"github.com/pgscale/pgscale/dmaps"
+	"github.com/pgscale/pgscale/httpapi"
 	"github.com/pgscale/pgscale/kontext"
+	"github.com/pgscale/pgscale/logging"
 	"github.com/pgscale/pgscale/postgresql"
+	"github.com/pgscale/pgscale/slowlog"
+	"github.com/pgscale/pgscale/tracing"
+	"github.com/pgscale/pgscale/upgrade"
 	"github.com/pgscale/pgscale/utils"
 )
 
 type PgScale struct {
+	// mtx serializes reloads and protects config.
+	mtx               sync.Mutex
 	config            *config.Config
-	log               *flog.Logger
+	log               *logging.Logger
+	slowlog           *slowlog.SlowLog
+	tracing           *tracing.Tracing
+	auditor           *audit.Auditor
 	postgres          *postgresql.PostgreSQL
+	http              *httpapi.Server
+	inherited         map[string]net.Listener
 	olric             *olric.Olric
 	dmaps             *dmaps.DMaps
 	shutdownCallbacks []func()
 }
 
-func (d *PgScale) configureLogger(c *config.Config) (*flog.Logger, error) {
+func (d *PgScale) configureLogger(c *config.Config) (*logging.Logger, error) {
 	var out *os.File
 
 	switch c.PgScale.Logging.Output {
@@ -63,19 +75,14 @@ func (d *PgScale) configureLogger(c *config.Config) (*flog.Logger, error) {
 		})
 	}
 
-	filter := &logutils.LevelFilter{
-		Levels: []logutils.LogLevel{
-			config.DebugLog,
-			config.WarnLog,
-			config.ErrorLog,
-			config.InfoLog,
-		},
-		MinLevel: logutils.LogLevel(strings.ToUpper(c.PgScale.Logging.Level)),
-		Writer:   out,
+	var format string
+	if c.PgScale.Logging.Format != nil {
+		format = *c.PgScale.Logging.Format
+	}
+	logger, err := logging.New(out, format, c.PgScale.Logging.Level)
+	if err != nil {
+		return nil, err
 	}
-	l := log.New(out, "", log.LstdFlags)
-	l.SetOutput(filter)
-	logger := flog.New(l)
 	logger.SetLevel(c.PgScale.Logging.Verbosity)
 	if c.PgScale.Logging.Level == config.DebugLog {
 		logger.ShowLineNumber(1)
@@ -94,32 +101,219 @@ func New(k *kontext.Kontext) (*PgScale, error) {
 		return nil, err
 	}
 
+	inherited, err := upgrade.ListenersFromKontext(k)
+	if err != nil {
+		return nil, err
+	}
+
 	d := &PgScale{
 		config:            c,
 		olric:             db,
 		dmaps:             dmaps.New(db),
+		inherited:         inherited,
 		shutdownCallbacks: []func(){},
 	}
 	l, err := d.configureLogger(c)
 	if err != nil {
 		return nil, err
 	}
-	d.log = l
-	return d, err
+	d.log = l.With(logging.F("component", "pgscale"))
+
+	sl, err := slowlog.New(c.PgScale.SlowQueryLog)
+	if err != nil {
+		return nil, err
+	}
+	d.slowlog = sl
+	d.shutdownCallbacks = append(d.shutdownCallbacks, func() {
+		if err := sl.Close(); err != nil {
+			d.log.V(3).Printf("[ERROR] Failed to close slow query log: %v", err)
+		}
+	})
+
+	tr, err := tracing.New(c.PgScale.Tracing)
+	if err != nil {
+		return nil, err
+	}
+	d.tracing = tr
+	d.shutdownCallbacks = append(d.shutdownCallbacks, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tr.Shutdown(ctx); err != nil {
+			d.log.V(3).Printf("[ERROR] Failed to flush spans: %v", err)
+		}
+	})
+
+	au, err := audit.New(c.PgScale.Audit)
+	if err != nil {
+		return nil, err
+	}
+	d.auditor = au
+	d.shutdownCallbacks = append(d.shutdownCallbacks, func() {
+		if err := au.Close(); err != nil {
+			d.log.V(3).Printf("[ERROR] Failed to close audit log: %v", err)
+		}
+	})
+
+	pk := kontext.New()
+	pk.Set(kontext.LoggerKey, d.log)
+	pk.Set(kontext.ConfigKey, d.config)
+	pk.Set(kontext.DMapsKey, d.dmaps)
+	pk.Set(kontext.SlowLogKey, d.slowlog)
+	pk.Set(kontext.TracingKey, d.tracing)
+	pk.Set(kontext.AuditorKey, d.auditor)
+	pk.Set(kontext.ListenersKey, d.inherited)
+	pk.Set(kontext.ReloaderKey, d)
+	p, err := postgresql.New(pk)
+	if err != nil {
+		return nil, err
+	}
+	d.postgres = p
+
+	if c.PgScale.HTTP != nil {
+		hk := kontext.New()
+		hk.Set(kontext.LoggerKey, d.log)
+		hk.Set(kontext.ConfigKey, d.config)
+		hk.Set(kontext.OlricKey, d.olric)
+		hs, err := httpapi.New(hk, d, d, d)
+		if err != nil {
+			return nil, err
+		}
+		d.http = hs
+		d.shutdownCallbacks = append(d.shutdownCallbacks, func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := hs.Shutdown(ctx); err != nil {
+				d.log.V(3).Printf("[ERROR] Failed to shutdown HTTP server: %v", err)
+			}
+		})
+	}
+	return d, nil
 }
 
-func (d *PgScale) ListenAndServe() error {
-	k := kontext.New()
-	k.Set(kontext.LoggerKey, d.log)
-	k.Set(kontext.ConfigKey, d.config)
-	k.Set(kontext.DMapsKey, d.dmaps)
-	p, err := postgresql.New(k)
+// Ready checks the embedded Olric node, the PostgreSQL listener and every database pool.
+// It implements httpapi.Checker.
+func (d *PgScale) Ready(ctx context.Context) map[string]error {
+	result := make(map[string]error)
+
+	// Stats returns an error until the node has joined the cluster.
+	_, err := d.olric.Stats()
+	result["olric"] = err
+
+	result["listener"] = nil
+	if !d.postgres.Listening() {
+		result["listener"] = errors.New("not listening")
+	}
+
+	for name, err := range d.postgres.CheckPools(ctx) {
+		result["database."+name] = err
+	}
+	return result
+}
+
+// Stats returns the client connections of the PostgreSQL proxy and the limits of the
+// running configuration. It implements httpapi.StatsReporter.
+func (d *PgScale) Stats() *httpapi.Stats {
+	d.mtx.Lock()
+	c := d.config
+	d.mtx.Unlock()
+
+	cs := d.postgres.ConnStats()
+	return &httpapi.Stats{
+		Connections: httpapi.Connections{
+			Total:              cs.Total,
+			Users:              cs.Users,
+			Databases:          cs.Databases,
+			Rejected:           cs.Rejected,
+			MaxClientConn:      config.Limit(c.PgScale.MaxClientConn),
+			MaxUserConnections: config.Limit(c.PgScale.MaxUserConnections),
+			MaxDBConnections:   config.Limit(c.PgScale.MaxDBConnections),
+		},
+	}
+}
+
+// Reload reads the configuration file again and applies the changes to users, databases,
+// cache tables and logging verbosity. It returns an error without applying anything
+// if the new configuration changes settings that require restart.
+func (d *PgScale) Reload() error {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	c, err := config.New(d.config.Filename)
 	if err != nil {
 		return err
 	}
-	d.postgres = p
+	// Keep the Olric ports of a process that's started by an upgrade.
+	if err = upgrade.ApplyOlric(c); err != nil {
+		return err
+	}
+
+	if err = config.CheckReload(d.config, c); err != nil {
+		return err
+	}
+
+	changed, err := config.ChangedDMaps(d.config, c)
+	if err != nil {
+		return err
+	}
+	config.AssignDMapNames(c)
+
+	if err = d.postgres.Reload(c); err != nil {
+		return err
+	}
+	d.log.SetLevel(c.PgScale.Logging.Verbosity)
+	d.config = c
+
+	for _, name := range changed {
+		d.log.With(logging.F("dmap", name)).V(2).Printf("[WARN] Eviction and TTL settings of the cache table will be applied after restart")
+	}
+	d.log.V(1).Printf("[INFO] Configuration has been reloaded from %s", c.Filename)
+	return nil
+}
+
+// ListenAndServeHTTP runs the HTTP server for health, readiness and cluster endpoints.
+// It returns immediately if the server is not configured.
+func (d *PgScale) ListenAndServeHTTP() error {
+	if d.http == nil {
+		return nil
+	}
+	if l, ok := d.inherited[upgrade.HTTPListener]; ok {
+		return d.http.Serve(l)
+	}
+	return d.http.ListenAndServe()
+}
 
-	err = p.ListenAndServe()
+// Started returns a channel that's closed after the PostgreSQL proxy starts to accept connections.
+func (d *PgScale) Started() <-chan struct{} {
+	return d.postgres.Started()
+}
+
+// Listeners returns the listeners to pass to a new process by upgrade.
+func (d *PgScale) Listeners() (map[string]net.Listener, error) {
+	l := d.postgres.Listener()
+	if l == nil {
+		return nil, errors.New("PostgreSQL proxy is not listening")
+	}
+	listeners := d.postgres.Listeners()
+	listeners[upgrade.PostgreSQLListener] = l
+
+	if d.http != nil {
+		select {
+		case <-d.http.Started():
+			listeners[upgrade.HTTPListener] = d.http.Listener()
+		default:
+			return nil, errors.New("HTTP server is not listening")
+		}
+	}
+	return listeners, nil
+}
+
+func (d *PgScale) ListenAndServe() error {
+	var err error
+	if l, ok := d.inherited[upgrade.PostgreSQLListener]; ok {
+		err = d.postgres.Serve(l)
+	} else {
+		err = d.postgres.ListenAndServe()
+	}
 	opErr, ok := err.(*net.OpError)
 	if !ok {
 		return err
@@ -143,10 +337,13 @@ func (d *PgScale) ListenAndServe() error {
 }
 
 func (d *PgScale) Shutdown() error {
+	// Drain the clients first, the logger, the audit log and the HTTP server are
+	// still in use until the connections are closed.
+	err := d.postgres.Shutdown()
 	if d.shutdownCallbacks != nil {
 		for _, f := range d.shutdownCallbacks {
 			f()
 		}
 	}
-	return d.postgres.Shutdown()
+	return err
 }
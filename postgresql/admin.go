@@ -0,0 +1,214 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgresql
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/pgscale/pgscale/audit"
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/logging"
+	"github.com/pgscale/pgscale/postgresql/auth"
+)
+
+// ReloadCommand reloads the configuration file like SIGHUP.
+const ReloadCommand = "RELOAD"
+
+// Reloader applies the configuration file to the running process.
+type Reloader interface {
+	Reload() error
+}
+
+// adminConsole serves the admin commands of a user in admin_users on the admin
+// database. The commands are run by PgScale, they are not sent to a backend.
+type adminConsole struct {
+	mtx      sync.Mutex
+	conn     net.Conn
+	backend  *pgproto3.Backend
+	session  *auth.Session
+	reloader Reloader
+	auditor  *audit.Auditor
+	log      *logging.Logger
+
+	// busy is set while a command is running, drain terminates the connection after it.
+	busy     bool
+	draining bool
+
+	// extendedFailed is set after an extended query message, the messages are
+	// discarded until Sync.
+	extendedFailed bool
+}
+
+func newAdminConsole(conn net.Conn, session *auth.Session, reloader Reloader, auditor *audit.Auditor, lg *logging.Logger) *adminConsole {
+	return &adminConsole{
+		conn:     conn,
+		backend:  pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn),
+		session:  session,
+		reloader: reloader,
+		auditor:  auditor,
+		log:      lg.With(logging.F("user", session.User), logging.F("client_addr", conn.RemoteAddr().String())),
+	}
+}
+
+// serve runs the commands of the client until it terminates the connection. The
+// startup has been completed by auth, the client is waiting for a command.
+func (a *adminConsole) serve() error {
+	for {
+		msg, err := a.backend.Receive()
+		if err != nil {
+			if a.isDraining() {
+				// Drain has closed the connection.
+				return nil
+			}
+			return err
+		}
+
+		a.mtx.Lock()
+		if a.draining {
+			// Drain has terminated the connection.
+			a.mtx.Unlock()
+			return nil
+		}
+		a.busy = true
+		a.mtx.Unlock()
+
+		done, err := a.handle(msg)
+
+		a.mtx.Lock()
+		a.busy = false
+		draining := a.draining
+		a.mtx.Unlock()
+		if err != nil || done {
+			return err
+		}
+		if draining {
+			return a.terminate()
+		}
+	}
+}
+
+func (a *adminConsole) handle(msg pgproto3.FrontendMessage) (bool, error) {
+	switch m := msg.(type) {
+	case *pgproto3.Query:
+		return false, a.query(m.String)
+	case *pgproto3.Terminate:
+		return true, nil
+	case *pgproto3.Sync:
+		a.extendedFailed = false
+		return false, a.send(&pgproto3.ReadyForQuery{TxStatus: IdleTxStatus})
+	case *pgproto3.Flush:
+		return false, nil
+	default:
+		if a.extendedFailed {
+			return false, nil
+		}
+		a.extendedFailed = true
+		return false, a.send(&pgproto3.ErrorResponse{
+			Severity: "ERROR",
+			Code:     "0A000",
+			Message:  "extended query protocol is not supported by the admin console",
+		})
+	}
+}
+
+func (a *adminConsole) query(query string) error {
+	command := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(query), ";"))
+	if command == "" {
+		return a.send(&pgproto3.EmptyQueryResponse{}, &pgproto3.ReadyForQuery{TxStatus: IdleTxStatus})
+	}
+
+	if !strings.EqualFold(command, ReloadCommand) {
+		return a.send(&pgproto3.ErrorResponse{
+			Severity: "ERROR",
+			Code:     "42601",
+			Message:  fmt.Sprintf("invalid admin command: %q, the admin console supports %s", command, ReloadCommand),
+		}, &pgproto3.ReadyForQuery{TxStatus: IdleTxStatus})
+	}
+
+	auditErr := a.auditor.Record(&audit.Event{
+		Type:       audit.StatementEvent,
+		User:       a.session.User,
+		Database:   a.session.Database,
+		ClientAddr: a.conn.RemoteAddr().String(),
+		Class:      audit.UtilityClass,
+		Command:    ReloadCommand,
+		Statement:  query,
+	})
+	if auditErr != nil {
+		a.log.V(3).Printf("[ERROR] Failed to write audit record: %v", auditErr)
+	}
+
+	if err := a.reload(); err != nil {
+		a.log.V(2).Printf("[ERROR] Failed to reload configuration: %v", err)
+		code := "XX000"
+		var restartErr *config.RestartRequiredError
+		if errors.As(err, &restartErr) {
+			code = "55000"
+		}
+		return a.send(&pgproto3.ErrorResponse{
+			Severity: "ERROR",
+			Code:     code,
+			Message:  err.Error(),
+		}, &pgproto3.ReadyForQuery{TxStatus: IdleTxStatus})
+	}
+	a.log.V(2).Printf("[INFO] Configuration has been reloaded by admin command")
+	return a.send(&pgproto3.CommandComplete{CommandTag: []byte(ReloadCommand)}, &pgproto3.ReadyForQuery{TxStatus: IdleTxStatus})
+}
+
+func (a *adminConsole) reload() error {
+	if a.reloader == nil {
+		return errors.New("configuration reload is not available")
+	}
+	return a.reloader.Reload()
+}
+
+func (a *adminConsole) send(msgs ...pgproto3.BackendMessage) error {
+	var buf []byte
+	for _, msg := range msgs {
+		buf = msg.Encode(buf)
+	}
+	_, err := a.conn.Write(buf)
+	return err
+}
+
+func (a *adminConsole) isDraining() bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	return a.draining
+}
+
+func (a *adminConsole) terminate() error {
+	return timeoutResponse(a.conn, "57P01", ErrAdminShutdown)
+}
+
+// Drain terminates the connection if the console is idle, or after the running command.
+func (a *adminConsole) Drain() {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	a.draining = true
+	if a.busy {
+		return
+	}
+
+	_ = a.terminate()
+	_ = a.conn.Close()
+}
@@ -0,0 +1,246 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgresql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/pgscale/pgscale/audit"
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/postgresql/auth"
+	"github.com/pgscale/pgscale/testutils"
+	"github.com/pgscale/pgscale/tracing"
+	"github.com/stretchr/testify/require"
+)
+
+type reloaderFunc func() error
+
+func (f reloaderFunc) Reload() error {
+	return f()
+}
+
+func newTestAdminServer(t *testing.T, reloader Reloader, auditOutput *string) *PostgreSQL {
+	c := &config.Config{}
+	c.PgScale.Auth.Users = map[string]map[string]string{
+		"admin": {"auth_type": config.TrustAuthType},
+		"app":   {"auth_type": config.TrustAuthType},
+	}
+	c.PgScale.Auth.AdminUsers = []string{"admin"}
+
+	users, err := auth.NewUsers(c, nil)
+	require.NoError(t, err)
+	tr, err := tracing.New(nil)
+	require.NoError(t, err)
+	var auditConfig *config.Audit
+	if auditOutput != nil {
+		auditConfig = &config.Audit{Output: auditOutput}
+	}
+	au, err := audit.New(auditConfig)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = au.Close()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	return &PostgreSQL{
+		log:      testutils.NewLogger(),
+		config:   c,
+		users:    users,
+		tracing:  tr,
+		auditor:  au,
+		limits:   newConnLimits(),
+		reloader: reloader,
+		ctx:      ctx,
+		cancel:   cancel,
+		proxies:  make(map[*Proxy]struct{}),
+		admins:   make(map[*adminConsole]struct{}),
+	}
+}
+
+// connectAdmin runs the startup of user on the admin database. The returned channel
+// receives the result of the session.
+func connectAdmin(t *testing.T, p *PostgreSQL, user string) (*pgproto3.Frontend, <-chan error) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.proxyHandler(server, &listener{})
+	}()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(client), client)
+	require.NoError(t, frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": user, "database": config.AdminDatabase},
+	}))
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.AuthenticationOk{}, msg)
+	for {
+		msg, err = frontend.Receive()
+		require.NoError(t, err)
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			break
+		}
+	}
+	return frontend, errCh
+}
+
+// adminQuery runs a query and returns the response before ReadyForQuery.
+func adminQuery(t *testing.T, frontend *pgproto3.Frontend, query string) pgproto3.BackendMessage {
+	require.NoError(t, frontend.Send(&pgproto3.Query{String: query}))
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	rfq, err := frontend.Receive()
+	require.NoError(t, err)
+	require.Equal(t, &pgproto3.ReadyForQuery{TxStatus: IdleTxStatus}, rfq)
+	return msg
+}
+
+func TestAdminConsole_Reload(t *testing.T) {
+	var reloads int
+	output := filepath.Join(t.TempDir(), "audit.log")
+	p := newTestAdminServer(t, reloaderFunc(func() error {
+		reloads++
+		return nil
+	}), &output)
+	frontend, errCh := connectAdmin(t, p, "admin")
+
+	msg := adminQuery(t, frontend, "reload;")
+	require.Equal(t, &pgproto3.CommandComplete{CommandTag: []byte(ReloadCommand)}, msg)
+	require.Equal(t, 1, reloads)
+
+	msg = adminQuery(t, frontend, " ")
+	require.IsType(t, &pgproto3.EmptyQueryResponse{}, msg)
+
+	require.NoError(t, frontend.Send(&pgproto3.Terminate{}))
+	require.NoError(t, <-errCh)
+
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	var statements []audit.Event
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte{'\n'}) {
+		var e audit.Event
+		require.NoError(t, json.Unmarshal(line, &e))
+		if e.Type == audit.StatementEvent {
+			statements = append(statements, e)
+		}
+	}
+	require.Len(t, statements, 1)
+	require.Equal(t, "admin", statements[0].User)
+	require.Equal(t, audit.UtilityClass, statements[0].Class)
+	require.Equal(t, ReloadCommand, statements[0].Command)
+	require.Equal(t, "reload;", statements[0].Statement)
+}
+
+func TestAdminConsole_Reload_Errors(t *testing.T) {
+	p := newTestAdminServer(t, reloaderFunc(func() error {
+		return &config.RestartRequiredError{Fields: []string{"pgscale.bind_port"}}
+	}), nil)
+	frontend, errCh := connectAdmin(t, p, "admin")
+
+	msg := adminQuery(t, frontend, "RELOAD")
+	require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+	require.Equal(t, "55000", msg.(*pgproto3.ErrorResponse).Code)
+
+	msg = adminQuery(t, frontend, "SELECT 1")
+	require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+	require.Equal(t, "42601", msg.(*pgproto3.ErrorResponse).Code)
+
+	// The extended query protocol fails until Sync.
+	sent := make(chan error, 1)
+	go func() {
+		for _, m := range []pgproto3.FrontendMessage{
+			&pgproto3.Parse{Query: "RELOAD"},
+			&pgproto3.Bind{},
+			&pgproto3.Execute{},
+			&pgproto3.Sync{},
+		} {
+			if err := frontend.Send(m); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- nil
+	}()
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.ErrorResponse{}, msg)
+	require.Equal(t, "0A000", msg.(*pgproto3.ErrorResponse).Code)
+	msg, err = frontend.Receive()
+	require.NoError(t, err)
+	require.Equal(t, &pgproto3.ReadyForQuery{TxStatus: IdleTxStatus}, msg)
+	require.NoError(t, <-sent)
+
+	require.NoError(t, frontend.Send(&pgproto3.Terminate{}))
+	require.NoError(t, <-errCh)
+}
+
+func TestAdminConsole_NotAdmin(t *testing.T) {
+	p := newTestAdminServer(t, reloaderFunc(func() error {
+		t.Fatal("reload is not allowed")
+		return nil
+	}), nil)
+	client, server := net.Pipe()
+	defer client.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.proxyHandler(server, &listener{})
+	}()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(client), client)
+	require.NoError(t, frontend.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "app", "database": config.AdminDatabase},
+	}))
+	for {
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		if e, ok := msg.(*pgproto3.ErrorResponse); ok {
+			require.Equal(t, "FATAL", e.Severity)
+			require.Equal(t, "42501", e.Code)
+			break
+		}
+	}
+	require.Error(t, <-errCh)
+}
+
+func TestAdminConsole_Drain(t *testing.T) {
+	p := newTestAdminServer(t, nil, nil)
+	frontend, errCh := connectAdmin(t, p, "admin")
+	// The console is registered after the startup.
+	require.Eventually(t, func() bool {
+		p.proxiesMtx.Lock()
+		defer p.proxiesMtx.Unlock()
+		return len(p.admins) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	done := receiveAdminShutdown(t, frontend)
+	p.drain()
+	<-done
+	require.NoError(t, <-errCh)
+}
@@ -15,11 +15,18 @@
 package auth
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
 
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgproto3/v2"
+	"github.com/pgscale/pgscale/audit"
 	"github.com/pgscale/pgscale/config"
 	"github.com/pgscale/pgscale/kontext"
 )
@@ -34,6 +41,13 @@ var (
 
 const ProtocolVersion3 = 196608 // 3.0
 
+// PassthroughMethod is the authentication method of the databases with passthrough_auth.
+const PassthroughMethod = "passthrough"
+
+// Verifier authenticates the user of a session on the backend with the password that
+// the client has sent. The error is relayed to the client if it's a *pgconn.PgError.
+type Verifier func(ctx context.Context, s *Session, password string) error
+
 type Session struct {
 	ProtocolVersionNumber int
 	ApplicationName       string
@@ -43,8 +57,19 @@ type Session struct {
 
 type Auth struct {
 	config  *config.Config
+	users   *Users
+	verify  Verifier
+	salt    [4]byte
 	backend *pgproto3.Backend
 	conn    net.Conn
+	auditor *audit.Auditor
+	session *Session
+	method  string
+
+	// tls is the configuration of the connections that are upgraded by SSLRequest.
+	tls         *tls.Config
+	tlsRequired bool
+	tlsActive   bool
 }
 
 func SessionFromKontext(k *kontext.Kontext) (*Session, error) {
@@ -61,15 +86,31 @@ func SessionFromKontext(k *kontext.Kontext) (*Session, error) {
 	return s, nil
 }
 
-func New(c *config.Config, conn net.Conn) *Auth {
+func New(c *config.Config, users *Users, verify Verifier, conn net.Conn, auditor *audit.Auditor) *Auth {
 	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
 	return &Auth{
 		config:  c,
+		users:   users,
+		verify:  verify,
 		backend: backend,
 		conn:    conn,
+		auditor: auditor,
 	}
 }
 
+// EnableTLS lets the client upgrade the connection to TLS by SSLRequest. If required
+// is true, the clients that don't request TLS are rejected.
+func (a *Auth) EnableTLS(c *tls.Config, required bool) {
+	a.tls = c
+	a.tlsRequired = required
+}
+
+// Conn returns the connection of the client. It's a *tls.Conn if the client has
+// requested TLS.
+func (a *Auth) Conn() net.Conn {
+	return a.conn
+}
+
 func (a *Auth) authOK() error {
 	buf := (&pgproto3.AuthenticationOk{}).Encode(nil)
 	buf = (&pgproto3.ParameterStatus{Name: "server_version", Value: "13.4 (Debian 13.4-1.pgdg100+1)"}).Encode(buf)
@@ -79,6 +120,11 @@ func (a *Auth) authOK() error {
 }
 
 func (a *Auth) checkMD5Password(s *Session, msg *pgproto3.PasswordMessage, creds map[string]string) bool {
+	if verifier, ok := creds[verifierKey]; ok {
+		// The client sends "md5" + md5(md5(password + username) + salt)
+		sum := md5.Sum(append([]byte(verifier), a.salt[:]...))
+		return md5Prefix+hex.EncodeToString(sum[:]) == msg.Password
+	}
 	// PostgreSQL MD5-hashed password format: "md5" + md5(password + username)
 	return fmt.Sprintf("md5%s", creds["hash"]) == msg.Password
 }
@@ -88,15 +134,22 @@ func (a *Auth) checkCleartextPassword(msg *pgproto3.PasswordMessage, creds map[s
 }
 
 func (a *Auth) errorResponse(msg string) error {
+	return a.fatalResponse("", msg)
+}
+
+// fatalResponse sends a FATAL error with an SQLSTATE code to the client and returns
+// the message as an error.
+func (a *Auth) fatalResponse(code, msg string) error {
 	e := &pgproto3.ErrorResponse{
 		Severity: "FATAL",
+		Code:     code,
 		Message:  msg,
 	}
 	_, err := a.conn.Write(e.Encode(nil))
 	if err != nil {
 		return fmt.Errorf("error sending error message: %w", err)
 	}
-	return fmt.Errorf(msg)
+	return errors.New(msg)
 }
 
 func (a *Auth) authUserWithPassword(s *Session, credentials map[string]string, msg *pgproto3.PasswordMessage) error {
@@ -159,8 +212,55 @@ func (a *Auth) doCleartextPasswordAuth() error {
 	return nil
 }
 
-func (a *Auth) doMD5PasswordAuth() error {
-	buf := (&pgproto3.AuthenticationMD5Password{}).Encode(nil)
+// handlePassthrough asks the client for its password and relays the credentials to the
+// backend. The password is sent in cleartext, like the password method.
+func (a *Auth) handlePassthrough(ctx context.Context, s *Session) (*Session, error) {
+	if err := a.doCleartextPasswordAuth(); err != nil {
+		return nil, err
+	}
+
+	frontendMsg, err := a.backend.Receive()
+	if err != nil {
+		return nil, fmt.Errorf("error receiving auth message: %w", err)
+	}
+	msg, ok := frontendMsg.(*pgproto3.PasswordMessage)
+	if !ok {
+		return nil, fmt.Errorf("unknown startup message: %#v", frontendMsg)
+	}
+
+	if err = a.verify(ctx, s, msg.Password); err != nil {
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) {
+			_ = a.errorResponse(fmt.Sprintf("authentication failed for user \"%s\"", s.User))
+			return nil, fmt.Errorf("failed to authenticate on the backend: %w", err)
+		}
+
+		// Relay the error of the backend, such as invalid_password.
+		e := &pgproto3.ErrorResponse{
+			Severity: "FATAL",
+			Code:     pgErr.Code,
+			Message:  pgErr.Message,
+		}
+		if _, werr := a.conn.Write(e.Encode(nil)); werr != nil {
+			return nil, fmt.Errorf("error sending error message: %w", werr)
+		}
+		return nil, fmt.Errorf("failed to authenticate on the backend: %w", err)
+	}
+
+	if err = a.authOK(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (a *Auth) doMD5PasswordAuth(credentials map[string]string) error {
+	if _, ok := credentials[verifierKey]; ok {
+		// Verifiers of the auth_file and the auth_query are salted like PostgreSQL does.
+		if _, err := rand.Read(a.salt[:]); err != nil {
+			return fmt.Errorf("failed to generate salt: %w", err)
+		}
+	}
+	buf := (&pgproto3.AuthenticationMD5Password{Salt: a.salt}).Encode(nil)
 	_, err := a.conn.Write(buf)
 	if err != nil {
 		return fmt.Errorf("error sending AuthenticationMD5Password message: %w", err)
@@ -168,7 +268,37 @@ func (a *Auth) doMD5PasswordAuth() error {
 	return nil
 }
 
-func (a *Auth) HandleStartup() (*Session, error) {
+// HandleStartup runs the startup flow, authenticates the client and records the
+// result to the audit stream.
+func (a *Auth) HandleStartup(ctx context.Context) (*Session, error) {
+	s, err := a.handleStartup(ctx)
+	if auditErr := a.recordLogin(err); auditErr != nil && err == nil {
+		return nil, fmt.Errorf("failed to write audit record: %w", auditErr)
+	}
+	return s, err
+}
+
+func (a *Auth) recordLogin(err error) error {
+	if a.session == nil {
+		// Startup message is not received, there is nobody to audit.
+		return nil
+	}
+
+	e := &audit.Event{
+		Type:       audit.LoginEvent,
+		User:       a.session.User,
+		Database:   a.session.Database,
+		ClientAddr: a.conn.RemoteAddr().String(),
+		AuthMethod: a.method,
+	}
+	if err != nil {
+		e.Type = audit.LoginFailedEvent
+		e.Reason = err.Error()
+	}
+	return a.auditor.Record(e)
+}
+
+func (a *Auth) handleStartup(ctx context.Context) (*Session, error) {
 	startupMessage, err := a.backend.ReceiveStartupMessage()
 	if err != nil {
 		return nil, fmt.Errorf("error receiving startup message: %w", err)
@@ -189,16 +319,40 @@ func (a *Auth) HandleStartup() (*Session, error) {
 		if applicationName, ok := msg.Parameters["application_name"]; ok {
 			s.ApplicationName = applicationName
 		}
+		a.session = s
 
 		// Startup is done.
 
+		if a.tlsRequired && !a.tlsActive {
+			e := &pgproto3.ErrorResponse{
+				Severity: "FATAL",
+				Code:     "28000",
+				Message:  "SSL connection is required",
+			}
+			if _, err = a.conn.Write(e.Encode(nil)); err != nil {
+				return nil, fmt.Errorf("error sending error message: %w", err)
+			}
+			return nil, fmt.Errorf("client of user \"%s\" has not requested SSL", s.User)
+		}
+
+		if db := a.config.PgScale.PostgreSQL.Database(s.Database); db != nil && db.Passthrough() {
+			a.method = PassthroughMethod
+			return a.handlePassthrough(ctx, s)
+		}
+
 		// Check authentication method and run
-		credentials, ok := a.config.PgScale.Auth.Users[s.User]
+		credentials, ok, err := a.users.Lookup(ctx, s.User)
+		if err != nil {
+			// The client gets a generic message, the cause is returned to the caller.
+			_ = a.errorResponse(fmt.Sprintf("authentication failed for user \"%s\"", s.User))
+			return nil, fmt.Errorf("failed to look up user \"%s\": %w", s.User, err)
+		}
 		if !ok {
 			return nil, a.errorResponse(fmt.Sprintf("no such user: \"%s\"", s.User))
 		}
 
 		authType := credentials["auth_type"]
+		a.method = authType
 
 		switch authType {
 		case config.TrustAuthType:
@@ -212,19 +366,43 @@ func (a *Auth) HandleStartup() (*Session, error) {
 			}
 			return a.HandleAuth(s, credentials)
 		case config.MD5AuthType:
-			if err = a.doMD5PasswordAuth(); err != nil {
+			if err = a.doMD5PasswordAuth(credentials); err != nil {
 				return nil, err
 			}
 			return a.HandleAuth(s, credentials)
+		case config.SCRAMSHA256AuthType:
+			if _, ok := credentials[verifierKey]; !ok {
+				// The inline users don't have a verifier.
+				return nil, a.fatalResponse("28000", fmt.Sprintf("authentication failed for user \"%s\"", s.User))
+			}
+			if err = a.doSCRAMAuth(s, credentials); err != nil {
+				return nil, err
+			}
+			return s, nil
 		default:
+			_ = a.fatalResponse("28000", fmt.Sprintf("authentication failed for user \"%s\"", s.User))
 			return nil, fmt.Errorf("unknown auth type: %s", authType)
 		}
 	case *pgproto3.SSLRequest:
-		_, err = a.conn.Write([]byte("N"))
-		if err != nil {
-			return nil, fmt.Errorf("error sending deny SSL request: %w", err)
+		if a.tls == nil || a.tlsActive {
+			_, err = a.conn.Write([]byte("N"))
+			if err != nil {
+				return nil, fmt.Errorf("error sending deny SSL request: %w", err)
+			}
+			return a.handleStartup(ctx)
+		}
+
+		if _, err = a.conn.Write([]byte("S")); err != nil {
+			return nil, fmt.Errorf("error sending accept SSL request: %w", err)
+		}
+		conn := tls.Server(a.conn, a.tls)
+		if err = conn.HandshakeContext(ctx); err != nil {
+			return nil, fmt.Errorf("TLS handshake failed: %w", err)
 		}
-		return a.HandleStartup()
+		a.conn = conn
+		a.backend = pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+		a.tlsActive = true
+		return a.handleStartup(ctx)
 	default:
 		return nil, fmt.Errorf("unknown startup message: %#v", startupMessage)
 	}
@@ -0,0 +1,317 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/pgscale/pgscale/audit"
+	"github.com/pgscale/pgscale/config"
+	"github.com/stretchr/testify/require"
+)
+
+func passthroughStartup(t *testing.T, verify Verifier) (*pgproto3.Frontend, <-chan error) {
+	auditor, err := audit.New(nil)
+	require.NoError(t, err)
+
+	c := &config.Config{}
+	enabled := true
+	c.PgScale.PostgreSQL.Databases = []config.Database{
+		{Dbname: "postgres", PassthroughAuth: &enabled},
+	}
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		a := New(c, &Users{}, verify, server, auditor)
+		_, err := a.HandleStartup(context.Background())
+		done <- err
+	}()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(client), client)
+	_, err = client.Write((&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice", "database": "postgres"},
+	}).Encode(nil))
+	require.NoError(t, err)
+
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.AuthenticationCleartextPassword{}, msg)
+
+	_, err = client.Write((&pgproto3.PasswordMessage{Password: "secret"}).Encode(nil))
+	require.NoError(t, err)
+	return frontend, done
+}
+
+func TestAuth_Passthrough(t *testing.T) {
+	var password string
+	frontend, done := passthroughStartup(t, func(_ context.Context, s *Session, p string) error {
+		require.Equal(t, "alice", s.User)
+		password = p
+		return nil
+	})
+
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.AuthenticationOk{}, msg)
+	go func() {
+		// Drain ParameterStatus and ReadyForQuery
+		for {
+			if _, err := frontend.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+
+	require.NoError(t, <-done)
+	require.Equal(t, "secret", password)
+}
+
+func TestAuth_Passthrough_BackendError(t *testing.T) {
+	frontend, done := passthroughStartup(t, func(context.Context, *Session, string) error {
+		return &pgconn.PgError{
+			Severity: "FATAL",
+			Code:     "28P01",
+			Message:  `password authentication failed for user "alice"`,
+		}
+	})
+
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	e, ok := msg.(*pgproto3.ErrorResponse)
+	require.True(t, ok)
+	require.Equal(t, "FATAL", e.Severity)
+	require.Equal(t, "28P01", e.Code)
+	require.Equal(t, `password authentication failed for user "alice"`, e.Message)
+
+	require.Error(t, <-done)
+}
+
+func selfSignedTLS(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+// tlsStartup runs HandleStartup on a passthrough database that requires TLS.
+func tlsStartup(t *testing.T) (net.Conn, <-chan error) {
+	auditor, err := audit.New(nil)
+	require.NoError(t, err)
+
+	c := &config.Config{}
+	enabled := true
+	c.PgScale.PostgreSQL.Databases = []config.Database{
+		{Dbname: "postgres", PassthroughAuth: &enabled},
+	}
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		a := New(c, &Users{}, func(context.Context, *Session, string) error { return nil }, server, auditor)
+		a.EnableTLS(selfSignedTLS(t), true)
+		_, err := a.HandleStartup(context.Background())
+		done <- err
+	}()
+	return client, done
+}
+
+func sendStartup(t *testing.T, conn net.Conn) *pgproto3.Frontend {
+	_, err := conn.Write((&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice", "database": "postgres"},
+	}).Encode(nil))
+	require.NoError(t, err)
+	return pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn)
+}
+
+func TestAuth_TLS(t *testing.T) {
+	client, done := tlsStartup(t)
+
+	_, err := client.Write((&pgproto3.SSLRequest{}).Encode(nil))
+	require.NoError(t, err)
+	reply := make([]byte, 1)
+	_, err = client.Read(reply)
+	require.NoError(t, err)
+	require.Equal(t, byte('S'), reply[0])
+
+	conn := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, conn.Handshake())
+
+	frontend := sendStartup(t, conn)
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.AuthenticationCleartextPassword{}, msg)
+
+	_, err = conn.Write((&pgproto3.PasswordMessage{Password: "secret"}).Encode(nil))
+	require.NoError(t, err)
+	msg, err = frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.AuthenticationOk{}, msg)
+	go func() {
+		for {
+			if _, err := frontend.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+	require.NoError(t, <-done)
+}
+
+func TestAuth_TLS_Required(t *testing.T) {
+	client, done := tlsStartup(t)
+
+	frontend := sendStartup(t, client)
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	e, ok := msg.(*pgproto3.ErrorResponse)
+	require.True(t, ok)
+	require.Equal(t, "FATAL", e.Severity)
+	require.Equal(t, "28000", e.Code)
+	require.Equal(t, "SSL connection is required", e.Message)
+
+	require.Error(t, <-done)
+}
+
+// newSCRAMVerifier returns a SCRAM-SHA-256 verifier of a password like PostgreSQL does.
+func newSCRAMVerifier(password string, salt []byte, iterations int) string {
+	// Hi(password, salt, i) is PBKDF2 with HMAC-SHA-256 and a single block.
+	u := hmacSHA256([]byte(password), string(append(salt, 0, 0, 0, 1)))
+	salted := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		u = hmacSHA256([]byte(password), string(u))
+		for j := range salted {
+			salted[j] ^= u[j]
+		}
+	}
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := hmacSHA256(salted, "Server Key")
+	return fmt.Sprintf("SCRAM-SHA-256$%d:%s$%s:%s", iterations,
+		base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(storedKey[:]),
+		base64.StdEncoding.EncodeToString(serverKey))
+}
+
+func TestAuth_SCRAMVerifier(t *testing.T) {
+	auditor, err := audit.New(nil)
+	require.NoError(t, err)
+	users := &Users{inline: map[string]map[string]string{
+		"alice": credentialsFromVerifier(newSCRAMVerifier("secret", []byte("0123456789abcdef"), 4096)),
+	}}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				a := New(&config.Config{}, users, nil, conn, auditor)
+				if _, err := a.HandleStartup(context.Background()); err != nil {
+					return
+				}
+				// Wait for the Terminate message of the client.
+				_, _ = a.backend.Receive()
+			}()
+		}
+	}()
+
+	connString := func(password string) string {
+		return fmt.Sprintf("postgres://alice:%s@%s/postgres?sslmode=disable", password, l.Addr())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// pgconn runs the client side of SCRAM-SHA-256 and verifies the server signature.
+	conn, err := pgconn.Connect(ctx, connString("secret"))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close(ctx))
+
+	_, err = pgconn.Connect(ctx, connString("wrong"))
+	var pgErr *pgconn.PgError
+	require.ErrorAs(t, err, &pgErr)
+	require.Equal(t, "28P01", pgErr.Code)
+}
+
+func TestAuth_UnknownAuthType(t *testing.T) {
+	auditor, err := audit.New(nil)
+	require.NoError(t, err)
+	users := &Users{inline: map[string]map[string]string{
+		"alice": {"auth_type": "cert"},
+	}}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		a := New(&config.Config{}, users, nil, server, auditor)
+		_, err := a.HandleStartup(context.Background())
+		done <- err
+	}()
+
+	frontend := sendStartup(t, client)
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	e, ok := msg.(*pgproto3.ErrorResponse)
+	require.True(t, ok)
+	require.Equal(t, "FATAL", e.Severity)
+	require.Equal(t, "28000", e.Code)
+	require.Error(t, <-done)
+}
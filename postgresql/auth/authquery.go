@@ -0,0 +1,133 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/buraksezer/olric"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/dmaps"
+)
+
+// AuthDMapName is the name of the DMap that caches the results of the auth_query on
+// the cluster.
+const AuthDMapName = "pgscale.auth"
+
+const (
+	defaultAuthQueryMaxConns = 2
+	defaultAuthQueryCacheTTL = time.Minute
+)
+
+// AuthQuery looks up the password verifiers of users on the backend.
+type AuthQuery struct {
+	query string
+	ttl   time.Duration
+	pool  *pgxpool.Pool
+	dmaps *dmaps.DMaps
+}
+
+// NewAuthQuery creates the pool of the auth_query. The pool connects on demand.
+func NewAuthQuery(c *config.AuthQuery, dms *dmaps.DMaps) (*AuthQuery, error) {
+	q := &AuthQuery{
+		query: config.DefaultAuthQuery,
+		ttl:   defaultAuthQueryCacheTTL,
+		dmaps: dms,
+	}
+	if c.Query != nil {
+		q.query = *c.Query
+	}
+	if c.CacheTTL != nil {
+		ttl, err := time.ParseDuration(*c.CacheTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auth_query.cache_ttl: %w", err)
+		}
+		q.ttl = ttl
+	}
+
+	maxConns := defaultAuthQueryMaxConns
+	if c.MaxConns != nil {
+		maxConns = *c.MaxConns
+	}
+	db := config.Database{
+		Dbname:     c.Dbname,
+		Parameters: c.Parameters,
+		ConnectionPool: config.ConnectionPool{
+			MaxConns: &maxConns,
+		},
+	}
+	pc, err := pgxpool.ParseConfig(db.ConnString())
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth_query: %w", err)
+	}
+	pc.LazyConnect = true
+
+	q.pool, err = pgxpool.ConnectConfig(context.Background(), pc)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// noVerifier is cached for the users that are not found or have no password, so the
+// failed logins don't run the query on the backend until the entry expires.
+const noVerifier = ""
+
+// Lookup returns the password verifier of a user from the cache, or runs the query on
+// the backend and caches the result.
+func (q *AuthQuery) Lookup(ctx context.Context, user string) (string, bool, error) {
+	dm, err := q.dmaps.GetOrCreateDMap(AuthDMapName)
+	if err != nil {
+		return "", false, err
+	}
+
+	value, err := dm.Get(user)
+	if err == nil {
+		if verifier, ok := value.(string); ok {
+			return verifier, verifier != noVerifier, nil
+		}
+	} else if !errors.Is(err, olric.ErrKeyNotFound) {
+		return "", false, err
+	}
+
+	var name string
+	var passwd *string
+	err = q.pool.QueryRow(ctx, q.query, user).Scan(&name, &passwd)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && (passwd == nil || *passwd == noVerifier)) {
+		// The user is not found or has no password, it cannot log in.
+		if err = dm.PutEx(user, noVerifier, q.ttl); err != nil {
+			return "", false, err
+		}
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to run auth_query: %w", err)
+	}
+
+	if err = dm.PutEx(user, *passwd, q.ttl); err != nil {
+		return "", false, err
+	}
+	return *passwd, true, nil
+}
+
+// Close closes the pool.
+func (q *AuthQuery) Close() {
+	q.pool.Close()
+}
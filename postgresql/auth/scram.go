@@ -0,0 +1,199 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// https://www.postgresql.org/docs/current/sasl-authentication.html
+// https://datatracker.ietf.org/doc/html/rfc5802
+
+const scramSHA256Mechanism = "SCRAM-SHA-256"
+
+var errInvalidSCRAMMessage = errors.New("invalid SCRAM message")
+
+// scramVerifier is a SCRAM-SHA-256 password verifier as it's stored in pg_authid:
+// SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+type scramVerifier struct {
+	iterations int
+	salt       string
+	storedKey  []byte
+	serverKey  []byte
+}
+
+func parseSCRAMVerifier(verifier string) (*scramVerifier, error) {
+	parts := strings.Split(strings.TrimPrefix(verifier, scramSHA256Prefix), "$")
+	if len(parts) != 2 {
+		return nil, errors.New("invalid SCRAM-SHA-256 verifier")
+	}
+	params := strings.Split(parts[0], ":")
+	keys := strings.Split(parts[1], ":")
+	if len(params) != 2 || len(keys) != 2 {
+		return nil, errors.New("invalid SCRAM-SHA-256 verifier")
+	}
+
+	iterations, err := strconv.Atoi(params[0])
+	if err != nil || iterations <= 0 {
+		return nil, errors.New("invalid iteration count of SCRAM-SHA-256 verifier")
+	}
+	if _, err = base64.StdEncoding.DecodeString(params[1]); err != nil {
+		return nil, fmt.Errorf("invalid salt of SCRAM-SHA-256 verifier: %w", err)
+	}
+	storedKey, err := base64.StdEncoding.DecodeString(keys[0])
+	if err != nil || len(storedKey) != sha256.Size {
+		return nil, errors.New("invalid stored key of SCRAM-SHA-256 verifier")
+	}
+	serverKey, err := base64.StdEncoding.DecodeString(keys[1])
+	if err != nil || len(serverKey) != sha256.Size {
+		return nil, errors.New("invalid server key of SCRAM-SHA-256 verifier")
+	}
+	return &scramVerifier{
+		iterations: iterations,
+		salt:       params[1],
+		storedKey:  storedKey,
+		serverKey:  serverKey,
+	}, nil
+}
+
+func hmacSHA256(key []byte, message string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(message))
+	return h.Sum(nil)
+}
+
+// scramAttribute returns the value of an attribute, such as r=<nonce>, of a SCRAM message.
+func scramAttribute(message, name string) (string, bool) {
+	for _, attr := range strings.Split(message, ",") {
+		if strings.HasPrefix(attr, name+"=") {
+			return attr[len(name)+1:], true
+		}
+	}
+	return "", false
+}
+
+// doSCRAMAuth runs a SCRAM-SHA-256 exchange with the client. The proof of the client is
+// checked with the stored key of the verifier, the password is never seen. Channel
+// binding is not supported.
+func (a *Auth) doSCRAMAuth(s *Session, credentials map[string]string) error {
+	verifier, err := parseSCRAMVerifier(credentials[verifierKey])
+	if err != nil {
+		_ = a.fatalResponse("28000", fmt.Sprintf("authentication failed for user \"%s\"", s.User))
+		return fmt.Errorf("user \"%s\": %w", s.User, err)
+	}
+
+	if err = a.backend.Send(&pgproto3.AuthenticationSASL{AuthMechanisms: []string{scramSHA256Mechanism}}); err != nil {
+		return fmt.Errorf("error sending AuthenticationSASL message: %w", err)
+	}
+	if err = a.backend.SetAuthType(pgproto3.AuthTypeSASL); err != nil {
+		return err
+	}
+	msg, err := a.backend.Receive()
+	if err != nil {
+		return fmt.Errorf("error receiving auth message: %w", err)
+	}
+	initial, ok := msg.(*pgproto3.SASLInitialResponse)
+	if !ok || initial.AuthMechanism != scramSHA256Mechanism {
+		_ = a.fatalResponse("28000", "unsupported SASL authentication mechanism")
+		return fmt.Errorf("unknown SASL message: %#v", msg)
+	}
+
+	// client-first-message: gs2-header client-first-message-bare
+	clientFirst := string(initial.Data)
+	if !strings.HasPrefix(clientFirst, "n,,") && !strings.HasPrefix(clientFirst, "y,,") {
+		_ = a.fatalResponse("08P01", "SCRAM channel binding is not supported")
+		return errInvalidSCRAMMessage
+	}
+	gs2Header, clientFirstBare := clientFirst[:3], clientFirst[3:]
+	clientNonce, ok := scramAttribute(clientFirstBare, "r")
+	if !ok || clientNonce == "" {
+		_ = a.fatalResponse("08P01", "malformed SCRAM message")
+		return errInvalidSCRAMMessage
+	}
+
+	var random [18]byte
+	if _, err = rand.Read(random[:]); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	nonce := clientNonce + base64.StdEncoding.EncodeToString(random[:])
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce, verifier.salt, verifier.iterations)
+	if err = a.backend.Send(&pgproto3.AuthenticationSASLContinue{Data: []byte(serverFirst)}); err != nil {
+		return fmt.Errorf("error sending AuthenticationSASLContinue message: %w", err)
+	}
+	if err = a.backend.SetAuthType(pgproto3.AuthTypeSASLContinue); err != nil {
+		return err
+	}
+	msg, err = a.backend.Receive()
+	if err != nil {
+		return fmt.Errorf("error receiving auth message: %w", err)
+	}
+	response, ok := msg.(*pgproto3.SASLResponse)
+	if !ok {
+		return fmt.Errorf("unknown SASL message: %#v", msg)
+	}
+
+	// client-final-message: c=<gs2-header>,r=<nonce>,p=<proof>
+	clientFinal := string(response.Data)
+	idx := strings.LastIndex(clientFinal, ",p=")
+	if idx < 0 {
+		_ = a.fatalResponse("08P01", "malformed SCRAM message")
+		return errInvalidSCRAMMessage
+	}
+	clientFinalWithoutProof := clientFinal[:idx]
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[idx+3:])
+	if err != nil || len(proof) != sha256.Size {
+		_ = a.fatalResponse("08P01", "malformed SCRAM message")
+		return errInvalidSCRAMMessage
+	}
+	channelBinding, _ := scramAttribute(clientFinalWithoutProof, "c")
+	finalNonce, _ := scramAttribute(clientFinalWithoutProof, "r")
+	if channelBinding != base64.StdEncoding.EncodeToString([]byte(gs2Header)) || finalNonce != nonce {
+		_ = a.fatalResponse("08P01", "malformed SCRAM message")
+		return errInvalidSCRAMMessage
+	}
+
+	// ClientKey = ClientProof XOR HMAC(StoredKey, AuthMessage), H(ClientKey) must be
+	// the StoredKey.
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+	clientSignature := hmacSHA256(verifier.storedKey, authMessage)
+	clientKey := make([]byte, sha256.Size)
+	for i := range clientKey {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], verifier.storedKey) != 1 {
+		return a.fatalResponse("28P01", fmt.Sprintf("password authentication failed for user \"%s\"", s.User))
+	}
+
+	serverSignature := hmacSHA256(verifier.serverKey, authMessage)
+	var final bytes.Buffer
+	final.WriteString("v=")
+	final.WriteString(base64.StdEncoding.EncodeToString(serverSignature))
+	if err = a.backend.Send(&pgproto3.AuthenticationSASLFinal{Data: final.Bytes()}); err != nil {
+		return fmt.Errorf("error sending AuthenticationSASLFinal message: %w", err)
+	}
+	return a.authOK()
+}
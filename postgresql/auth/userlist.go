@@ -0,0 +1,140 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UserList is an auth_file in the userlist.txt format of PgBouncer. Every line has a
+// quoted user name and a quoted password or password verifier:
+//
+//	"user" "md5a1b2c3..."
+//
+// Double quotes are escaped by doubling them, lines that don't start with a double
+// quote are ignored. The file is read again if it has been changed.
+type UserList struct {
+	mtx     sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	users   map[string]string
+}
+
+// NewUserList reads the file at path.
+func NewUserList(path string) (*UserList, error) {
+	l := &UserList{path: path}
+	if err := l.refresh(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Path returns the path of the file.
+func (l *UserList) Path() string {
+	return l.path
+}
+
+func (l *UserList) refresh() error {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	if l.users != nil && info.ModTime().Equal(l.modTime) && info.Size() == l.size {
+		return nil
+	}
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users, err := parseUserList(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", l.path, err)
+	}
+	l.users = users
+	l.modTime = info.ModTime()
+	l.size = info.Size()
+	return nil
+}
+
+// Lookup returns the password or the password verifier of a user.
+func (l *UserList) Lookup(user string) (string, bool, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if err := l.refresh(); err != nil {
+		return "", false, err
+	}
+	password, ok := l.users[user]
+	return password, ok, nil
+}
+
+// readQuoted reads a double-quoted field from the beginning of s and returns the field
+// and the rest of s.
+func readQuoted(s string) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", "", fmt.Errorf("expected a double-quoted field")
+	}
+
+	var field strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != '"' {
+			field.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '"' {
+			// Escaped double quote
+			field.WriteByte('"')
+			i++
+			continue
+		}
+		return field.String(), s[i+1:], nil
+	}
+	return "", "", fmt.Errorf("unterminated double-quoted field")
+}
+
+func parseUserList(r io.Reader) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(text, `"`) {
+			continue
+		}
+
+		user, rest, err := readQuoted(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		password, _, err := readQuoted(strings.TrimLeft(rest, " \t"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		users[user] = password
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pgscale/pgscale/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+const userList = `;; comment
+"alice" "md5a5e8b5ffd0ca76b1ca2bb1c8ad5a2a23"
+"bob"   "secret"
+"say ""hi""" "SCRAM-SHA-256$4096:salt$key:server"
+
+not a user line
+`
+
+func TestUserList_Parse(t *testing.T) {
+	users, err := parseUserList(strings.NewReader(userList))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"alice":    "md5a5e8b5ffd0ca76b1ca2bb1c8ad5a2a23",
+		"bob":      "secret",
+		`say "hi"`: "SCRAM-SHA-256$4096:salt$key:server",
+	}, users)
+}
+
+func TestUserList_Parse_Invalid(t *testing.T) {
+	_, err := parseUserList(strings.NewReader(`"alice" secret`))
+	require.Error(t, err)
+
+	_, err = parseUserList(strings.NewReader(`"alice" "secret`))
+	require.Error(t, err)
+}
+
+func TestUserList_Reload(t *testing.T) {
+	f, err := testutils.CreateTmpfile(t, "userlist.*.txt", []byte(userList))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	l, err := NewUserList(f.Name())
+	require.NoError(t, err)
+
+	password, ok, err := l.Lookup("bob")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "secret", password)
+
+	require.NoError(t, os.WriteFile(f.Name(), []byte(`"carol" "1234"`), 0600))
+	// Make sure that the modification time is changed on file systems with coarse timestamps.
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(f.Name(), later, later))
+
+	_, ok, err = l.Lookup("bob")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	password, ok, err = l.Lookup("carol")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "1234", password)
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/dmaps"
+)
+
+const (
+	md5Prefix         = "md5"
+	scramSHA256Prefix = "SCRAM-SHA-256$"
+
+	// verifierKey holds md5(password + user) of the users that are read from the
+	// auth_file or by the auth_query.
+	verifierKey = "verifier"
+)
+
+// Users looks up the credentials of a user in the users of the configuration, in the
+// auth_file and by the auth_query, in that order.
+type Users struct {
+	inline map[string]map[string]string
+	file   *UserList
+	query  *AuthQuery
+}
+
+// NewUsers creates the user database of the configuration.
+func NewUsers(c *config.Config, dms *dmaps.DMaps) (*Users, error) {
+	u := &Users{inline: c.PgScale.Auth.Users}
+	if c.PgScale.Auth.AuthFile != nil {
+		file, err := NewUserList(*c.PgScale.Auth.AuthFile)
+		if err != nil {
+			return nil, err
+		}
+		u.file = file
+	}
+
+	if c.PgScale.Auth.AuthQuery != nil {
+		query, err := NewAuthQuery(c.PgScale.Auth.AuthQuery, dms)
+		if err != nil {
+			return nil, err
+		}
+		u.query = query
+	}
+	return u, nil
+}
+
+// Update returns the user database of a reloaded configuration. The auth_file is read
+// again if its path has been changed, the auth_query is shared.
+func (u *Users) Update(c *config.Config) (*Users, error) {
+	updated := &Users{
+		inline: c.PgScale.Auth.Users,
+		query:  u.query,
+	}
+
+	if path := c.PgScale.Auth.AuthFile; path != nil {
+		if u.file != nil && u.file.Path() == *path {
+			updated.file = u.file
+		} else {
+			file, err := NewUserList(*path)
+			if err != nil {
+				return nil, err
+			}
+			updated.file = file
+		}
+	}
+	return updated, nil
+}
+
+// credentialsFromVerifier converts a password or a password verifier, as it's stored
+// in pg_shadow, to credentials.
+func credentialsFromVerifier(verifier string) map[string]string {
+	switch {
+	case strings.HasPrefix(verifier, md5Prefix) && len(verifier) == len(md5Prefix)+32:
+		return map[string]string{
+			"auth_type": config.MD5AuthType,
+			verifierKey: strings.TrimPrefix(verifier, md5Prefix),
+		}
+	case strings.HasPrefix(verifier, scramSHA256Prefix):
+		return map[string]string{
+			"auth_type": config.SCRAMSHA256AuthType,
+			verifierKey: verifier,
+		}
+	default:
+		return map[string]string{
+			"auth_type": config.PasswordAuthType,
+			"password":  verifier,
+		}
+	}
+}
+
+// Lookup returns the credentials of a user. It returns false if the user is not found.
+func (u *Users) Lookup(ctx context.Context, user string) (map[string]string, bool, error) {
+	if credentials, ok := u.inline[user]; ok {
+		return credentials, true, nil
+	}
+
+	if u.file != nil {
+		verifier, ok, err := u.file.Lookup(user)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return credentialsFromVerifier(verifier), true, nil
+		}
+	}
+
+	if u.query != nil {
+		verifier, ok, err := u.query.Lookup(ctx, user)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			return credentialsFromVerifier(verifier), true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// Close closes the pool of the auth_query.
+func (u *Users) Close() {
+	if u.query != nil {
+		u.query.Close()
+	}
+}
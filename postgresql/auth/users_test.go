@@ -0,0 +1,162 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/pgscale/pgscale/audit"
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/dmaps"
+	"github.com/pgscale/pgscale/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func newUsers(t *testing.T, authQuery *config.AuthQuery) *Users {
+	f, err := testutils.CreateTmpfile(t, "userlist.*.txt", []byte(userList))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	c := &config.Config{}
+	c.PgScale.Auth.Users = map[string]map[string]string{
+		"bob": {"auth_type": config.TrustAuthType},
+	}
+	name := f.Name()
+	c.PgScale.Auth.AuthFile = &name
+	c.PgScale.Auth.AuthQuery = authQuery
+
+	users, err := NewUsers(c, dmaps.New(testutils.NewOlricInstance(t)))
+	require.NoError(t, err)
+	t.Cleanup(users.Close)
+	return users
+}
+
+func TestUsers_Lookup(t *testing.T) {
+	users := newUsers(t, nil)
+
+	// Inline users take precedence over the auth_file.
+	credentials, ok, err := users.Lookup(context.Background(), "bob")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, map[string]string{"auth_type": config.TrustAuthType}, credentials)
+
+	credentials, ok, err = users.Lookup(context.Background(), "alice")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, map[string]string{
+		"auth_type": config.MD5AuthType,
+		verifierKey: "a5e8b5ffd0ca76b1ca2bb1c8ad5a2a23",
+	}, credentials)
+
+	_, ok, err = users.Lookup(context.Background(), "mallory")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestUsers_AuthQuery_Cached(t *testing.T) {
+	users := newUsers(t, &config.AuthQuery{
+		Dbname: "postgres",
+		Parameters: map[string]string{
+			"host": "127.0.0.1",
+			"port": "1",
+		},
+	})
+
+	// The backend is not reachable, the verifier has been cached by another node.
+	dm, err := users.query.dmaps.GetOrCreateDMap(AuthDMapName)
+	require.NoError(t, err)
+	require.NoError(t, dm.Put("dave", "plaintext"))
+
+	credentials, ok, err := users.Lookup(context.Background(), "dave")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, map[string]string{
+		"auth_type": config.PasswordAuthType,
+		"password":  "plaintext",
+	}, credentials)
+
+	_, _, err = users.Lookup(context.Background(), "erin")
+	require.Error(t, err)
+
+	// The unknown users are cached too, the failed logins don't run the query.
+	require.NoError(t, dm.Put("frank", noVerifier))
+	_, ok, err = users.Lookup(context.Background(), "frank")
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestAuth_MD5Verifier(t *testing.T) {
+	users := newUsers(t, nil)
+	auditor, err := audit.New(nil)
+	require.NoError(t, err)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	type result struct {
+		session *Session
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		a := New(&config.Config{}, users, nil, server, auditor)
+		s, err := a.HandleStartup(context.Background())
+		done <- result{session: s, err: err}
+	}()
+
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(client), client)
+	_, err = client.Write((&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "alice", "database": "postgres"},
+	}).Encode(nil))
+	require.NoError(t, err)
+
+	msg, err := frontend.Receive()
+	require.NoError(t, err)
+	request, ok := msg.(*pgproto3.AuthenticationMD5Password)
+	require.True(t, ok)
+	require.NotEqual(t, [4]byte{}, request.Salt)
+
+	password := "md5" + md5Hex("a5e8b5ffd0ca76b1ca2bb1c8ad5a2a23"+string(request.Salt[:]))
+	_, err = client.Write((&pgproto3.PasswordMessage{Password: password}).Encode(nil))
+	require.NoError(t, err)
+
+	msg, err = frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.AuthenticationOk{}, msg)
+	go func() {
+		// Drain ParameterStatus and ReadyForQuery
+		for {
+			if _, err := frontend.Receive(); err != nil {
+				return
+			}
+		}
+	}()
+
+	r := <-done
+	require.NoError(t, r.err)
+	require.Equal(t, "alice", r.session.User)
+}
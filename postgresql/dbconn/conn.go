@@ -19,20 +19,42 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/pgscale/pgscale/config"
 	"github.com/pgscale/pgscale/kontext"
+	"github.com/pgscale/pgscale/postgresql/matcher"
 )
 
 var ErrDatabaseConnNotFound = errors.New("conn not found")
 
+const (
+	// loadCatalogTimeout bounds reading the metadata of a database.
+	loadCatalogTimeout = 5 * time.Second
+	// loadCatalogRetryInterval is the time to wait after a failure before the catalog
+	// is read again, the statements don't wait for the database in the meantime.
+	loadCatalogRetryInterval = 10 * time.Second
+	// pingTimeout bounds the health check of the database.
+	pingTimeout = 5 * time.Second
+)
+
 type Conn struct {
 	mtx sync.Mutex
 
 	Database *config.Database
 	Config   *pgxpool.Config
 	Pool     *pgxpool.Pool
+	Queue    *Queue
+
+	// catalogMtx protects Catalog, the metadata of the database. catalogErr is the
+	// last failure to read it, it's returned until catalogRetry.
+	catalogMtx   sync.Mutex
+	Catalog      *matcher.Catalog
+	catalogErr   error
+	catalogRetry time.Time
 }
 
 func (c *Conn) CreatePool(ctx context.Context) error {
@@ -51,6 +73,151 @@ func (c *Conn) CreatePool(ctx context.Context) error {
 	return nil
 }
 
+// LoadCatalog returns the views, the relations, the immutable functions and the default
+// search_path of the database. They are read by the first call that succeeds, the
+// changes after that are not visible until the configuration is reloaded. After a
+// failure, the error is returned without reading the catalog again for a while.
+func (c *Conn) LoadCatalog(ctx context.Context) (*matcher.Catalog, error) {
+	c.catalogMtx.Lock()
+	defer c.catalogMtx.Unlock()
+
+	if c.Catalog != nil {
+		return c.Catalog, nil
+	}
+	if c.catalogErr != nil && time.Now().Before(c.catalogRetry) {
+		return nil, c.catalogErr
+	}
+
+	catalog, err := c.loadCatalog(ctx)
+	if err != nil {
+		c.catalogErr = err
+		c.catalogRetry = time.Now().Add(loadCatalogRetryInterval)
+		return nil, err
+	}
+	c.Catalog, c.catalogErr = catalog, nil
+	return catalog, nil
+}
+
+func (c *Conn) loadCatalog(ctx context.Context) (*matcher.Catalog, error) {
+	pool := c.CurrentPool()
+	if pool == nil {
+		return nil, errors.New("pool has not been created")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, loadCatalogTimeout)
+	defer cancel()
+
+	catalog := &matcher.Catalog{
+		Views:     make(matcher.Views),
+		Functions: make(map[string]map[string]struct{}),
+	}
+	err := scanRows(ctx, pool, matcher.ViewsQuery, func(rows pgx.Rows) error {
+		var view, relation matcher.Relation
+		if err := rows.Scan(&view.Schema, &view.Name, &relation.Schema, &relation.Name); err != nil {
+			return err
+		}
+		catalog.Views[view] = append(catalog.Views[view], relation)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read views: %w", err)
+	}
+
+	err = scanRows(ctx, pool, matcher.RelationsQuery, func(rows pgx.Rows) error {
+		var schema, name string
+		if err := rows.Scan(&schema, &name); err != nil {
+			return err
+		}
+		catalog.AddRelation(schema, name)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read relations: %w", err)
+	}
+
+	err = scanRows(ctx, pool, matcher.ImmutableFunctionsQuery, func(rows pgx.Rows) error {
+		var schema, name string
+		if err := rows.Scan(&schema, &name); err != nil {
+			return err
+		}
+		catalog.AddFunction(schema, name)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read functions: %w", err)
+	}
+
+	var searchPath string
+	if err = pool.QueryRow(ctx, matcher.SearchPathQuery).Scan(&searchPath); err != nil {
+		return nil, fmt.Errorf("failed to read search_path: %w", err)
+	}
+	catalog.SearchPath = matcher.ParseSearchPath(searchPath)
+	return catalog, nil
+}
+
+func scanRows(ctx context.Context, pool *pgxpool.Pool, query string, scan func(rows pgx.Rows) error) error {
+	rows, err := pool.Query(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err = scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Ping checks that the database accepts connections. It uses a dedicated connection,
+// the health check neither waits behind the clients in the queue nor takes a server
+// connection from them.
+func (c *Conn) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+
+	conn, err := pgconn.ConnectConfig(ctx, &c.Config.ConnConfig.Config)
+	if err != nil {
+		return err
+	}
+	return conn.Close(ctx)
+}
+
+// CurrentPool returns the pool if it has been created, otherwise nil.
+func (c *Conn) CurrentPool() *pgxpool.Pool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.Pool
+}
+
+// Acquire waits in the queue and acquires a connection from the pool. The connection
+// must be released by Release.
+func (c *Conn) Acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	if c.Queue == nil {
+		return c.CurrentPool().Acquire(ctx)
+	}
+
+	if err := c.Queue.Wait(ctx); err != nil {
+		return nil, err
+	}
+	conn, err := c.CurrentPool().Acquire(ctx)
+	if err != nil {
+		c.Queue.Done()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Release returns a connection that's acquired by Acquire to the pool.
+func (c *Conn) Release(conn *pgxpool.Conn) {
+	conn.Release()
+	if c.Queue != nil {
+		c.Queue.Done()
+	}
+}
+
 func ConnFromKontext(k *kontext.Kontext) (*Conn, error) {
 	i := k.Get(kontext.DBConnKey)
 	if i == nil {
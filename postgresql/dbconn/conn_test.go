@@ -0,0 +1,87 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbconn
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConn_LoadCatalog_Backoff(t *testing.T) {
+	cfg, err := pgxpool.ParseConfig("host=127.0.0.1 port=1 dbname=postgres connect_timeout=1")
+	require.NoError(t, err)
+	cfg.LazyConnect = true
+	c := &Conn{Config: cfg}
+	require.NoError(t, c.CreatePool(context.Background()))
+	defer c.Pool.Close()
+
+	_, err = c.LoadCatalog(context.Background())
+	require.Error(t, err)
+
+	// The statements don't wait for the database until the retry interval is over.
+	start := time.Now()
+	_, again := c.LoadCatalog(context.Background())
+	require.True(t, again == err)
+	require.Less(t, time.Since(start), time.Second)
+
+	c.catalogRetry = time.Now()
+	_, again = c.LoadCatalog(context.Background())
+	require.Error(t, again)
+	require.False(t, again == err)
+}
+
+func TestConn_Ping(t *testing.T) {
+	cfg, err := pgxpool.ParseConfig("host=127.0.0.1 dbname=postgres sslmode=disable")
+	require.NoError(t, err)
+	var dialed int
+	cfg.ConnConfig.DialFunc = func(context.Context, string, string) (net.Conn, error) {
+		dialed++
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			backend := pgproto3.NewBackend(pgproto3.NewChunkReader(server), server)
+			if _, err := backend.ReceiveStartupMessage(); err != nil {
+				return
+			}
+			_ = backend.Send(&pgproto3.AuthenticationOk{})
+			_ = backend.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+			// Wait for Terminate.
+			_, _ = backend.Receive()
+		}()
+		return client, nil
+	}
+
+	// All of the server connections are taken by the clients.
+	c := &Conn{Config: cfg, Queue: NewQueue(QueueOptions{Size: 1})}
+	require.NoError(t, c.Queue.Wait(context.Background()))
+	defer c.Queue.Done()
+
+	require.NoError(t, c.Ping(context.Background()))
+	require.Equal(t, 1, dialed)
+	require.Nil(t, c.CurrentPool())
+}
+
+func TestConn_Ping_Unavailable(t *testing.T) {
+	cfg, err := pgxpool.ParseConfig("host=127.0.0.1 port=1 dbname=postgres connect_timeout=1")
+	require.NoError(t, err)
+	c := &Conn{Config: cfg}
+	require.Error(t, c.Ping(context.Background()))
+}
@@ -0,0 +1,160 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbconn
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQueryWaitTimeout is returned if a client has waited for a server connection
+	// longer than query_wait_timeout.
+	ErrQueryWaitTimeout = errors.New("query_wait_timeout")
+
+	// ErrWaitQueueFull is returned if max_wait_clients are already waiting for a
+	// server connection.
+	ErrWaitQueueFull = errors.New("no more connections allowed (max_wait_clients)")
+)
+
+// QueueOptions configures a Queue. Zero values mean no limit.
+type QueueOptions struct {
+	// Size is the number of server connections that are given out without waiting
+	// for the reserve pool.
+	Size int
+
+	// ReserveSize is the number of extra connections that are given to the clients
+	// which have waited longer than ReserveTimeout.
+	ReserveSize    int
+	ReserveTimeout time.Duration
+
+	MaxWaiting  int
+	WaitTimeout time.Duration
+}
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+	reserve bool
+}
+
+// Queue hands out the server connections of a pool to the clients in FIFO order.
+type Queue struct {
+	mtx     sync.Mutex
+	opts    QueueOptions
+	active  int
+	waiters *list.List
+}
+
+// NewQueue creates a queue for a pool of opts.Size + opts.ReserveSize connections.
+func NewQueue(opts QueueOptions) *Queue {
+	return &Queue{
+		opts:    opts,
+		waiters: list.New(),
+	}
+}
+
+// Wait blocks until a connection can be acquired from the pool. Every successful call
+// must be followed by a call to Done.
+func (q *Queue) Wait(ctx context.Context) error {
+	q.mtx.Lock()
+	if q.waiters.Len() == 0 && q.active < q.opts.Size {
+		q.active++
+		q.mtx.Unlock()
+		return nil
+	}
+	if q.opts.MaxWaiting > 0 && q.waiters.Len() >= q.opts.MaxWaiting {
+		q.mtx.Unlock()
+		return ErrWaitQueueFull
+	}
+	w := &waiter{ready: make(chan struct{})}
+	e := q.waiters.PushBack(w)
+	q.mtx.Unlock()
+
+	var reserve, timeout <-chan time.Time
+	if q.opts.ReserveSize > 0 {
+		t := time.NewTimer(q.opts.ReserveTimeout)
+		defer t.Stop()
+		reserve = t.C
+	}
+	if q.opts.WaitTimeout > 0 {
+		t := time.NewTimer(q.opts.WaitTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	var err error
+	for err == nil {
+		select {
+		case <-w.ready:
+			return nil
+		case <-reserve:
+			reserve = nil
+			q.mtx.Lock()
+			w.reserve = true
+			q.dispatch()
+			q.mtx.Unlock()
+		case <-timeout:
+			err = ErrQueryWaitTimeout
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	if w.granted {
+		// The connection has been given to the waiter in the meantime.
+		return nil
+	}
+	q.waiters.Remove(e)
+	return err
+}
+
+// Done gives the connection to the next waiter.
+func (q *Queue) Done() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.active--
+	q.dispatch()
+}
+
+// dispatch grants connections to the waiters in FIFO order. The reserve pool is only
+// used by the waiters that have waited longer than ReserveTimeout. The caller must hold
+// mtx.
+func (q *Queue) dispatch() {
+	for e := q.waiters.Front(); e != nil; e = q.waiters.Front() {
+		w := e.Value.(*waiter)
+		if q.active >= q.opts.Size && !(w.reserve && q.active < q.opts.Size+q.opts.ReserveSize) {
+			return
+		}
+		q.active++
+		w.granted = true
+		close(w.ready)
+		q.waiters.Remove(e)
+	}
+}
+
+// Waiting returns the number of clients that are waiting for a connection.
+func (q *Queue) Waiting() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	return q.waiters.Len()
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dbconn
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// waitInBackground starts waiting in the queue and returns after the waiter is queued.
+func waitInBackground(t *testing.T, q *Queue, ctx context.Context) <-chan error {
+	n := q.Waiting()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- q.Wait(ctx)
+	}()
+	require.Eventually(t, func() bool {
+		return q.Waiting() == n+1
+	}, time.Second, time.Millisecond)
+	return errCh
+}
+
+func TestQueue_FIFO(t *testing.T) {
+	q := NewQueue(QueueOptions{Size: 1})
+	require.NoError(t, q.Wait(context.Background()))
+
+	first := waitInBackground(t, q, context.Background())
+	second := waitInBackground(t, q, context.Background())
+
+	q.Done()
+	require.NoError(t, <-first)
+	select {
+	case <-second:
+		t.Fatal("second waiter has acquired a connection before the first one released it")
+	default:
+	}
+
+	q.Done()
+	require.NoError(t, <-second)
+	require.Equal(t, 0, q.Waiting())
+}
+
+func TestQueue_MaxWaiting(t *testing.T) {
+	q := NewQueue(QueueOptions{Size: 1, MaxWaiting: 1})
+	require.NoError(t, q.Wait(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiting := waitInBackground(t, q, ctx)
+	require.ErrorIs(t, q.Wait(context.Background()), ErrWaitQueueFull)
+
+	cancel()
+	require.ErrorIs(t, <-waiting, context.Canceled)
+	require.Equal(t, 0, q.Waiting())
+}
+
+func TestQueue_WaitTimeout(t *testing.T) {
+	q := NewQueue(QueueOptions{Size: 1, WaitTimeout: 10 * time.Millisecond})
+	require.NoError(t, q.Wait(context.Background()))
+
+	require.ErrorIs(t, q.Wait(context.Background()), ErrQueryWaitTimeout)
+	require.Equal(t, 0, q.Waiting())
+
+	// The slot of the first client is still in use.
+	q.Done()
+	require.NoError(t, q.Wait(context.Background()))
+}
+
+func TestQueue_ReservePool(t *testing.T) {
+	q := NewQueue(QueueOptions{
+		Size:           1,
+		ReserveSize:    1,
+		ReserveTimeout: 10 * time.Millisecond,
+		WaitTimeout:    time.Second,
+	})
+	require.NoError(t, q.Wait(context.Background()))
+
+	// The second client gets the reserve connection after ReserveTimeout.
+	start := time.Now()
+	require.NoError(t, q.Wait(context.Background()))
+	require.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+
+	// The reserve pool is exhausted.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, q.Wait(ctx), context.DeadlineExceeded)
+
+	q.Done()
+	require.NoError(t, q.Wait(context.Background()))
+}
@@ -15,22 +15,24 @@
 package postgresql
 
 import (
+	"bytes"
 	"errors"
 
 	"github.com/buraksezer/olric"
 	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/logging"
 	"github.com/pgscale/pgscale/postgresql/matcher"
 	"github.com/pgscale/pgscale/postgresql/protocol"
 	"github.com/pgscale/pgscale/utils"
 )
 
-func (p *Proxy) cacheExtendedQuery(table *config.Table, c *protocol.Reader, data *protocol.DataPacket) (bool, error) {
-	value, err := p.loadFromCache(table, data)
+func (p *Proxy) cacheExtendedQuery(tables []*config.Table, c *protocol.Reader, data *protocol.DataPacket) (bool, error) {
+	value, err := p.loadFromCache(tables, data)
 	if errors.Is(err, olric.ErrKeyNotFound) {
 		return false, nil
 	}
 
-	if errors.Is(err, ErrGetOrCreateDMap) {
+	if errors.Is(err, ErrGetOrCreateDMap) || errors.Is(err, ErrTableVersions) {
 		return false, nil
 	}
 
@@ -51,6 +53,95 @@ func (p *Proxy) cacheExtendedQuery(table *config.Table, c *protocol.Reader, data
 	return p.serveFromCache(value)
 }
 
+// splitParse returns the name of the prepared statement and the query of a Parse message.
+func splitParse(payload []byte) (string, []byte) {
+	idx := bytes.IndexByte(payload, 0)
+	if idx < 0 {
+		return "", nil
+	}
+	name, query := string(payload[:idx]), payload[idx+1:]
+	if idx = bytes.IndexByte(query, 0); idx >= 0 {
+		query = query[:idx]
+	}
+	return name, query
+}
+
+// boundStatement returns the name of the prepared statement of a Bind message, which
+// follows the name of the portal.
+func boundStatement(payload []byte) (string, bool) {
+	idx := bytes.IndexByte(payload, 0)
+	if idx < 0 {
+		return "", false
+	}
+	payload = payload[idx+1:]
+	if idx = bytes.IndexByte(payload, 0); idx < 0 {
+		return "", false
+	}
+	return string(payload[:idx]), true
+}
+
+// closedStatement returns the name of the prepared statement of a Close message. It
+// returns false if a portal is closed.
+func closedStatement(payload []byte) (string, bool) {
+	// The first byte is 'S' for a prepared statement and 'P' for a portal.
+	if len(payload) == 0 || payload[0] != 'S' {
+		return "", false
+	}
+	name := payload[1:]
+	idx := bytes.IndexByte(name, 0)
+	if idx < 0 {
+		return "", false
+	}
+	return string(name[:idx]), true
+}
+
+// prepare parses the query of a Parse message and remembers the cache tables that are
+// written by the prepared statement.
+func (p *Proxy) prepare(data *protocol.DataPacket) (*matcher.Query, bool, error) {
+	name, statement := splitParse(data.Payload)
+	query, ok, err := p.parseQuery(statement)
+	if p.prepared == nil {
+		p.prepared = make(map[string][]string)
+	}
+	if len(p.statementModified) > 0 {
+		p.prepared[name] = p.statementModified
+	} else {
+		delete(p.prepared, name)
+	}
+	// The result of a named statement is not served from the cache, the server must
+	// know the statement for the next Bind.
+	return query, ok && name == "", err
+}
+
+// trackStatement records the cache tables that are written by the prepared statements
+// in a batch of extended query messages, such as a Bind that executes an UPDATE again.
+func (p *Proxy) trackStatement(data *protocol.DataPacket) error {
+	if len(p.dbconn.Database.Caches) == 0 {
+		return nil
+	}
+
+	switch data.Identifier {
+	case ParseIdentifier:
+		if _, _, err := p.prepare(data); err != nil {
+			// The server returns the syntax error.
+			p.log.V(3).Printf("[DEBUG] Failed to parse prepared statement: %v", err)
+		}
+	case BindIdentifier:
+		name, ok := boundStatement(data.Payload)
+		if !ok {
+			return nil
+		}
+		for _, dmapName := range p.prepared[name] {
+			p.modified[dmapName] = struct{}{}
+		}
+	case CloseIdentifier:
+		if name, ok := closedStatement(data.Payload); ok {
+			delete(p.prepared, name)
+		}
+	}
+	return nil
+}
+
 func (p *Proxy) handleExtendedQuery(c *protocol.Reader, data *protocol.DataPacket) (bool, error) {
 	var servedFromCache bool
 	var err error
@@ -60,22 +151,21 @@ func (p *Proxy) handleExtendedQuery(c *protocol.Reader, data *protocol.DataPacke
 		p.log.V(1).Printf("[INFO] Extended query statement: %s", utils.ByteToString(payload))
 	}
 
-	if !utils.StartWithSelect(payload) {
-		return false, nil
-	}
-
-	query, err := matcher.Parse(payload)
-	if err != nil {
+	query, ok, err := p.prepare(data)
+	if err != nil || !ok {
 		return false, err
 	}
 
-	return query.Match(p.dbconn.Database.Caches, func(table *config.Table) (bool, error) {
-		servedFromCache, err = p.cacheExtendedQuery(table, c, data)
+	return query.Match(p.dbconn.Database.Caches, func(tables []*config.Table) (bool, error) {
+		servedFromCache, err = p.cacheExtendedQuery(tables, c, data)
 		if err != nil {
 			return false, err
 		}
 		if servedFromCache {
-			p.log.V(3).Printf("[INFO] Extended query result fetched from cache. Statement: %s", utils.ByteToString(payload))
+			p.log.With(
+				logging.F("dmap", tables[0].DMapName),
+				logging.F("duration_ms", p.statementDuration()),
+			).V(3).Printf("[INFO] Extended query result fetched from cache. Statement: %s", utils.ByteToString(payload))
 		}
 		return servedFromCache, nil
 	})
@@ -0,0 +1,115 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgresql
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/pgscale/pgscale/config"
+)
+
+// TooManyConnections is the SQLSTATE of too_many_connections.
+const TooManyConnections = "53300"
+
+// ConnStats is a snapshot of the client connections.
+type ConnStats struct {
+	Total     int
+	Users     map[string]int
+	Databases map[string]int
+	// Rejected is the number of connections that exceeded a limit.
+	Rejected uint64
+}
+
+// connLimits counts the client connections in total, per user and per database.
+type connLimits struct {
+	mtx       sync.Mutex
+	total     int
+	users     map[string]int
+	databases map[string]int
+	rejected  uint64
+}
+
+func newConnLimits() *connLimits {
+	return &connLimits{
+		users:     make(map[string]int),
+		databases: make(map[string]int),
+	}
+}
+
+// acquire counts a connection of user to database. It returns an error without counting
+// the connection if it exceeds one of the limits of c.
+func (l *connLimits) acquire(c *config.Config, user, database string) error {
+	maxDB := config.Limit(c.PgScale.MaxDBConnections)
+	if db := c.PgScale.PostgreSQL.Database(database); db != nil && db.MaxDBConnections != nil {
+		maxDB = *db.MaxDBConnections
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	var err error
+	if max := config.Limit(c.PgScale.MaxClientConn); max > 0 && l.total >= max {
+		err = fmt.Errorf("sorry, too many clients already")
+	} else if max := config.Limit(c.PgScale.MaxUserConnections); max > 0 && l.users[user] >= max {
+		err = fmt.Errorf("too many connections for role \"%s\"", user)
+	} else if maxDB > 0 && l.databases[database] >= maxDB {
+		err = fmt.Errorf("too many connections for database \"%s\"", database)
+	}
+	if err != nil {
+		l.rejected++
+		return err
+	}
+
+	l.total++
+	l.users[user]++
+	l.databases[database]++
+	return nil
+}
+
+// release removes a connection that's counted by acquire.
+func (l *connLimits) release(user, database string) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.total--
+	l.users[user]--
+	if l.users[user] == 0 {
+		delete(l.users, user)
+	}
+	l.databases[database]--
+	if l.databases[database] == 0 {
+		delete(l.databases, database)
+	}
+}
+
+func (l *connLimits) stats() ConnStats {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	s := ConnStats{
+		Total:     l.total,
+		Users:     make(map[string]int, len(l.users)),
+		Databases: make(map[string]int, len(l.databases)),
+		Rejected:  l.rejected,
+	}
+	for user, n := range l.users {
+		s.Users[user] = n
+	}
+	for database, n := range l.databases {
+		s.Databases[database] = n
+	}
+	return s
+}
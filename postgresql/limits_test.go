@@ -0,0 +1,106 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgresql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/postgresql/dbconn"
+	"github.com/stretchr/testify/require"
+)
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestConnLimits(t *testing.T) {
+	c := &config.Config{}
+	c.PgScale.MaxClientConn = intPtr(3)
+	c.PgScale.MaxUserConnections = intPtr(2)
+	c.PgScale.MaxDBConnections = intPtr(2)
+	c.PgScale.PostgreSQL.Databases = []config.Database{
+		{Dbname: "postgres"},
+		{Dbname: "reports", MaxDBConnections: intPtr(1)},
+	}
+
+	l := newConnLimits()
+	require.NoError(t, l.acquire(c, "alice", "postgres"))
+	require.NoError(t, l.acquire(c, "alice", "postgres"))
+	require.EqualError(t, l.acquire(c, "alice", "reports"), `too many connections for role "alice"`)
+	require.EqualError(t, l.acquire(c, "bob", "postgres"), `too many connections for database "postgres"`)
+
+	require.NoError(t, l.acquire(c, "bob", "reports"))
+	require.EqualError(t, l.acquire(c, "carol", "reports"), "sorry, too many clients already")
+
+	s := l.stats()
+	require.Equal(t, 3, s.Total)
+	require.Equal(t, map[string]int{"alice": 2, "bob": 1}, s.Users)
+	require.Equal(t, map[string]int{"postgres": 2, "reports": 1}, s.Databases)
+	require.Equal(t, uint64(3), s.Rejected)
+
+	l.release("bob", "reports")
+	require.NoError(t, l.acquire(c, "carol", "reports"))
+}
+
+func TestPassthroughUsers(t *testing.T) {
+	require.Equal(t, defaultMaxPassthroughUsers, maxPassthroughUsers(&config.Database{}))
+	require.Equal(t, 0, maxPassthroughUsers(&config.Database{MaxPassthroughUsers: intPtr(0)}))
+
+	p := &PostgreSQL{dbconns: map[string]map[string]*dbconn.Conn{
+		"alice": {"postgres": {}, "reports": {}},
+		"bob":   {"postgres": {}},
+	}}
+	require.Equal(t, 2, p.passthroughUsers("postgres"))
+	require.Equal(t, 1, p.passthroughUsers("reports"))
+	require.Equal(t, 0, p.passthroughUsers("other"))
+}
+
+func TestConnLimits_Unlimited(t *testing.T) {
+	l := newConnLimits()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, l.acquire(&config.Config{}, "alice", "postgres"))
+	}
+	for i := 0; i < 100; i++ {
+		l.release("alice", "postgres")
+	}
+
+	s := l.stats()
+	require.Equal(t, 0, s.Total)
+	require.Empty(t, s.Users)
+	require.Empty(t, s.Databases)
+}
+
+func TestQueueOptions(t *testing.T) {
+	opts, err := queueOptions(&config.ConnectionPool{}, 10)
+	require.NoError(t, err)
+	require.Equal(t, 10, opts.Size)
+	require.Equal(t, defaultQueryWaitTimeout, opts.WaitTimeout)
+	require.Equal(t, 0, opts.ReserveSize)
+
+	waitTimeout, reserveTimeout := "0s", "1s"
+	opts, err = queueOptions(&config.ConnectionPool{
+		QueryWaitTimeout:   &waitTimeout,
+		MaxWaitClients:     intPtr(100),
+		ReservePoolSize:    intPtr(5),
+		ReservePoolTimeout: &reserveTimeout,
+	}, 10)
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(0), opts.WaitTimeout)
+	require.Equal(t, 100, opts.MaxWaiting)
+	require.Equal(t, 5, opts.ReserveSize)
+	require.Equal(t, time.Second, opts.ReserveTimeout)
+}
@@ -0,0 +1,115 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgresql
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/tcp"
+	"github.com/pgscale/pgscale/upgrade"
+)
+
+// listener is a client endpoint of the proxy.
+type listener struct {
+	// config is nil for bind_addr:bind_port.
+	config      *config.Listener
+	tls         *tls.Config
+	tlsRequired bool
+}
+
+func newListener(lc *config.Listener, c *config.TLS) (*listener, error) {
+	l := &listener{config: lc}
+	if c == nil {
+		return l, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	l.tls = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	l.tlsRequired = c.Required()
+	return l, nil
+}
+
+// allows returns true if the clients of the listener can connect to dbname.
+func (l *listener) allows(dbname string) bool {
+	return l.config == nil || l.config.Allows(dbname)
+}
+
+func (p *PostgreSQL) handler(l *listener) tcp.Handler {
+	return func(conn net.Conn) error {
+		return p.proxyHandler(conn, l)
+	}
+}
+
+// addListeners binds the listener blocks of the configuration, or takes them over from
+// the old process after an upgrade, and adds them to s.
+func (p *PostgreSQL) addListeners(s *tcp.Server, c *config.Config) error {
+	bound := make(map[string]net.Listener)
+	closeAll := func() {
+		for _, nl := range bound {
+			_ = nl.Close()
+		}
+	}
+
+	for i := range c.PgScale.Listeners {
+		lc := &c.PgScale.Listeners[i]
+		l, err := newListener(lc, lc.TLS)
+		if err != nil {
+			closeAll()
+			return fmt.Errorf("listener %s: %w", lc.Name, err)
+		}
+
+		nl, ok := p.inherited[upgrade.ListenerName(lc.Name)]
+		if !ok {
+			nl, err = net.Listen("tcp", net.JoinHostPort(lc.BindAddr, lc.BindPort))
+			if err != nil {
+				closeAll()
+				return fmt.Errorf("listener %s: %w", lc.Name, err)
+			}
+		}
+		bound[lc.Name] = nl
+		s.AddListener(nl, p.handler(l))
+		p.log.V(1).Printf("[INFO] Listener %s addr: %s", lc.Name, nl.Addr())
+	}
+
+	p.listenersMtx.Lock()
+	p.listeners = bound
+	p.listenersMtx.Unlock()
+	return nil
+}
+
+// Listeners returns the listener blocks of the configuration by upgrade name, if the
+// proxy is ready to accept connections.
+func (p *PostgreSQL) Listeners() map[string]net.Listener {
+	result := make(map[string]net.Listener)
+	if !p.Listening() {
+		return result
+	}
+
+	p.listenersMtx.Lock()
+	defer p.listenersMtx.Unlock()
+	for name, nl := range p.listeners {
+		result[upgrade.ListenerName(name)] = nl
+	}
+	return result
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matcher
+
+// Catalog is the metadata of a database that's used to resolve the relations of the
+// queries. It's read once per database.
+type Catalog struct {
+	Views Views
+	// Relations are the tables, views and foreign tables by schema.
+	Relations map[string]map[string]struct{}
+	// Functions are the immutable functions by schema. It's nil if the functions are
+	// not known, otherwise a function that's not in it is not immutable.
+	Functions map[string]map[string]struct{}
+	// SearchPath is the default search_path of the user of the pool.
+	SearchPath []string
+}
+
+// AddRelation adds a relation to the catalog.
+func (c *Catalog) AddRelation(schema, name string) {
+	if c.Relations == nil {
+		c.Relations = make(map[string]map[string]struct{})
+	}
+	add(c.Relations, schema, name)
+}
+
+// AddFunction adds an immutable function to the catalog.
+func (c *Catalog) AddFunction(schema, name string) {
+	if c.Functions == nil {
+		c.Functions = make(map[string]map[string]struct{})
+	}
+	add(c.Functions, schema, name)
+}
+
+// RelationsQuery returns the relations that can be referenced in a query.
+const RelationsQuery = `SELECT n.nspname, c.relname
+FROM pg_catalog.pg_class c
+JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('r', 'p', 'v', 'm', 'f')
+	AND n.nspname !~ '^pg_toast' AND n.nspname !~ '^pg_temp_'`
+
+// SearchPathQuery returns the search_path of a new session.
+const SearchPathQuery = `SELECT pg_catalog.current_setting('search_path')`
@@ -0,0 +1,91 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matcher
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pgscale/pgscale/utils"
+)
+
+const hintPrefix = "pgscale:"
+
+// Hints control the caching of a single query. They are given in the comments before
+// the query, such as /* pgscale:cache ttl=30s */.
+type Hints struct {
+	// NoCache is set by pgscale:nocache, the query is sent to the server and its result
+	// is not cached.
+	NoCache bool
+	// Refresh is set by pgscale:refresh, the query is sent to the server and its result
+	// replaces the cached one.
+	Refresh bool
+	// TTL is set by pgscale:cache ttl=<duration>, the cached result expires after it.
+	// It's zero if the result is kept until it's evicted or invalidated.
+	TTL time.Duration
+}
+
+// ParseHints returns the hints in the leading comments of a query. The invalid ones
+// are skipped and reported in the error, the valid ones are still returned.
+func ParseHints(query []byte) (*Hints, error) {
+	hints := &Hints{}
+	var errs []string
+	comments, _ := utils.LeadingComments(query)
+	for _, comment := range comments {
+		var directive string
+		for _, field := range bytes.Fields(comment) {
+			token := string(field)
+			if strings.HasPrefix(token, hintPrefix) {
+				directive = strings.TrimPrefix(token, hintPrefix)
+				switch directive {
+				case "cache":
+				case "nocache":
+					hints.NoCache = true
+				case "refresh":
+					hints.Refresh = true
+				default:
+					errs = append(errs, fmt.Sprintf("unknown hint: %s", token))
+				}
+				continue
+			}
+			if directive == "" {
+				// Not a hint, the comment may contain anything.
+				continue
+			}
+
+			key, value := token, ""
+			if i := strings.IndexByte(token, '='); i != -1 {
+				key, value = token[:i], token[i+1:]
+			}
+			if directive != "cache" || key != "ttl" {
+				errs = append(errs, fmt.Sprintf("unknown option of %s%s: %s", hintPrefix, directive, key))
+				continue
+			}
+			ttl, err := time.ParseDuration(value)
+			if err != nil || ttl <= 0 {
+				errs = append(errs, fmt.Sprintf("invalid ttl: %q", value))
+				continue
+			}
+			hints.TTL = ttl
+		}
+	}
+
+	if len(errs) > 0 {
+		return hints, fmt.Errorf("invalid query hints: %s", strings.Join(errs, ", "))
+	}
+	return hints, nil
+}
@@ -21,64 +21,202 @@ import (
 	"github.com/valyala/fastjson"
 )
 
-var (
-	pool              fastjson.ParserPool
-	defaultSchemaName = []byte("public")
-)
+var pool fastjson.ParserPool
 
 type Query struct {
+	// hierarchy contains the relations that are read by the query, by schema.
 	hierarchy map[string]map[string]struct{}
+	// modified contains the relations that are written by the query, by schema.
+	modified map[string]map[string]struct{}
+
+	searchPath       *SearchPath
+	searchPathChange *SearchPathChange
+	tempRelations    bool
+	// reason is the first reason why the result of the query cannot be cached.
+	reason string
+}
+
+func (q *Query) notCacheable(reason string) {
+	if q.reason == "" {
+		q.reason = reason
+	}
+}
+
+// NotCacheable returns the reason why the result of the query cannot be cached, or an
+// empty string if it can be cached.
+func (q *Query) NotCacheable() string {
+	return q.reason
 }
 
-func (q *Query) add(schema, table string) {
-	_, ok := q.hierarchy[schema]
+func add(h map[string]map[string]struct{}, schema, table string) {
+	_, ok := h[schema]
 	if !ok {
-		q.hierarchy[schema] = make(map[string]struct{})
+		h[schema] = make(map[string]struct{})
 	}
-	q.hierarchy[schema][table] = struct{}{}
+	h[schema][table] = struct{}{}
 }
 
-func (q *Query) Match(c []*config.Cache, f func(t *config.Table) (bool, error)) (bool, error) {
+// tables returns the configured tables of the relations in h, in the order of the
+// configuration, and the number of relations that are not configured.
+func tables(h map[string]map[string]struct{}, c []*config.Cache) ([]*config.Table, int) {
+	var result []*config.Table
+	found := make(map[string]map[string]struct{})
 	for _, cache := range c {
-		s, ok := q.hierarchy[cache.Schema]
+		relations, ok := h[cache.Schema]
 		if !ok {
-			return false, nil
+			continue
 		}
-
 		for i, table := range cache.Tables {
-			if _, ok = s[table.Name]; !ok {
-				continue
+			if _, ok = relations[table.Name]; ok {
+				result = append(result, cache.Tables[i])
+				add(found, cache.Schema, table.Name)
 			}
-			return f(cache.Tables[i])
 		}
 	}
 
-	return false, nil
+	missing := 0
+	for schema, relations := range h {
+		missing += len(relations) - len(found[schema])
+	}
+	return result, missing
 }
 
-func discoveryHierarchy(q *Query, value *fastjson.Value) {
-	if value.Type() == fastjson.TypeObject && value.Exists("RangeVar") {
-		rangeVar := value.GetObject("RangeVar")
-		schemaName := rangeVar.Get("schemaname").GetStringBytes()
-		if schemaName == nil {
-			schemaName = defaultSchemaName
-		}
-		schema := utils.ByteToString(schemaName)
-		relname := rangeVar.Get("relname").GetStringBytes()
-		table := utils.ByteToString(relname)
-		q.add(schema, table)
+// Match calls f with the tables of every relation that's referenced by the query. The
+// result of the query can only be cached if all of them are cache tables and it's not
+// volatile, f is not called otherwise.
+func (q *Query) Match(c []*config.Cache, f func(tables []*config.Table) (bool, error)) (bool, error) {
+	if q.reason != "" {
+		return false, nil
+	}
+	result, missing := tables(q.hierarchy, c)
+	if len(result) == 0 || missing > 0 {
+		return false, nil
+	}
+	return f(result)
+}
+
+// Modified returns the cache tables that are written by the query, such as the target
+// of an INSERT, UPDATE, DELETE or TRUNCATE.
+func (q *Query) Modified(c []*config.Cache) []*config.Table {
+	result, _ := tables(q.modified, c)
+	return result
+}
+
+// addRangeVar adds a relation to h. The values are copied, the parser is reused.
+func (q *Query) addRangeVar(h map[string]map[string]struct{}, rangeVar *fastjson.Value) {
+	table := string(rangeVar.Get("relname").GetStringBytes())
+	schemaName := rangeVar.Get("schemaname").GetStringBytes()
+	if schemaName == nil {
+		add(h, q.searchPath.resolve(table), table)
 		return
 	}
+	add(h, string(schemaName), table)
+}
 
-	if value.Type() == fastjson.TypeObject {
-		obj := value.GetObject()
-		obj.Visit(func(key []byte, v *fastjson.Value) {
-			discoveryHierarchy(q, v)
+// walkWith walks the common table expressions of a statement and returns the names
+// that are visible in the rest of it. A common table expression only sees the ones
+// before it, its own name is a relation in its body. WITH RECURSIVE makes all of the
+// names visible in every body.
+func (q *Query) walkWith(stmt *fastjson.Value, ctes map[string]struct{}) map[string]struct{} {
+	with := stmt.Get("withClause")
+	items := with.Get("ctes").GetArray()
+	if len(items) == 0 {
+		return ctes
+	}
+
+	scope := make(map[string]struct{}, len(ctes)+len(items))
+	for name := range ctes {
+		scope[name] = struct{}{}
+	}
+	recursive := with.GetBool("recursive")
+	if recursive {
+		for _, item := range items {
+			if name := item.Get("CommonTableExpr", "ctename").GetStringBytes(); name != nil {
+				scope[string(name)] = struct{}{}
+			}
+		}
+	}
+	for _, item := range items {
+		q.walk(item, scope)
+		if name := item.Get("CommonTableExpr", "ctename").GetStringBytes(); name != nil && !recursive {
+			scope[string(name)] = struct{}{}
+		}
+	}
+	return scope
+}
+
+// modifyingStmts are the statements that write to their relation field.
+var modifyingStmts = []string{"InsertStmt", "UpdateStmt", "DeleteStmt"}
+
+// walk discovers the relations in the whole parse tree, such as the subqueries in the
+// target list and WHERE clause, the arms of a UNION, lateral joins and the common table
+// expressions. ctes are the names of the common table expressions in scope, they are
+// not relations.
+func (q *Query) walk(value *fastjson.Value, ctes map[string]struct{}) {
+	switch value.Type() {
+	case fastjson.TypeArray:
+		for _, item := range value.GetArray() {
+			q.walk(item, ctes)
+		}
+	case fastjson.TypeObject:
+		if rangeVar := value.Get("RangeVar"); rangeVar != nil {
+			if isTempRelation(rangeVar) {
+				q.tempRelations = true
+			}
+			if rangeVar.Get("schemaname") == nil {
+				if _, ok := ctes[string(rangeVar.Get("relname").GetStringBytes())]; ok {
+					return
+				}
+			}
+			q.addRangeVar(q.hierarchy, rangeVar)
+			return
+		}
+
+		for _, name := range modifyingStmts {
+			if relation := value.Get(name, "relation"); relation != nil {
+				q.addRangeVar(q.modified, relation)
+				q.notCacheable("modifies " + string(relation.Get("relname").GetStringBytes()))
+			}
+		}
+		if value.Get("relname") != nil && isTempRelation(value) {
+			// The relation of CREATE TEMP TABLE or an INTO clause.
+			q.tempRelations = true
+		}
+		q.checkVolatility(value)
+		if change := searchPathChange(value); change != nil {
+			q.searchPathChange = change
+			return
+		}
+
+		if truncate := value.Get("TruncateStmt"); truncate != nil {
+			for _, item := range truncate.Get("relations").GetArray() {
+				if rangeVar := item.Get("RangeVar"); rangeVar != nil {
+					q.addRangeVar(q.modified, rangeVar)
+				}
+			}
+			q.notCacheable("truncates a relation")
+			return
+		}
+
+		ctes = q.walkWith(value, ctes)
+		value.GetObject().Visit(func(key []byte, v *fastjson.Value) {
+			if string(key) == "withClause" {
+				// It's walked by walkWith.
+				return
+			}
+			q.walk(v, ctes)
 		})
 	}
 }
 
+// Parse parses a query in the default search_path, unqualified relations are in public.
 func Parse(query []byte) (*Query, error) {
+	return ParseInSearchPath(query, nil)
+}
+
+// ParseInSearchPath parses a query and resolves the schemas of its unqualified relations
+// in the search path.
+func ParseInSearchPath(query []byte, searchPath *SearchPath) (*Query, error) {
 	result, err := pg_query.ParseToJSON(utils.ByteToString(query))
 	if err != nil {
 		return nil, err
@@ -102,13 +240,12 @@ func Parse(query []byte) (*Query, error) {
 	}
 
 	q := &Query{
-		hierarchy: make(map[string]map[string]struct{}),
+		hierarchy:  make(map[string]map[string]struct{}),
+		modified:   make(map[string]map[string]struct{}),
+		searchPath: searchPath,
 	}
 	for _, value := range values {
-		fromClause := value.Get("stmt").GetObject("SelectStmt").Get("fromClause").GetArray()
-		for _, item := range fromClause {
-			discoveryHierarchy(q, item)
-		}
+		q.walk(value.Get("stmt"), nil)
 	}
 
 	return q, nil
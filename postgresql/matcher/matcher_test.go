@@ -15,9 +15,17 @@
 package matcher
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/pgscale/pgscale/config"
 	"github.com/stretchr/testify/require"
 )
 
@@ -37,3 +45,266 @@ func TestMatcher_Match(t *testing.T) {
 	require.NoError(t, err)
 	fmt.Println(q)
 }
+
+func testCaches() []*config.Cache {
+	return []*config.Cache{
+		{
+			Schema: "public",
+			Tables: []*config.Table{
+				{Name: "users", DMapName: "postgres.public.users"},
+				{Name: "profile", DMapName: "postgres.public.profile"},
+			},
+		},
+	}
+}
+
+func matchedTables(t *testing.T, data string) []string {
+	q, err := Parse([]byte(data))
+	require.NoError(t, err)
+
+	var names []string
+	_, err = q.Match(testCaches(), func(tables []*config.Table) (bool, error) {
+		for _, table := range tables {
+			names = append(names, table.Name)
+		}
+		return true, nil
+	})
+	require.NoError(t, err)
+	return names
+}
+
+func TestMatcher_Match_MultipleTables(t *testing.T) {
+	names := matchedTables(t, "SELECT * FROM profile JOIN users ON users.id = profile.user_id")
+	require.Equal(t, []string{"users", "profile"}, names)
+}
+
+func TestMatcher_Match_NotCacheable(t *testing.T) {
+	names := matchedTables(t, "SELECT * FROM users JOIN orders ON users.id = orders.user_id")
+	require.Nil(t, names)
+
+	names = matchedTables(t, "SELECT * FROM other.users")
+	require.Nil(t, names)
+}
+
+func TestMatcher_NotCacheable(t *testing.T) {
+	statements := map[string]string{
+		"SELECT now(), * FROM users":                                     "calls volatile function now",
+		"SELECT * FROM users WHERE id = (random() * 10)::int":            "calls volatile function random",
+		"SELECT nextval('users_id_seq'), name FROM users":                "calls volatile function nextval",
+		"SELECT * FROM users WHERE created_at > CURRENT_TIMESTAMP":       "calls SQL value function",
+		"SELECT * FROM users FOR UPDATE":                                 "has a locking clause",
+		"SELECT * FROM users u JOIN profile p USING (id) FOR SHARE OF u": "has a locking clause",
+		"SELECT * INTO users_copy FROM users":                            "creates a table by SELECT INTO",
+		"SELECT * FROM users TABLESAMPLE SYSTEM (10)":                    "samples a table",
+		"WITH d AS (DELETE FROM users RETURNING *) SELECT * FROM d":      "modifies users",
+		"SELECT lower(name), count(*) FROM users GROUP BY 1":             "",
+		"SELECT * FROM users WHERE id IN (SELECT abs(id) FROM profile)":  "",
+	}
+	for statement, expected := range statements {
+		q, err := Parse([]byte(statement))
+		require.NoError(t, err)
+		require.Equal(t, expected, q.NotCacheable(), statement)
+
+		matched, err := q.Match(testCaches(), func(tables []*config.Table) (bool, error) {
+			return true, nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, expected == "", matched, statement)
+	}
+}
+
+func TestMatcher_NotCacheable_Catalog(t *testing.T) {
+	catalog := &Catalog{}
+	catalog.AddFunction("app", "tenant_name")
+	catalog.AddFunction("pg_catalog", "upper")
+	catalog.AddFunction("pg_catalog", "count")
+	catalog.AddFunction("public", "slugify")
+	sp := &SearchPath{Schemas: []string{"$user", "public"}, User: "app", Functions: catalog.Functions}
+
+	// The functions that are not known to be immutable are volatile, such as the ones
+	// that are created after the catalog has been read.
+	statements := map[string]string{
+		"SELECT current_tenant(), * FROM users":                  "calls volatile function current_tenant",
+		"SELECT public.tenant_name(id) FROM users":               "calls volatile function tenant_name",
+		"SELECT to_char(created_at, 'YYYY') FROM users":          "calls volatile function to_char",
+		"SELECT tenant_name(id), app.tenant_name(id) FROM users": "",
+		"SELECT upper(name), count(*) FROM users GROUP BY 1":     "",
+		"SELECT slugify(name) FROM users":                        "",
+	}
+	for statement, expected := range statements {
+		q, err := ParseInSearchPath([]byte(statement), sp)
+		require.NoError(t, err)
+		require.Equal(t, expected, q.NotCacheable(), statement)
+	}
+}
+
+func TestMatcher_Modified(t *testing.T) {
+	statements := map[string][]string{
+		"INSERT INTO users (name) VALUES ('foo')":                   {"users"},
+		"UPDATE profile SET bio = '' FROM orders":                   {"profile"},
+		"DELETE FROM public.users WHERE id = 1":                     {"users"},
+		"TRUNCATE users, profile, orders":                           {"users", "profile"},
+		"SELECT * FROM users; UPDATE profile SET bio = ''":          {"profile"},
+		"UPDATE other.users SET name = 'foo'":                       nil,
+		"SELECT * FROM users JOIN profile ON users.id = profile.id": nil,
+	}
+	for statement, expected := range statements {
+		q, err := Parse([]byte(statement))
+		require.NoError(t, err)
+
+		var names []string
+		for _, table := range q.Modified(testCaches()) {
+			names = append(names, table.Name)
+		}
+		require.Equal(t, expected, names, statement)
+	}
+}
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// relations is the golden representation of a parsed query.
+type relations struct {
+	Read     []string `json:"read"`
+	Modified []string `json:"modified"`
+	// NotCacheable is the reason why the result cannot be cached.
+	NotCacheable string `json:"not_cacheable,omitempty"`
+}
+
+func sortedRelations(h map[string]map[string]struct{}) []string {
+	result := []string{}
+	for schema, tables := range h {
+		for table := range tables {
+			result = append(result, schema+"."+table)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestMatcher_Parse_Golden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "queries", "*.sql"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+
+	for _, file := range files {
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			query, err := os.ReadFile(file)
+			require.NoError(t, err)
+
+			q, err := Parse(query)
+			require.NoError(t, err)
+			data, err := json.MarshalIndent(relations{
+				Read:         sortedRelations(q.hierarchy),
+				Modified:     sortedRelations(q.modified),
+				NotCacheable: q.NotCacheable(),
+			}, "", "  ")
+			require.NoError(t, err)
+			data = append(data, '\n')
+
+			golden := strings.TrimSuffix(file, ".sql") + ".golden"
+			if *update {
+				require.NoError(t, os.WriteFile(golden, data, 0644))
+			}
+			expected, err := os.ReadFile(golden)
+			require.NoError(t, err)
+			require.Equal(t, string(expected), string(data))
+		})
+	}
+}
+
+func TestMatcher_ResolveViews(t *testing.T) {
+	q, err := Parse([]byte("SELECT * FROM active_users JOIN orders ON orders.user_id = active_users.id"))
+	require.NoError(t, err)
+
+	q.ResolveViews(Views{
+		{Schema: "public", Name: "active_users"}: {{Schema: "public", Name: "user_summary"}},
+		{Schema: "public", Name: "user_summary"}: {
+			{Schema: "public", Name: "users"},
+			{Schema: "public", Name: "profile"},
+		},
+	})
+	require.Equal(t, []string{"public.orders", "public.profile", "public.users"}, sortedRelations(q.hierarchy))
+}
+
+func TestMatcher_SearchPath(t *testing.T) {
+	sp := &SearchPath{Schemas: []string{"$user", "app", "public"}, User: "alice"}
+	q, err := ParseInSearchPath([]byte("SELECT * FROM users JOIN public.profile USING (id)"), sp)
+	require.NoError(t, err)
+	// Without the catalog, the first schema except "$user" is used.
+	require.Equal(t, []string{"app.users", "public.profile"}, sortedRelations(q.hierarchy))
+
+	catalog := &Catalog{}
+	catalog.AddRelation("alice", "orders")
+	catalog.AddRelation("public", "users")
+	catalog.AddRelation("pg_catalog", "pg_class")
+	sp.Relations = catalog.Relations
+	q, err = ParseInSearchPath([]byte("SELECT * FROM users, orders, pg_class, missing"), sp)
+	require.NoError(t, err)
+	require.Equal(t,
+		[]string{"alice.missing", "alice.orders", "pg_catalog.pg_class", "public.users"},
+		sortedRelations(q.hierarchy),
+	)
+}
+
+func TestMatcher_SearchPathChange(t *testing.T) {
+	statements := map[string]*SearchPathChange{
+		`SET search_path TO app, "Public"`:        {Schemas: []string{"app", "Public"}},
+		"SET LOCAL search_path = app":             {Schemas: []string{"app"}, Local: true},
+		"SET SESSION search_path TO '$user', app": {Schemas: []string{"$user", "app"}},
+		"SET search_path TO DEFAULT":              {},
+		"RESET search_path":                       {},
+		"RESET ALL":                               {},
+		"DISCARD ALL":                             {},
+		"SET statement_timeout = 0":               nil,
+		"SELECT * FROM users":                     nil,
+	}
+	for statement, expected := range statements {
+		q, err := Parse([]byte(statement))
+		require.NoError(t, err)
+		require.Equal(t, expected, q.SearchPathChange(), statement)
+	}
+}
+
+func TestMatcher_TempRelations(t *testing.T) {
+	statements := map[string]bool{
+		"CREATE TEMP TABLE users (id int)":           true,
+		"CREATE TEMPORARY VIEW v AS SELECT 1":        true,
+		"CREATE TABLE pg_temp.users (id int)":        true,
+		"SELECT * INTO TEMP recent FROM users":       true,
+		"CREATE TEMP TABLE recent AS SELECT 1":       true,
+		"SELECT * FROM pg_temp.users":                true,
+		"CREATE TABLE users (id int)":                false,
+		"SELECT * FROM users JOIN profile USING(id)": false,
+	}
+	for statement, expected := range statements {
+		q, err := Parse([]byte(statement))
+		require.NoError(t, err)
+		require.Equal(t, expected, q.TempRelations(), statement)
+	}
+}
+
+func TestMatcher_ParseSearchPath(t *testing.T) {
+	require.Equal(t, []string{"$user", "public"}, ParseSearchPath(`"$user", public`))
+	require.Equal(t, []string{"My Schema", `a"b`}, ParseSearchPath(`"My Schema",  "a""b"`))
+	require.Nil(t, ParseSearchPath(""))
+}
+
+func TestMatcher_ParseHints(t *testing.T) {
+	statements := map[string]*Hints{
+		"SELECT * FROM users":                                                    {},
+		"/* pgscale:cache ttl=30s */ SELECT * FROM users":                        {TTL: 30 * time.Second},
+		"-- pgscale:nocache\nSELECT * FROM users":                                {NoCache: true},
+		"\n/* app:orders */ /* pgscale:refresh pgscale:cache ttl=1m */ SELECT 1": {Refresh: true, TTL: time.Minute},
+		"SELECT * FROM users /* pgscale:nocache */":                              {},
+		"/* see pgscale:nocache */ SELECT 1":                                     {NoCache: true},
+	}
+	for statement, expected := range statements {
+		hints, err := ParseHints([]byte(statement))
+		require.NoError(t, err, statement)
+		require.Equal(t, expected, hints, statement)
+	}
+
+	hints, err := ParseHints([]byte("/* pgscale:cache ttl=soon pgscale:nocache pgscale:forever */ SELECT 1"))
+	require.EqualError(t, err, `invalid query hints: invalid ttl: "soon", unknown hint: pgscale:forever`)
+	require.Equal(t, &Hints{NoCache: true}, hints)
+}
@@ -0,0 +1,172 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matcher
+
+import (
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// userSchema is replaced with the name of the user in search_path.
+const userSchema = "$user"
+
+const catalogSchema = "pg_catalog"
+
+// DefaultSearchPath is the default value of search_path in PostgreSQL.
+var DefaultSearchPath = []string{userSchema, "public"}
+
+// SearchPath resolves the schemas of the unqualified relations in a query.
+type SearchPath struct {
+	// Schemas are the schemas in search_path, in order.
+	Schemas []string
+	// User is the name that replaces "$user".
+	User string
+	// Relations are the relations in the database by schema. If it's nil, an
+	// unqualified relation is in the first schema of Schemas, except "$user".
+	Relations map[string]map[string]struct{}
+	// Functions are the immutable functions by schema. If it's nil, only the functions
+	// in the built-in list are volatile.
+	Functions map[string]map[string]struct{}
+}
+
+func (s *SearchPath) exists(schema, name string) bool {
+	_, ok := s.Relations[schema][name]
+	return ok
+}
+
+// resolve returns the schema of an unqualified relation like PostgreSQL does. pg_catalog
+// is searched first if it's not in search_path.
+func (s *SearchPath) resolve(name string) string {
+	if s == nil {
+		return "public"
+	}
+
+	if s.Relations == nil {
+		for _, schema := range s.Schemas {
+			if schema != userSchema {
+				return schema
+			}
+		}
+		return "public"
+	}
+
+	schemas := s.Schemas
+	if !contains(schemas, catalogSchema) {
+		schemas = append([]string{catalogSchema}, schemas...)
+	}
+	var first string
+	for _, schema := range schemas {
+		if schema == userSchema {
+			schema = s.User
+		}
+		if first == "" && schema != catalogSchema {
+			first = schema
+		}
+		if s.exists(schema, name) {
+			return schema
+		}
+	}
+	// The relation doesn't exist, the server returns an error.
+	if first == "" {
+		return "public"
+	}
+	return first
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSearchPath parses the value of search_path, such as `"$user", public`.
+func ParseSearchPath(value string) []string {
+	var schemas []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) >= 2 && item[0] == '"' && item[len(item)-1] == '"' {
+			item = strings.ReplaceAll(item[1:len(item)-1], `""`, `"`)
+		}
+		if item != "" {
+			schemas = append(schemas, item)
+		}
+	}
+	return schemas
+}
+
+// SearchPathChange is a SET or RESET of search_path in a query.
+type SearchPathChange struct {
+	// Schemas is nil if search_path is reset to its default.
+	Schemas []string
+	// Local is true for SET LOCAL, the change is reverted at the end of the transaction.
+	Local bool
+}
+
+// SearchPathChange returns the last change of search_path in the query, nil if the
+// query doesn't change it.
+func (q *Query) SearchPathChange() *SearchPathChange {
+	return q.searchPathChange
+}
+
+// TempRelations returns true if the query creates or reads a temporary relation. The
+// temporary schema is searched first, its relations shadow the cache tables for the
+// rest of the session.
+func (q *Query) TempRelations() bool {
+	return q.tempRelations
+}
+
+// isTempRelation returns true if a RangeVar is a temporary relation, such as the
+// target of CREATE TEMP TABLE or a relation in pg_temp.
+func isTempRelation(rangeVar *fastjson.Value) bool {
+	if string(rangeVar.Get("relpersistence").GetStringBytes()) == "t" {
+		return true
+	}
+	return strings.HasPrefix(string(rangeVar.Get("schemaname").GetStringBytes()), "pg_temp")
+}
+
+// searchPathChange returns the change of search_path in a statement, if there is one.
+func searchPathChange(value *fastjson.Value) *SearchPathChange {
+	if target := value.Get("DiscardStmt", "target").GetStringBytes(); string(target) == "DISCARD_ALL" {
+		return &SearchPathChange{}
+	}
+
+	stmt := value.Get("VariableSetStmt")
+	if stmt == nil {
+		return nil
+	}
+	kind := string(stmt.Get("kind").GetStringBytes())
+	if kind == "VAR_RESET_ALL" {
+		return &SearchPathChange{}
+	}
+	if string(stmt.Get("name").GetStringBytes()) != "search_path" {
+		return nil
+	}
+
+	change := &SearchPathChange{Local: stmt.GetBool("is_local")}
+	if kind != "VAR_SET_VALUE" {
+		// VAR_SET_DEFAULT or VAR_RESET
+		return change
+	}
+	for _, arg := range stmt.Get("args").GetArray() {
+		if schema := arg.Get("A_Const", "val", "String", "str").GetStringBytes(); schema != nil {
+			change.Schemas = append(change.Schemas, string(schema))
+		}
+	}
+	return change
+}
@@ -0,0 +1,6 @@
+WITH recent AS (
+    SELECT * FROM orders WHERE created_at > now() - interval '1 day'
+), big AS (
+    SELECT * FROM recent WHERE total > 100
+)
+SELECT users.name, big.total FROM big JOIN users ON users.id = big.user_id;
@@ -0,0 +1,4 @@
+SELECT *
+FROM users
+JOIN profile ON profile.user_id = users.id
+FOR UPDATE OF users SKIP LOCKED;
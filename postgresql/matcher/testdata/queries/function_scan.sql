@@ -0,0 +1 @@
+SELECT * FROM generate_series(1, 10) AS g(n) JOIN users ON users.id = g.n;
@@ -0,0 +1,4 @@
+SELECT u.id, p.bio
+FROM users u
+JOIN profile p ON p.user_id = u.id
+LEFT JOIN billing.invoices i ON i.user_id = u.id;
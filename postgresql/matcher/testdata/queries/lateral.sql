@@ -0,0 +1,5 @@
+SELECT u.id, last_order.total
+FROM users u
+CROSS JOIN LATERAL (
+    SELECT total FROM orders o WHERE o.user_id = u.id ORDER BY created_at DESC LIMIT 1
+) AS last_order;
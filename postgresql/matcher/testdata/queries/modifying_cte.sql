@@ -0,0 +1,4 @@
+WITH moved AS (
+    DELETE FROM orders WHERE created_at < '2020-01-01' RETURNING *
+)
+INSERT INTO archive.orders SELECT * FROM moved;
@@ -0,0 +1,2 @@
+WITH users AS (SELECT 1 AS id)
+SELECT * FROM users JOIN public.users pu ON pu.id = users.id;
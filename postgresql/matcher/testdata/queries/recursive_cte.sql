@@ -0,0 +1,6 @@
+WITH RECURSIVE tree AS (
+    SELECT id, parent_id FROM categories WHERE parent_id IS NULL
+    UNION ALL
+    SELECT c.id, c.parent_id FROM categories c JOIN tree t ON c.parent_id = t.id
+)
+SELECT * FROM tree;
@@ -0,0 +1,2 @@
+SELECT u.id, (SELECT count(*) FROM orders o WHERE o.user_id = u.id) AS order_count
+FROM users u;
@@ -0,0 +1,3 @@
+SELECT id, name
+INTO TEMPORARY users_copy
+FROM users;
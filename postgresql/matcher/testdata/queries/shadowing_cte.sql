@@ -0,0 +1,4 @@
+WITH profile AS (
+    SELECT * FROM profile WHERE bio IS NOT NULL
+)
+SELECT users.name, profile.bio FROM users JOIN profile ON profile.user_id = users.id;
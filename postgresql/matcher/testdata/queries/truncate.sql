@@ -0,0 +1 @@
+TRUNCATE users, billing.invoices;
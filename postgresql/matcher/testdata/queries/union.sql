@@ -0,0 +1,5 @@
+SELECT id, name FROM users
+UNION
+SELECT id, name FROM archive.users
+EXCEPT
+SELECT id, name FROM banned_users;
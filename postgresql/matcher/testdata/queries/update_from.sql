@@ -0,0 +1 @@
+UPDATE profile SET bio = u.name FROM users u WHERE u.id = profile.user_id;
@@ -0,0 +1,3 @@
+SELECT now() AS fetched_at, u.*
+FROM users u
+WHERE u.id IN (SELECT user_id FROM profile WHERE random() < 0.5);
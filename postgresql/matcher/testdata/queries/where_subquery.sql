@@ -0,0 +1,3 @@
+SELECT * FROM users
+WHERE id IN (SELECT user_id FROM orders WHERE total > 100)
+  AND EXISTS (SELECT 1 FROM profile WHERE profile.user_id = users.id);
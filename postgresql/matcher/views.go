@@ -0,0 +1,74 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matcher
+
+// Relation is a table or a view in a schema.
+type Relation struct {
+	Schema string
+	Name   string
+}
+
+// Views contains the relations that are referenced in the definition of every view.
+type Views map[Relation][]Relation
+
+// ViewsQuery returns the relations that are referenced by the views in the catalog, one
+// row for every view and relation.
+const ViewsQuery = `SELECT DISTINCT vn.nspname, v.relname, tn.nspname, t.relname
+FROM pg_catalog.pg_rewrite r
+JOIN pg_catalog.pg_class v ON v.oid = r.ev_class
+JOIN pg_catalog.pg_namespace vn ON vn.oid = v.relnamespace
+JOIN pg_catalog.pg_depend d ON d.objid = r.oid
+	AND d.classid = 'pg_catalog.pg_rewrite'::regclass
+	AND d.refclassid = 'pg_catalog.pg_class'::regclass
+JOIN pg_catalog.pg_class t ON t.oid = d.refobjid
+JOIN pg_catalog.pg_namespace tn ON tn.oid = t.relnamespace
+WHERE v.relkind = 'v' AND t.oid <> v.oid
+	AND vn.nspname NOT IN ('pg_catalog', 'information_schema')`
+
+func resolveView(h map[string]map[string]struct{}, views Views, r Relation, visited map[Relation]struct{}) {
+	base, ok := views[r]
+	if !ok {
+		add(h, r.Schema, r.Name)
+		return
+	}
+	if _, ok = visited[r]; ok {
+		return
+	}
+	visited[r] = struct{}{}
+	for _, relation := range base {
+		resolveView(h, views, relation, visited)
+	}
+}
+
+func resolveViews(h map[string]map[string]struct{}, views Views) map[string]map[string]struct{} {
+	resolved := make(map[string]map[string]struct{})
+	for schema, relations := range h {
+		for name := range relations {
+			resolveView(resolved, views, Relation{Schema: schema, Name: name}, make(map[Relation]struct{}))
+		}
+	}
+	return resolved
+}
+
+// ResolveViews replaces the views in the query with the tables in their definitions,
+// the views of views are resolved too. The results of a query on a view are cached
+// and invalidated by its tables.
+func (q *Query) ResolveViews(views Views) {
+	if len(views) == 0 {
+		return
+	}
+	q.hierarchy = resolveViews(q.hierarchy, views)
+	q.modified = resolveViews(q.modified, views)
+}
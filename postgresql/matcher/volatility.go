@@ -0,0 +1,151 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package matcher
+
+import (
+	"strings"
+
+	"github.com/valyala/fastjson"
+)
+
+// volatileFunctions are the built-in functions that are not immutable. Their results
+// can change between two calls with the same arguments, so a query that calls one of
+// them is not cached. It's used if the functions of the catalog are not known.
+var volatileFunctions = map[string]struct{}{
+	// Date and time
+	"now":                   {},
+	"clock_timestamp":       {},
+	"statement_timestamp":   {},
+	"transaction_timestamp": {},
+	"timeofday":             {},
+	// Random values
+	"random":             {},
+	"setseed":            {},
+	"gen_random_uuid":    {},
+	"uuid_generate_v1":   {},
+	"uuid_generate_v4":   {},
+	"gen_random_bytes":   {},
+	"pg_sleep":           {},
+	"pg_sleep_for":       {},
+	"pg_sleep_until":     {},
+	"nextval":            {},
+	"currval":            {},
+	"lastval":            {},
+	"setval":             {},
+	"txid_current":       {},
+	"pg_current_xact_id": {},
+	// Session and server state
+	"current_setting":          {},
+	"set_config":               {},
+	"current_database":         {},
+	"current_schema":           {},
+	"current_schemas":          {},
+	"current_query":            {},
+	"pg_backend_pid":           {},
+	"inet_client_addr":         {},
+	"inet_client_port":         {},
+	"inet_server_addr":         {},
+	"inet_server_port":         {},
+	"pg_postmaster_start_time": {},
+	"pg_current_wal_lsn":       {},
+	"pg_is_in_recovery":        {},
+	"version":                  {},
+	// Locks and notifications
+	"pg_advisory_lock":          {},
+	"pg_advisory_xact_lock":     {},
+	"pg_try_advisory_lock":      {},
+	"pg_try_advisory_xact_lock": {},
+	"pg_notify":                 {},
+}
+
+// ImmutableFunctionsQuery returns the functions that are immutable. An overloaded
+// function is returned only if all of its variants are. The functions that are created
+// later are not in the catalog, they are not cached until it's read again.
+const ImmutableFunctionsQuery = `SELECT n.nspname, p.proname
+FROM pg_catalog.pg_proc p
+JOIN pg_catalog.pg_namespace n ON n.oid = p.pronamespace
+GROUP BY n.nspname, p.proname
+HAVING bool_and(p.provolatile = 'i')`
+
+// functionName returns the schema and the name of a function call, the schema is
+// empty if it's not qualified.
+func functionName(funcname []*fastjson.Value) (string, string) {
+	var parts []string
+	for _, item := range funcname {
+		parts = append(parts, string(item.Get("String", "str").GetStringBytes()))
+	}
+	switch len(parts) {
+	case 0:
+		return "", ""
+	case 1:
+		return "", parts[0]
+	default:
+		return parts[len(parts)-2], parts[len(parts)-1]
+	}
+}
+
+// isVolatile returns true if a function call may return a different result for the
+// same arguments. An unqualified function is resolved in pg_catalog and search_path,
+// the first schema that has a function with the name is used. A function that's not
+// known to be immutable is volatile.
+func (s *SearchPath) isVolatile(schema, name string) bool {
+	if _, ok := volatileFunctions[strings.ToLower(name)]; ok {
+		return true
+	}
+	if s == nil || s.Functions == nil {
+		return false
+	}
+
+	if schema != "" {
+		_, ok := s.Functions[schema][name]
+		return !ok
+	}
+	if _, ok := s.Functions[catalogSchema][name]; ok {
+		return false
+	}
+	for _, schema := range s.Schemas {
+		if schema == userSchema {
+			schema = s.User
+		}
+		if _, ok := s.Functions[schema][name]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// checkVolatility marks the query as not cacheable if value is a construct whose
+// result is not determined by the tables: a volatile or stable function, a
+// CURRENT_TIMESTAMP like value function, a locking clause, SELECT INTO or TABLESAMPLE.
+func (q *Query) checkVolatility(value *fastjson.Value) {
+	if fn := value.Get("FuncCall"); fn != nil {
+		schema, name := functionName(fn.Get("funcname").GetArray())
+		if q.searchPath.isVolatile(schema, name) {
+			q.notCacheable("calls volatile function " + name)
+		}
+	}
+	if value.Get("SQLValueFunction") != nil {
+		q.notCacheable("calls SQL value function")
+	}
+	if value.Get("RangeTableSample") != nil {
+		q.notCacheable("samples a table")
+	}
+	if len(value.Get("lockingClause").GetArray()) > 0 {
+		q.notCacheable("has a locking clause")
+	}
+	if value.Get("intoClause") != nil {
+		q.notCacheable("creates a table by SELECT INTO")
+	}
+}
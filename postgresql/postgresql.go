@@ -16,31 +16,94 @@ package postgresql
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/buraksezer/olric/pkg/flog"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgproto3/v2"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pgscale/pgscale/audit"
 	"github.com/pgscale/pgscale/config"
 	"github.com/pgscale/pgscale/dmaps"
 	"github.com/pgscale/pgscale/kontext"
+	"github.com/pgscale/pgscale/logging"
 	"github.com/pgscale/pgscale/postgresql/auth"
 	"github.com/pgscale/pgscale/postgresql/dbconn"
+	"github.com/pgscale/pgscale/slowlog"
 	"github.com/pgscale/pgscale/tcp"
+	"github.com/pgscale/pgscale/tracing"
+	"github.com/pgscale/pgscale/upgrade"
 	"github.com/pgscale/pgscale/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type PostgreSQL struct {
-	log     *flog.Logger
+	// mtx protects config, users and dbconns, they are replaced by Reload. The pools of
+	// the databases with passthrough_auth are added to dbconns on demand.
+	mtx     sync.RWMutex
+	log     *logging.Logger
 	config  *config.Config
+	users   *auth.Users
 	dbconns map[string]map[string]*dbconn.Conn
 	server  *tcp.Server
 	dmaps   *dmaps.DMaps
+	slowlog *slowlog.SlowLog
+	tracing *tracing.Tracing
+	auditor *audit.Auditor
+	limits  *connLimits
 	ctx     context.Context
 	cancel  context.CancelFunc
+
+	// listening is set to 1 after the TCP listener is bound.
+	listening int32
+	started   chan struct{}
+
+	// inherited are the listeners that are taken over from the old process.
+	inherited map[string]net.Listener
+
+	// listenersMtx protects listeners, the listener blocks by name.
+	listenersMtx sync.Mutex
+	listeners    map[string]net.Listener
+
+	// reloader runs the RELOAD command of the admin console.
+	reloader Reloader
+
+	// proxiesMtx protects proxies, admins and draining.
+	proxiesMtx sync.Mutex
+	proxies    map[*Proxy]struct{}
+	admins     map[*adminConsole]struct{}
+	draining   bool
+}
+
+const (
+	defaultShutdownTimeout     = 30 * time.Second
+	defaultQueryWaitTimeout    = 120 * time.Second
+	defaultReservePoolTimeout  = 5 * time.Second
+	defaultMaxPassthroughUsers = 100
+)
+
+// shutdownTimeout returns the time to wait for the running transactions on shutdown.
+func shutdownTimeout(c *config.Config) (time.Duration, error) {
+	if c.PgScale.ShutdownTimeout == nil {
+		return defaultShutdownTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(*c.PgScale.ShutdownTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid shutdown_timeout: %w", err)
+	}
+	return timeout, nil
 }
 
 func New(k *kontext.Kontext) (*PostgreSQL, error) {
@@ -49,7 +112,7 @@ func New(k *kontext.Kontext) (*PostgreSQL, error) {
 		return nil, err
 	}
 
-	lg, err := utils.FlogFromKontext(k)
+	lg, err := logging.FromKontext(k)
 	if err != nil {
 		return nil, err
 	}
@@ -59,14 +122,58 @@ func New(k *kontext.Kontext) (*PostgreSQL, error) {
 		return nil, err
 	}
 
+	sl, err := slowlog.FromKontext(k)
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := tracing.FromKontext(k)
+	if err != nil {
+		return nil, err
+	}
+
+	au, err := audit.FromKontext(k)
+	if err != nil {
+		return nil, err
+	}
+
+	inherited, err := upgrade.ListenersFromKontext(k)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = shutdownTimeout(c); err != nil {
+		return nil, err
+	}
+	if _, err = parseClientTimeouts(c); err != nil {
+		return nil, err
+	}
+
+	users, err := auth.NewUsers(c, dms)
+	if err != nil {
+		return nil, err
+	}
+
+	// The admin console cannot reload without a reloader, such as in tests.
+	reloader, _ := k.Get(kontext.ReloaderKey).(Reloader)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	p := &PostgreSQL{
-		log:     lg,
-		config:  c,
-		dbconns: make(map[string]map[string]*dbconn.Conn),
-		dmaps:   dms,
-		ctx:     ctx,
-		cancel:  cancel,
+		log:       lg.With(logging.F("component", "postgresql")),
+		config:    c,
+		users:     users,
+		dmaps:     dms,
+		slowlog:   sl,
+		tracing:   tr,
+		auditor:   au,
+		limits:    newConnLimits(),
+		inherited: inherited,
+		reloader:  reloader,
+		ctx:       ctx,
+		cancel:    cancel,
+		proxies:   make(map[*Proxy]struct{}),
+		admins:    make(map[*adminConsole]struct{}),
+		started:   make(chan struct{}),
 	}
 
 	err = p.initializePools()
@@ -80,50 +187,309 @@ func New(k *kontext.Kontext) (*PostgreSQL, error) {
 func (p *PostgreSQL) afterRelease(conn *pgx.Conn, db *config.Database) bool {
 	_, releaseErr := conn.Query(p.ctx, db.ResetQuery)
 	if releaseErr != nil {
-		p.log.V(3).Printf("[ERROR] Failed to reset session: %v", releaseErr)
+		p.log.With(logging.F("database", db.Dbname)).V(3).Printf("[ERROR] Failed to reset session: %v", releaseErr)
 		return false
 	}
 	return true
 }
 
-func (p *PostgreSQL) initializePools() error {
-	for i, database := range p.config.PgScale.PostgreSQL.Databases {
-		cfg, err := pgxpool.ParseConfig(database.ConnString())
+func (p *PostgreSQL) newDBConn(database config.Database) (*dbconn.Conn, error) {
+	cfg, err := pgxpool.ParseConfig(database.ConnString())
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.AfterRelease = func(conn *pgx.Conn) bool {
+		return p.afterRelease(conn, &database)
+	}
+
+	queue, err := queueOptions(&database.ConnectionPool, int(cfg.MaxConns))
+	if err != nil {
+		return nil, err
+	}
+	// The reserve pool is a part of the pool, the queue limits its usage.
+	cfg.MaxConns += int32(queue.ReserveSize)
+
+	return &dbconn.Conn{
+		Database: &database,
+		Config:   cfg,
+		Queue:    dbconn.NewQueue(queue),
+	}, nil
+}
+
+// queueOptions returns the options of the client queue of a pool with size connections.
+func queueOptions(c *config.ConnectionPool, size int) (dbconn.QueueOptions, error) {
+	opts := dbconn.QueueOptions{
+		Size:           size,
+		ReserveSize:    config.Limit(c.ReservePoolSize),
+		ReserveTimeout: defaultReservePoolTimeout,
+		MaxWaiting:     config.Limit(c.MaxWaitClients),
+		WaitTimeout:    defaultQueryWaitTimeout,
+	}
+
+	var err error
+	if c.QueryWaitTimeout != nil {
+		opts.WaitTimeout, err = time.ParseDuration(*c.QueryWaitTimeout)
 		if err != nil {
-			return err
+			return opts, fmt.Errorf("invalid query_wait_timeout: %w", err)
+		}
+	}
+	if c.ReservePoolTimeout != nil {
+		opts.ReserveTimeout, err = time.ParseDuration(*c.ReservePoolTimeout)
+		if err != nil {
+			return opts, fmt.Errorf("invalid reserve_pool_timeout: %w", err)
 		}
+	}
+	return opts, nil
+}
 
-		cfg.AfterRelease = func(conn *pgx.Conn) bool {
-			return p.afterRelease(conn, &p.config.PgScale.PostgreSQL.Databases[i])
+func makeDBConns(c *config.Config, newDBConn func(config.Database) (*dbconn.Conn, error)) (map[string]map[string]*dbconn.Conn, error) {
+	dbconns := make(map[string]map[string]*dbconn.Conn)
+	for _, database := range c.PgScale.PostgreSQL.Databases {
+		if database.Passthrough() {
+			// The pools are created per user after authentication.
+			continue
+		}
+		dc, err := newDBConn(database)
+		if err != nil {
+			return nil, err
 		}
 
-		d := p.config.PgScale.PostgreSQL.Databases[i]
-		_, ok := p.dbconns[cfg.ConnConfig.User]
+		_, ok := dbconns[dc.Config.ConnConfig.User]
 		if !ok {
-			p.dbconns[cfg.ConnConfig.User] = make(map[string]*dbconn.Conn)
+			dbconns[dc.Config.ConnConfig.User] = make(map[string]*dbconn.Conn)
+		}
+		dbconns[dc.Config.ConnConfig.User][dc.Config.ConnConfig.Database] = dc
+	}
+	return dbconns, nil
+}
+
+func (p *PostgreSQL) initializePools() error {
+	dbconns, err := makeDBConns(p.config, p.newDBConn)
+	if err != nil {
+		return err
+	}
+	p.dbconns = dbconns
+	return nil
+}
+
+// sameConnSettings returns true if a pool that's created for a can be used for b.
+func sameConnSettings(a, b *config.Database) bool {
+	return reflect.DeepEqual(a.Parameters, b.Parameters) &&
+		reflect.DeepEqual(a.ConnectionPool, b.ConnectionPool) &&
+		a.ResetQuery == b.ResetQuery &&
+		a.Passthrough() == b.Passthrough()
+}
+
+// maxPassthroughUsers returns the number of users that can get a pool of a database
+// with passthrough_auth, zero means no limit.
+func maxPassthroughUsers(database *config.Database) int {
+	if database.MaxPassthroughUsers == nil {
+		return defaultMaxPassthroughUsers
+	}
+	return *database.MaxPassthroughUsers
+}
+
+// verifyPassthrough authenticates a user on a database with passthrough_auth by
+// connecting to the backend with the credentials of the client. Every login is verified,
+// PostgreSQL remains the source of truth for the passwords and the roles. The pool of the
+// user is created on demand and it's replaced if the password has been changed.
+func (p *PostgreSQL) verifyPassthrough(ctx context.Context, s *auth.Session, password string) error {
+	p.mtx.RLock()
+	c := p.config
+	p.mtx.RUnlock()
+
+	database := c.PgScale.PostgreSQL.Database(s.Database)
+	if database == nil {
+		return fmt.Errorf("database %s is not in the configuration", s.Database)
+	}
+	dc, err := p.newDBConn(*database)
+	if err != nil {
+		return err
+	}
+	dc.Config.ConnConfig.User = s.User
+	dc.Config.ConnConfig.Password = password
+
+	conn, err := pgconn.ConnectConfig(ctx, &dc.Config.ConnConfig.Config)
+	if err != nil {
+		return err
+	}
+	if err = conn.Close(ctx); err != nil {
+		p.log.With(logging.F("database", s.Database)).V(3).Printf("[ERROR] Failed to close connection: %v", err)
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.config != c {
+		// The configuration has been reloaded in the meantime, the pool is created by
+		// the next session.
+		return nil
+	}
+	current := p.dbconns[s.User][s.Database]
+	if current != nil && subtle.ConstantTimeCompare([]byte(current.Config.ConnConfig.Password), []byte(password)) == 1 {
+		return nil
+	}
+	if current == nil {
+		if max := maxPassthroughUsers(database); max > 0 && p.passthroughUsers(s.Database) >= max {
+			return &pgconn.PgError{
+				Severity: "FATAL",
+				Code:     "53300",
+				Message:  fmt.Sprintf("too many users for database \"%s\"", s.Database),
+			}
 		}
-		db := p.dbconns[cfg.ConnConfig.User]
-		db[cfg.ConnConfig.Database] = &dbconn.Conn{
-			Database: &d,
-			Config:   cfg,
+	}
+
+	if _, ok := p.dbconns[s.User]; !ok {
+		p.dbconns[s.User] = make(map[string]*dbconn.Conn)
+	}
+	if current != nil {
+		if pool := current.CurrentPool(); pool != nil {
+			go pool.Close()
 		}
 	}
+	p.dbconns[s.User][s.Database] = dc
 	return nil
 }
 
+// passthroughUsers returns the number of users that have a pool of the database. The
+// caller must hold mtx.
+func (p *PostgreSQL) passthroughUsers(database string) int {
+	n := 0
+	for _, db := range p.dbconns {
+		if _, ok := db[database]; ok {
+			n++
+		}
+	}
+	return n
+}
+
+// Reload replaces the running configuration. New sessions authenticate against the
+// users of c and connect to its databases. A pool is kept if the connection settings
+// of its database are unchanged, otherwise it's closed after the running sessions
+// release their connections.
+func (p *PostgreSQL) Reload(c *config.Config) error {
+	if _, err := shutdownTimeout(c); err != nil {
+		return err
+	}
+	if _, err := parseClientTimeouts(c); err != nil {
+		return err
+	}
+
+	dbconns, err := makeDBConns(c, p.newDBConn)
+	if err != nil {
+		return err
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	users, err := p.users.Update(c)
+	if err != nil {
+		return err
+	}
+
+	var stale []*dbconn.Conn
+	for user, db := range p.dbconns {
+		for name, current := range db {
+			if current.Database.Passthrough() {
+				// Keep the pools of the authenticated users.
+				database := c.PgScale.PostgreSQL.Database(name)
+				if database != nil && sameConnSettings(current.Database, database) {
+					if _, ok := dbconns[user]; !ok {
+						dbconns[user] = make(map[string]*dbconn.Conn)
+					}
+					dbconns[user][name] = current
+					continue
+				}
+				stale = append(stale, current)
+				continue
+			}
+
+			dc, ok := dbconns[user][name]
+			if ok && sameConnSettings(current.Database, dc.Database) {
+				dc.Pool = current.CurrentPool()
+				dc.Queue = current.Queue
+				continue
+			}
+			stale = append(stale, current)
+			if ok {
+				p.log.With(logging.F("database", name)).V(2).Printf("[INFO] Connection settings have been changed")
+			} else {
+				p.log.With(logging.F("database", name)).V(2).Printf("[INFO] Database has been removed")
+			}
+		}
+	}
+	for user, db := range dbconns {
+		for name := range db {
+			if _, ok := p.dbconns[user][name]; !ok {
+				p.log.With(logging.F("database", name)).V(2).Printf("[INFO] Database has been added")
+			}
+		}
+	}
+
+	p.config = c
+	p.users = users
+	p.dbconns = dbconns
+
+	for _, dc := range stale {
+		if pool := dc.CurrentPool(); pool != nil {
+			// Close blocks until all acquired connections are released. Sessions with
+			// statement pooling fail at their next statement.
+			go pool.Close()
+		}
+	}
+	return nil
+}
+
+// ListenAndServe binds bind_addr:bind_port and serves the clients.
 func (p *PostgreSQL) ListenAndServe() error {
+	return p.serve(nil)
+}
+
+// Serve serves the clients on l, such as a listener that's inherited from another process.
+func (p *PostgreSQL) Serve(l net.Listener) error {
+	return p.serve(l)
+}
+
+// Listener returns the listener if the proxy is ready to accept connections, otherwise nil.
+func (p *PostgreSQL) Listener() net.Listener {
+	if !p.Listening() {
+		return nil
+	}
+	return p.server.Listener()
+}
+
+// Started returns a channel that's closed after the listener is bound.
+func (p *PostgreSQL) Started() <-chan struct{} {
+	return p.started
+}
+
+func (p *PostgreSQL) serve(l net.Listener) error {
+	c := p.currentConfig()
 	k := kontext.New()
-	k.Set(kontext.ConfigKey, p.config)
+	k.Set(kontext.ConfigKey, c)
 	k.Set(kontext.LoggerKey, p.log)
 	k.Set(kontext.DMapsKey, p.dmaps)
 
-	s, err := tcp.New(k, p.callback, p.proxyHandler)
+	main, err := newListener(nil, c.PgScale.TLS)
 	if err != nil {
 		return err
 	}
+	s, err := tcp.New(k, p.callback, p.handler(main))
+	if err != nil {
+		return err
+	}
+	if err = p.addListeners(s, c); err != nil {
+		return err
+	}
 	p.server = s
 
-	err = p.server.ListenAndServe()
+	if l != nil {
+		err = p.server.Serve(l)
+	} else {
+		err = p.server.ListenAndServe()
+	}
 	if err != nil {
 		if strings.Contains(err.Error(), "use of closed network connection") {
 			err = nil
@@ -134,36 +500,188 @@ func (p *PostgreSQL) ListenAndServe() error {
 }
 
 func (p *PostgreSQL) callback() {
+	atomic.StoreInt32(&p.listening, 1)
+	close(p.started)
+	c := p.currentConfig()
 	p.log.V(1).Printf("[INFO] PgScale instance addr: %s",
 		net.JoinHostPort(
-			p.config.PgScale.BindAddr,
-			p.config.PgScale.BindPort,
+			c.PgScale.BindAddr,
+			c.PgScale.BindPort,
 		),
 	)
 	p.log.V(1).Printf("[INFO] PostgreSQL proxy is ready to accept connections")
 }
 
-func (p *PostgreSQL) proxyHandler(conn net.Conn) error {
+// Listening returns true if the proxy is ready to accept connections.
+func (p *PostgreSQL) Listening() bool {
+	return atomic.LoadInt32(&p.listening) == 1
+}
+
+// CheckPools acquires a connection from every database pool and returns the
+// errors by database name. The pools are created if they don't exist yet.
+func (p *PostgreSQL) CheckPools(ctx context.Context) map[string]error {
+	p.mtx.RLock()
+	var dbconns []*dbconn.Conn
+	for _, db := range p.dbconns {
+		for _, dc := range db {
+			if dc.Database.Passthrough() {
+				// Passthrough pools need the credentials of a client.
+				continue
+			}
+			dbconns = append(dbconns, dc)
+		}
+	}
+	p.mtx.RUnlock()
+
+	result := make(map[string]error)
+	for _, dc := range dbconns {
+		result[dc.Database.Dbname] = p.checkPool(ctx, dc)
+	}
+	return result
+}
+
+// ConnStats returns the number of client connections by user and database.
+func (p *PostgreSQL) ConnStats() ConnStats {
+	return p.limits.stats()
+}
+
+func (p *PostgreSQL) currentConfig() *config.Config {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	return p.config
+}
+
+// lookup returns the pool of the given database. The pools of the databases with
+// passthrough_auth belong to the user.
+func (p *PostgreSQL) lookup(user, database string) (*dbconn.Conn, bool) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	if db := p.config.PgScale.PostgreSQL.Database(database); db != nil && db.Passthrough() {
+		dc, ok := p.dbconns[user][database]
+		return dc, ok
+	}
+	for _, db := range p.dbconns {
+		dc, ok := db[database]
+		if ok {
+			return dc, true
+		}
+	}
+	return nil, false
+}
+
+func (p *PostgreSQL) checkPool(ctx context.Context, dc *dbconn.Conn) error {
+	if err := dc.CreatePool(ctx); err != nil {
+		return err
+	}
+	return dc.Ping(ctx)
+}
+
+func (p *PostgreSQL) proxyHandler(conn net.Conn, l *listener) (err error) {
 	defer func() {
 		if cerr := conn.Close(); cerr != nil {
-			p.log.V(3).Printf("[ERROR] Failed to close client socket: %s", cerr)
+			p.log.With(logging.F("client_addr", conn.RemoteAddr().String())).V(3).Printf("[ERROR] Failed to close client socket: %s", cerr)
+		}
+	}()
+
+	ctx, span := p.tracing.Start(p.ctx, "pgscale.session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("net.peer.name", conn.RemoteAddr().String())),
+	)
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
 		}
+		span.End()
 	}()
 
-	a := auth.New(p.config, conn)
-	session, err := a.HandleStartup()
+	_, authSpan := p.tracing.Start(ctx, "pgscale.auth")
+	p.mtx.RLock()
+	c, users := p.config, p.users
+	p.mtx.RUnlock()
+
+	timeouts, err := parseClientTimeouts(c)
 	if err != nil {
 		return err
 	}
+	if timeouts.login > 0 {
+		if err = conn.SetDeadline(time.Now().Add(timeouts.login)); err != nil {
+			return err
+		}
+	}
 
-	var ok bool
-	var dc *dbconn.Conn
-	for _, db := range p.dbconns {
-		dc, ok = db[session.Database]
-		if ok {
-			break
+	a := auth.New(c, users, p.verifyPassthrough, conn, p.auditor)
+	if l.tls != nil {
+		a.EnableTLS(l.tls, l.tlsRequired)
+	}
+	session, err := a.HandleStartup(ctx)
+	// The connection is upgraded if the client has requested TLS.
+	conn = a.Conn()
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		if werr := timeoutResponse(conn, "57014", ErrLoginTimeout); werr != nil {
+			p.log.With(logging.F("client_addr", conn.RemoteAddr().String())).V(3).Printf("[ERROR] Failed to send error response: %v", werr)
+		}
+		err = ErrLoginTimeout
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		authSpan.RecordError(err)
+		authSpan.SetStatus(codes.Error, err.Error())
+		authSpan.End()
+		return err
+	}
+	authSpan.End()
+
+	connectedAt := time.Now()
+	defer func() {
+		auditErr := p.auditor.Record(&audit.Event{
+			Type:       audit.DisconnectEvent,
+			User:       session.User,
+			Database:   session.Database,
+			ClientAddr: conn.RemoteAddr().String(),
+			DurationMs: float64(time.Since(connectedAt)) / float64(time.Millisecond),
+		})
+		if auditErr != nil {
+			p.log.V(3).Printf("[ERROR] Failed to write audit record: %v", auditErr)
 		}
+	}()
+	span.SetAttributes(
+		attribute.String("db.user", session.User),
+		attribute.String("db.name", session.Database),
+	)
+
+	if !l.allows(session.Database) {
+		msg := fmt.Sprintf("no such database: %s", session.Database)
+		if werr := fatalResponse(conn, "3D000", msg); werr != nil {
+			return fmt.Errorf("failed to return error response: %w", werr)
+		}
+		return fmt.Errorf("database %s is not allowed on listener %s", session.Database, l.config.Name)
+	}
+
+	if session.Database == config.AdminDatabase && len(c.PgScale.Auth.AdminUsers) > 0 {
+		if !c.PgScale.Auth.IsAdmin(session.User) {
+			msg := fmt.Sprintf("permission denied for admin console: user \"%s\" is not in admin_users", session.User)
+			if werr := fatalResponse(conn, "42501", msg); werr != nil {
+				return fmt.Errorf("failed to return error response: %w", werr)
+			}
+			return errors.New(msg)
+		}
+		return p.serveAdmin(conn, session)
 	}
+
+	if err = p.limits.acquire(c, session.User, session.Database); err != nil {
+		if werr := fatalResponse(conn, TooManyConnections, err.Error()); werr != nil {
+			return fmt.Errorf("failed to return error response: %w", werr)
+		}
+		return err
+	}
+	defer p.limits.release(session.User, session.Database)
+
+	dc, ok := p.lookup(session.User, session.Database)
 	if !ok {
 		msg := fmt.Sprintf("failed to database: %s in config", session.Database)
 		e := &pgproto3.ErrorResponse{
@@ -185,15 +703,23 @@ func (p *PostgreSQL) proxyHandler(conn net.Conn) error {
 	k := kontext.New()
 	k.Set(kontext.LoggerKey, p.log)
 	k.Set(kontext.DMapsKey, p.dmaps)
-	k.Set(kontext.ConfigKey, p.config)
+	k.Set(kontext.ConfigKey, c)
 	k.Set(kontext.DBConnKey, dc)
 	k.Set(kontext.SessionKey, session)
+	k.Set(kontext.ListenerKey, l.config)
+	k.Set(kontext.SlowLogKey, p.slowlog)
+	k.Set(kontext.TracingKey, p.tracing)
+	k.Set(kontext.TraceContextKey, ctx)
+	k.Set(kontext.AuditorKey, p.auditor)
 
 	pr, err := NewProxy(k, conn)
 	if err != nil {
 		return err
 	}
 
+	p.addProxy(pr)
+	defer p.removeProxy(pr)
+
 	errCh := make(chan error, 1)
 	go func() {
 		errCh <- pr.Start()
@@ -211,15 +737,118 @@ func (p *PostgreSQL) proxyHandler(conn net.Conn) error {
 	return <-errCh
 }
 
+// addProxy registers a proxy to drain it on shutdown. If the server is already
+// draining, the proxy terminates the connection before the first request.
+func (p *PostgreSQL) addProxy(pr *Proxy) {
+	p.proxiesMtx.Lock()
+	defer p.proxiesMtx.Unlock()
+
+	p.proxies[pr] = struct{}{}
+	if p.draining {
+		pr.Drain()
+	}
+}
+
+func (p *PostgreSQL) removeProxy(pr *Proxy) {
+	p.proxiesMtx.Lock()
+	defer p.proxiesMtx.Unlock()
+
+	delete(p.proxies, pr)
+}
+
+// serveAdmin runs the admin console for a user in admin_users. The connection doesn't
+// count against the connection limits, an admin can reload them when they are reached.
+func (p *PostgreSQL) serveAdmin(conn net.Conn, session *auth.Session) error {
+	a := newAdminConsole(conn, session, p.reloader, p.auditor, p.log)
+
+	p.proxiesMtx.Lock()
+	p.admins[a] = struct{}{}
+	if p.draining {
+		a.Drain()
+	}
+	p.proxiesMtx.Unlock()
+	defer func() {
+		p.proxiesMtx.Lock()
+		delete(p.admins, a)
+		p.proxiesMtx.Unlock()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-p.ctx.Done():
+			if closeErr := conn.Close(); closeErr != nil {
+				p.log.V(3).Printf("[ERROR] Failed to close admin console gracefully")
+			}
+		case <-done:
+		}
+	}()
+
+	return a.serve()
+}
+
+// drain terminates the idle clients. The others are terminated after their running
+// request or transaction has been completed.
+func (p *PostgreSQL) drain() {
+	p.proxiesMtx.Lock()
+	p.draining = true
+	proxies := make([]*Proxy, 0, len(p.proxies))
+	for pr := range p.proxies {
+		proxies = append(proxies, pr)
+	}
+	admins := make([]*adminConsole, 0, len(p.admins))
+	for a := range p.admins {
+		admins = append(admins, a)
+	}
+	p.proxiesMtx.Unlock()
+
+	// The idle clients are terminated concurrently, one that doesn't read cannot
+	// delay the others. Shutdown waits for the connections to be closed.
+	for _, pr := range proxies {
+		go pr.Drain()
+	}
+	for _, a := range admins {
+		go a.Drain()
+	}
+	p.log.V(2).Printf("[INFO] Draining %d client connection(s)", len(proxies))
+}
+
+// Shutdown stops accepting new connections and drains the running ones. The
+// connections that are still running after shutdown_timeout are closed.
 func (p *PostgreSQL) Shutdown() error {
 	select {
 	case <-p.ctx.Done():
 		return nil
 	default:
 	}
+	atomic.StoreInt32(&p.listening, 0)
+
+	// It has been validated by New and Reload.
+	timeout, _ := shutdownTimeout(p.currentConfig())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var err error
+	if p.server != nil {
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- p.server.Shutdown(ctx)
+		}()
+		p.drain()
+		err = <-errCh
+	}
 
+	// Close the remaining proxies.
 	p.cancel()
+	if errors.Is(err, context.DeadlineExceeded) {
+		p.log.V(2).Printf("[WARN] Shutdown timeout has been exceeded, closing the remaining connections")
+		err = p.server.Shutdown(context.Background())
+	}
 
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	p.users.Close()
 	for _, db := range p.dbconns {
 		for _, conn := range db {
 			if conn.Pool != nil {
@@ -227,6 +856,5 @@ func (p *PostgreSQL) Shutdown() error {
 			}
 		}
 	}
-
-	return p.server.Shutdown()
+	return err
 }
@@ -55,6 +55,10 @@ func (c *Reader) Read() (*DataPacket, error) {
 
 	packetLen := binary.BigEndian.Uint32(header[1:]) - 4
 	payload := make([]byte, packetLen)
+	if packetLen == 0 {
+		// Such as Sync, there is nothing to read.
+		return &DataPacket{Identifier: header[0], Header: header, Payload: payload}, nil
+	}
 	nr, err := c.src.Read(payload)
 	if errors.Is(err, io.EOF) {
 		err = nil
@@ -17,24 +17,35 @@ package postgresql
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/buraksezer/olric"
-	"github.com/buraksezer/olric/pkg/flog"
 	"github.com/cespare/xxhash/v2"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pgscale/pgscale/audit"
 	"github.com/pgscale/pgscale/bufpool"
 	"github.com/pgscale/pgscale/config"
 	"github.com/pgscale/pgscale/dmaps"
 	"github.com/pgscale/pgscale/kontext"
+	"github.com/pgscale/pgscale/logging"
 	"github.com/pgscale/pgscale/postgresql/auth"
 	"github.com/pgscale/pgscale/postgresql/dbconn"
+	"github.com/pgscale/pgscale/postgresql/matcher"
 	"github.com/pgscale/pgscale/postgresql/protocol"
+	"github.com/pgscale/pgscale/slowlog"
+	"github.com/pgscale/pgscale/tracing"
 	"github.com/pgscale/pgscale/utils"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -47,30 +58,92 @@ const (
 	SyncIdentifier          = byte('S')
 	TerminateIdentifier     = byte('X')
 	BindIdentifier          = byte('B')
+	CloseIdentifier         = byte('C')
+	ErrorResponseIdentifier = byte('E')
+	// CommandCompleteIdentifier is sent by the backend, CloseIdentifier by the client.
+	CommandCompleteIdentifier = byte('C')
+)
+
+// Transaction status indicators of ReadyForQuery
+const (
+	IdleTxStatus          = byte('I')
+	InTransactionTxStatus = byte('T')
+	FailedTxStatus        = byte('E')
 )
 
 var (
 	ErrGetOrCreateDMap = errors.New("failed to get or create DMap")
+	ErrTableVersions   = errors.New("failed to get table versions")
 	ErrClientIsGone    = errors.New("client is gone")
+	ErrAdminShutdown   = errors.New("terminating connection due to administrator command")
 )
 
 var pool = bufpool.New()
 
+// rollbackTimeout bounds rolling back an abandoned transaction before releasing its
+// server connection.
+const rollbackTimeout = 5 * time.Second
+
 type Proxy struct {
-	config     *config.Config
-	session    *auth.Session
-	hashPrefix []byte
-	client     net.Conn
-	dbconn     *dbconn.Conn
-	log        *flog.Logger
-	dmaps      *dmaps.DMaps
-	kontext    *kontext.Kontext
-	ctx        context.Context
-	cancel     context.CancelFunc
+	config             *config.Config
+	session            *auth.Session
+	hashPrefix         []byte
+	client             net.Conn
+	dbconn             *dbconn.Conn
+	log                *logging.Logger
+	dmaps              *dmaps.DMaps
+	slowlog            *slowlog.SlowLog
+	slowQueryThreshold time.Duration
+	timeouts           clientTimeouts
+	queryLimits        queryLimits
+	policy             string
+	tracing            *tracing.Tracing
+	auditor            *audit.Auditor
+	traceCtx           context.Context
+	statement          string
+	statementStart     time.Time
+	statementCtx       context.Context
+	statementSpan      trace.Span
+	kontext            *kontext.Kontext
+	ctx                context.Context
+	cancel             context.CancelFunc
+
+	// modified contains the DMap names of the cache tables that are written in the
+	// current transaction. Their versions are bumped after it ends.
+	modified map[string]struct{}
+	// sessionSearchPath is the search_path that's set by the client, nil for the
+	// default. localSearchPath is set by SET LOCAL until the end of the transaction.
+	sessionSearchPath  []string
+	localSearchPath    []string
+	hasLocalSearchPath bool
+	// txSearchPath is the sessionSearchPath at the beginning of the transaction, it's
+	// restored if the transaction is rolled back.
+	txSearchPath []string
+	// tempRelations is true after the client has created a temporary relation, it may
+	// shadow a cache table in the rest of the session.
+	tempRelations bool
+	// hints are given in the comments of the last query that's parsed.
+	hints *matcher.Hints
+	// statementModified are the DMap names of the cache tables that are written by the
+	// last query that's parsed.
+	statementModified []string
+	// prepared contains the DMap names of the cache tables that are written by the
+	// prepared statements of the client, by name. They are modified again by every
+	// execution of the statement.
+	prepared map[string][]string
+	// statements are the queries of the prepared statements of the client, by name.
+	// They are audited at every execution.
+	statements map[string]string
+
+	// mtx protects the drain state below.
+	mtx      sync.Mutex
+	idle     bool
+	draining bool
+	txStatus byte
 }
 
 func NewProxy(k *kontext.Kontext, client net.Conn) (*Proxy, error) {
-	lg, err := utils.FlogFromKontext(k)
+	lg, err := logging.FromKontext(k)
 	if err != nil {
 		return nil, err
 	}
@@ -95,17 +168,79 @@ func NewProxy(k *kontext.Kontext, client net.Conn) (*Proxy, error) {
 		return nil, err
 	}
 
+	sl, err := slowlog.FromKontext(k)
+	if err != nil {
+		return nil, err
+	}
+
+	tr, err := tracing.FromKontext(k)
+	if err != nil {
+		return nil, err
+	}
+
+	traceCtx, err := tracing.ContextFromKontext(k)
+	if err != nil {
+		return nil, err
+	}
+
+	au, err := audit.FromKontext(k)
+	if err != nil {
+		return nil, err
+	}
+
+	var slowQueryThreshold time.Duration
+	if dc.Database.SlowQueryThreshold != nil {
+		slowQueryThreshold, err = time.ParseDuration(*dc.Database.SlowQueryThreshold)
+		if err != nil {
+			return nil, fmt.Errorf("invalid slow_query_threshold: %w", err)
+		}
+	}
+
+	timeouts, err := parseClientTimeouts(c)
+	if err != nil {
+		return nil, err
+	}
+
+	ql, err := parseQueryLimits(dc.Database, c.PgScale.Auth.Users[session.User])
+	if err != nil {
+		return nil, err
+	}
+
+	// The listener of the client can override the policy of the database.
+	policy := dc.Database.ConnectionPool.Policy
+	if l, ok := k.Get(kontext.ListenerKey).(*config.Listener); ok && l != nil && l.Policy != nil {
+		policy = *l.Policy
+	}
+
+	lg = lg.With(
+		logging.F("component", "proxy"),
+		logging.F("client_addr", client.RemoteAddr().String()),
+		logging.F("user", session.User),
+		logging.F("database", session.Database),
+	)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Proxy{
-		config:  c,
-		session: session,
-		client:  client,
-		dbconn:  dc,
-		log:     lg,
-		dmaps:   dms,
-		kontext: kontext.New(),
-		ctx:     ctx,
-		cancel:  cancel,
+		config:             c,
+		session:            session,
+		hashPrefix:         cacheKeyPrefix(dc),
+		client:             client,
+		dbconn:             dc,
+		log:                lg,
+		dmaps:              dms,
+		slowlog:            sl,
+		slowQueryThreshold: slowQueryThreshold,
+		timeouts:           timeouts,
+		queryLimits:        ql,
+		policy:             policy,
+		modified:           make(map[string]struct{}),
+		tracing:            tr,
+		auditor:            au,
+		traceCtx:           traceCtx,
+		kontext:            kontext.New(),
+		ctx:                ctx,
+		cancel:             cancel,
+		txStatus:           IdleTxStatus,
 	}, nil
 }
 
@@ -121,6 +256,14 @@ func (p *Proxy) Start() error {
 			p.log.V(3).Printf("[DEBUG] Client is gone")
 			clientErr = nil
 		}
+		if errors.Is(clientErr, ErrAdminShutdown) || (p.isDraining() && errors.Is(clientErr, net.ErrClosed)) {
+			p.log.V(3).Printf("[DEBUG] Connection has been terminated by shutdown")
+			clientErr = nil
+		}
+		if errors.Is(clientErr, ErrIdleSessionTimeout) || errors.Is(clientErr, ErrIdleTransactionTimeout) {
+			p.log.V(3).Printf("[DEBUG] Connection has been terminated: %v", clientErr)
+			clientErr = nil
+		}
 		if clientErr != nil {
 			p.log.V(3).Printf("[ERROR] Failed to process message from client to server: %v", clientErr)
 		}
@@ -140,28 +283,218 @@ func (p *Proxy) Start() error {
 	return errGr.Wait()
 }
 
-func (p *Proxy) hashQuery(query []byte) uint64 {
+// cacheKeyPrefix returns the prefix of the cache keys of a pool. The queries run as the
+// user of the pool, the results of a role are not served to another one that may lack
+// its privileges, such as the users of a database with passthrough_auth.
+func cacheKeyPrefix(dc *dbconn.Conn) []byte {
+	if dc.Config == nil {
+		return nil
+	}
+	return []byte(dc.Config.ConnConfig.User + "\x00")
+}
+
+// hashQuery returns the cache key of a query. names are the DMap names of the tables
+// that are read by the query and versions are their versions. The same query text gets
+// a different key if it resolves to other tables, such as in another search_path, and
+// the key changes after one of the tables is written.
+func (p *Proxy) hashQuery(query []byte, names []string, versions []int) uint64 {
 	h := xxhash.New()
 	_, _ = h.Write(p.hashPrefix)
 	_, _ = h.Write(query)
+	var buf [8]byte
+	for i, name := range names {
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(name))
+		_, _ = h.Write([]byte{0})
+		binary.BigEndian.PutUint64(buf[:], uint64(versions[i]))
+		_, _ = h.Write(buf[:])
+	}
 	return h.Sum64()
 }
 
-func (p *Proxy) loadFromCache(table *config.Table, data *protocol.DataPacket) (interface{}, error) {
+// parseQuery parses a statement of the client and records the cache tables that are
+// written by it. It returns false if the result of the statement cannot be served
+// from the cache.
+func (p *Proxy) parseQuery(payload []byte) (*matcher.Query, bool, error) {
+	p.statementModified = nil
+	caches := p.dbconn.Database.Caches
+	if len(caches) == 0 {
+		return nil, false, nil
+	}
+
+	isSelect := utils.StartWithSelect(payload)
+	catalog, err := p.dbconn.LoadCatalog(p.ctx)
+	if err != nil {
+		// A view cannot be told from a table.
+		p.log.V(3).Printf("[ERROR] Failed to load database catalog: %v", err)
+		isSelect = false
+	}
+
+	hints, err := matcher.ParseHints(payload)
+	if err != nil {
+		p.log.V(2).Printf("[WARN] %v", err)
+	}
+	p.hints = hints
+
+	query, err := matcher.ParseInSearchPath(payload, p.searchPath(catalog))
+	if err != nil {
+		if isSelect {
+			return nil, false, err
+		}
+		// The server returns the syntax error.
+		return nil, false, nil
+	}
+	if catalog != nil {
+		query.ResolveViews(catalog.Views)
+	}
+	p.setSearchPath(query.SearchPathChange())
+	if query.TempRelations() {
+		p.tempRelations = true
+	}
+
+	for _, table := range query.Modified(caches) {
+		p.modified[table.DMapName] = struct{}{}
+		p.statementModified = append(p.statementModified, table.DMapName)
+	}
+	// The client must see its own writes, the cache is bypassed until they are committed.
+	if !isSelect || len(p.modified) > 0 {
+		return nil, false, nil
+	}
+	if hints.NoCache {
+		p.log.V(3).Printf("[DEBUG] Query result is not cacheable, it has a pgscale:nocache hint")
+		return nil, false, nil
+	}
+	if p.tempRelations {
+		p.log.V(3).Printf("[DEBUG] Query result is not cacheable, the session has temporary relations")
+		return nil, false, nil
+	}
+	if reason := query.NotCacheable(); reason != "" {
+		p.log.V(3).Printf("[DEBUG] Query result is not cacheable, it %s", reason)
+		return nil, false, nil
+	}
+	return query, true, nil
+}
+
+// searchPath returns the search_path of the client to resolve the unqualified relations.
+func (p *Proxy) searchPath(catalog *matcher.Catalog) *matcher.SearchPath {
+	schemas := p.sessionSearchPath
+	if p.hasLocalSearchPath {
+		schemas = p.localSearchPath
+	}
+
+	sp := &matcher.SearchPath{Schemas: schemas, User: p.session.User}
+	if p.dbconn.Config != nil {
+		// The queries run as the user of the pool.
+		sp.User = p.dbconn.Config.ConnConfig.User
+	}
+	if catalog != nil {
+		sp.Relations = catalog.Relations
+		sp.Functions = catalog.Functions
+		if schemas == nil {
+			sp.Schemas = catalog.SearchPath
+		}
+	}
+	if sp.Schemas == nil {
+		sp.Schemas = matcher.DefaultSearchPath
+	}
+	return sp
+}
+
+// setSearchPath tracks a SET or RESET of search_path by the client.
+func (p *Proxy) setSearchPath(change *matcher.SearchPathChange) {
+	switch {
+	case change == nil:
+	case change.Local:
+		p.localSearchPath = change.Schemas
+		p.hasLocalSearchPath = true
+	default:
+		p.sessionSearchPath = change.Schemas
+		p.hasLocalSearchPath = false
+	}
+}
+
+// endTransaction is called after a transaction ends. SET LOCAL is reverted, and so is
+// a SET of search_path in a transaction that is rolled back.
+func (p *Proxy) endTransaction(rolledBack bool) {
+	p.localSearchPath = nil
+	p.hasLocalSearchPath = false
+	if rolledBack {
+		p.sessionSearchPath = p.txSearchPath
+	}
+}
+
+// invalidate bumps the versions of the cache tables that are written by the client.
+// It's called after the transaction is committed or rolled back.
+func (p *Proxy) invalidate() {
+	if len(p.modified) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(p.modified))
+	for name := range p.modified {
+		names = append(names, name)
+	}
+	if err := p.dmaps.Bump(names); err != nil {
+		// Try again after the next statement, the cache is bypassed until then.
+		p.log.V(3).Printf("[ERROR] Failed to invalidate cache tables: %v", err)
+		return
+	}
+	p.modified = make(map[string]struct{})
+}
+
+// loadFromCache looks up the result of a query that reads tables. The result is stored
+// in the DMap of the first table. The leading comments are not a part of the key, a
+// query with a pgscale:refresh hint replaces the result of the same query without it.
+func (p *Proxy) loadFromCache(tables []*config.Table, data *protocol.DataPacket) (interface{}, error) {
+	table := tables[0]
+	_, span := p.tracing.Start(p.spanContext(), "pgscale.cache.lookup",
+		trace.WithAttributes(
+			attribute.String("pgscale.dmap", table.DMapName),
+			attribute.Int("pgscale.cache.tables", len(tables)),
+		),
+	)
+	defer span.End()
+
+	names := make([]string, len(tables))
+	for i, t := range tables {
+		names[i] = t.DMapName
+	}
+	versions, err := p.dmaps.Versions(names)
+	if err != nil {
+		p.log.With(logging.F("dmap", table.DMapName)).V(3).Printf("[ERROR] Failed to get table versions: %v", err)
+		return nil, fmt.Errorf("%w: %v", ErrTableVersions, err)
+	}
+
 	dm, err := p.dmaps.GetOrCreateDMap(table.DMapName)
 	if err != nil {
-		p.log.V(3).Printf("[ERROR] Failed to get distributed map object: %v", err)
+		p.log.With(logging.F("dmap", table.DMapName)).V(3).Printf("[ERROR] Failed to get distributed map object: %v", err)
 		// Just log this
 		return nil, fmt.Errorf("%w: %v", ErrGetOrCreateDMap, err)
 	}
 
-	hquery := p.hashQuery(data.Payload)
-	value, err := dm.Get(strconv.FormatUint(hquery, 10))
+	hints := p.hints
+	if hints == nil {
+		hints = &matcher.Hints{}
+	}
+	_, statement := utils.LeadingComments(utils.TrimNULChar(data.Payload))
+	hquery := p.hashQuery(statement, names, versions)
+
+	var value interface{}
+	if hints.Refresh {
+		err = olric.ErrKeyNotFound
+	} else {
+		value, err = dm.Get(strconv.FormatUint(hquery, 10))
+	}
+	span.SetAttributes(
+		attribute.Bool("pgscale.cache.hit", err == nil),
+		attribute.Bool("pgscale.cache.refresh", hints.Refresh),
+	)
 	if errors.Is(err, olric.ErrKeyNotFound) {
 		p.kontext.Set("start", true)
 		p.kontext.Set("table", table)
 		p.kontext.Set("query", string(data.Payload))
 		p.kontext.Set("hquery", hquery)
+		p.kontext.Set("ttl", hints.TTL)
 		buf, ok := p.kontext.Get("cache").(*bytes.Buffer)
 		if ok {
 			buf.Reset()
@@ -206,64 +539,134 @@ func (p *Proxy) cacheDataPacket(data *protocol.DataPacket) {
 	p.kontext.Set("start", false)
 	hquery := p.kontext.Get("hquery").(uint64)
 	table := p.kontext.Get("table").(*config.Table)
+
+	_, span := p.tracing.Start(p.spanContext(), "pgscale.cache.store",
+		trace.WithAttributes(
+			attribute.String("pgscale.dmap", table.DMapName),
+			attribute.Int("pgscale.cache.bytes", cache.Len()),
+		),
+	)
+	defer span.End()
+
+	lg := p.log.With(logging.F("dmap", table.DMapName))
 	dm, err := p.dmaps.GetOrCreateDMap(table.DMapName)
 	if err != nil {
-		p.log.V(3).Printf("[ERROR] Failed to get distributed map object: %v", err)
+		lg.V(3).Printf("[ERROR] Failed to get distributed map object: %v", err)
 		return
 	}
 
-	err = dm.Put(strconv.FormatUint(hquery, 10), cache.Bytes())
+	key := strconv.FormatUint(hquery, 10)
+	if ttl, ok := p.kontext.Get("ttl").(time.Duration); ok && ttl > 0 {
+		err = dm.PutEx(key, cache.Bytes(), ttl)
+	} else {
+		err = dm.Put(key, cache.Bytes())
+	}
 	if err != nil {
-		p.log.V(3).Printf("[ERROR] Failed to cache query response: %v", err)
+		lg.V(3).Printf("[ERROR] Failed to cache query response: %v", err)
+	}
+}
+
+// isRollback returns true if a message of the backend means that the transaction is
+// rolled back. COMMIT of a failed transaction is reported as ROLLBACK.
+func isRollback(data *protocol.DataPacket) bool {
+	switch data.Identifier {
+	case ErrorResponseIdentifier:
+		return true
+	case CommandCompleteIdentifier:
+		return bytes.Equal(data.Payload, []byte("ROLLBACK\x00"))
 	}
+	return false
 }
 
-func (p *Proxy) streamServerResponse(conn net.Conn) error {
-	c, err := protocol.New(conn)
+// streamServerResponse relays the response of the backend to the client. It returns
+// true if a cancel request of the query limits may still reach the backend.
+func (p *Proxy) streamServerResponse(server *pgconn.PgConn) (canceled bool, err error) {
+	c, err := protocol.New(server.Conn())
 	if err != nil {
-		return err
+		return false, err
 	}
 
+	guard := newQueryGuard(p.queryLimits, server.CancelRequest, p.log)
+	defer func() {
+		canceled = guard.stop()
+	}()
+
 	buf := pool.Get()
 	defer pool.Put(buf)
 
+	// rolledBack is true if the transaction is rolled back, by an error or ROLLBACK.
+	var rolledBack bool
 	for {
 		buf.Reset()
 
 		data, err := c.Read()
 		if err != nil {
-			return err
+			return false, err
 		}
+		if isRollback(data) {
+			rolledBack = true
+		}
+
+		msg := guard.filter(data)
 
 		start, ok := p.kontext.Get("start").(bool)
 		if ok && start {
-			p.cacheDataPacket(data)
+			if guard.limited() {
+				// Don't cache a truncated or canceled result.
+				p.kontext.Set("start", false)
+				p.kontext.Get("cache").(*bytes.Buffer).Reset()
+			} else {
+				p.cacheDataPacket(data)
+			}
 		}
 
-		_, _ = buf.Write(data.Header)
-		_, _ = buf.Write(data.Payload)
+		if msg == nil {
+			// Discarded
+			continue
+		}
+		_, _ = buf.Write(msg)
 
 		_, err = io.Copy(p.client, buf)
 		if err != nil {
-			return err
+			return false, err
 		}
 
 		if data.Identifier == ReadyForQueryIdentifier {
+			if len(data.Payload) > 0 {
+				p.setTxStatus(data.Payload[0])
+				if data.Payload[0] == IdleTxStatus {
+					p.endTransaction(rolledBack)
+					p.invalidate()
+				}
+			}
 			break
 		}
 	}
 
-	return nil
+	return false, nil
 }
 
-func (p *Proxy) requestToServer(conn *pgxpool.Conn, buf io.Reader) error {
-	server := conn.Conn().PgConn().Conn()
-	_, err := io.Copy(server, buf)
+// requestToServer sends a request to the backend and relays its response. It returns
+// true if a cancel request of the query limits may still reach the backend.
+func (p *Proxy) requestToServer(conn *pgxpool.Conn, buf io.Reader) (bool, error) {
+	_, span := p.tracing.Start(p.spanContext(), "pgscale.backend",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.Int64("pgscale.backend.pid", int64(conn.Conn().PgConn().PID()))),
+	)
+	defer span.End()
+
+	server := conn.Conn().PgConn()
+	_, err := io.Copy(server.Conn(), buf)
 	if err != nil {
-		return err
+		recordSpanError(span, err)
+		return false, err
 	}
 
-	return p.streamServerResponse(server)
+	canceled, err := p.streamServerResponse(server)
+	if err != nil {
+		recordSpanError(span, err)
+	}
+	return canceled, err
 }
 
 func (p *Proxy) consumeUntilSyncMessage(r *protocol.Reader, buf io.Writer) error {
@@ -276,6 +679,10 @@ func (p *Proxy) consumeUntilSyncMessage(r *protocol.Reader, buf io.Writer) error
 		_, _ = buf.Write(item.Header)
 		_, _ = buf.Write(item.Payload)
 
+		p.auditExtended(item)
+		if err := p.trackStatement(item); err != nil {
+			return err
+		}
 		if item.Identifier == SyncIdentifier {
 			break
 		}
@@ -285,11 +692,35 @@ func (p *Proxy) consumeUntilSyncMessage(r *protocol.Reader, buf io.Writer) error
 }
 
 func (p *Proxy) readFromClient(r *protocol.Reader, buf io.Writer) (bool, error) {
+	if err := p.waitForRequest(); err != nil {
+		return false, err
+	}
+	timeout := p.timeouts.readTimeout(p.transactionStatus())
+	if timeout > 0 {
+		if err := p.client.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return false, err
+		}
+	}
 	data, err := r.Read()
+	p.setBusy()
+	if timeout > 0 && err == nil {
+		err = p.client.SetReadDeadline(time.Time{})
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return false, p.idleTimeout()
+	}
 	if err != nil {
 		return false, err
 	}
 
+	if p.transactionStatus() == IdleTxStatus {
+		p.txSearchPath = p.sessionSearchPath
+	}
+	if data.Identifier == QueryIdentifier || data.Identifier == ParseIdentifier {
+		p.beginStatement(data)
+	}
+
+	p.auditExtended(data)
 	switch {
 	case data.Identifier == ParseIdentifier:
 		servedFromCache, err := p.handleExtendedQuery(r, data)
@@ -299,6 +730,10 @@ func (p *Proxy) readFromClient(r *protocol.Reader, buf io.Writer) (bool, error)
 		if servedFromCache {
 			return true, nil
 		}
+	case data.Identifier == BindIdentifier || data.Identifier == CloseIdentifier:
+		if err := p.trackStatement(data); err != nil {
+			return false, err
+		}
 	case data.Identifier == QueryIdentifier:
 		servedFromCache, err := p.handleSimpleQuery(data)
 		if err != nil {
@@ -323,12 +758,50 @@ func (p *Proxy) readFromClient(r *protocol.Reader, buf io.Writer) (bool, error)
 	return false, nil
 }
 
+func (p *Proxy) acquire() (*pgxpool.Conn, error) {
+	_, span := p.tracing.Start(p.spanContext(), "pgscale.pool.acquire")
+	defer span.End()
+
+	server, err := p.dbconn.Acquire(p.ctx)
+	if err == nil {
+		return server, nil
+	}
+	recordSpanError(span, err)
+
+	if errors.Is(err, dbconn.ErrQueryWaitTimeout) || errors.Is(err, dbconn.ErrWaitQueueFull) {
+		code := TooManyConnections
+		if errors.Is(err, dbconn.ErrQueryWaitTimeout) {
+			// PgBouncer reports query_wait_timeout as protocol_violation.
+			code = "08P01"
+		}
+		if werr := fatalResponse(p.client, code, err.Error()); werr != nil {
+			p.log.V(3).Printf("[ERROR] Failed to send error response: %v", werr)
+		}
+	}
+	return nil, err
+}
+
+// releaseServer returns the server connection of a session to the pool. A transaction
+// that's left open by the client, such as after an idle transaction timeout, is rolled
+// back first.
+func (p *Proxy) releaseServer(server *pgxpool.Conn) {
+	if p.transactionStatus() != IdleTxStatus {
+		ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+		defer cancel()
+		if _, err := server.Exec(ctx, "ROLLBACK"); err != nil {
+			p.log.V(3).Printf("[ERROR] Failed to roll back the transaction of the client: %v", err)
+			_ = server.Conn().Close(ctx)
+		}
+	}
+	p.dbconn.Release(server)
+}
+
 func (p *Proxy) sessionPooling(r *protocol.Reader) error {
-	server, err := p.dbconn.Pool.Acquire(p.ctx)
+	server, err := p.acquire()
 	if err != nil {
 		return err
 	}
-	defer server.Release()
+	defer p.releaseServer(server)
 
 	buf := pool.Get()
 	defer pool.Put(buf)
@@ -342,13 +815,23 @@ func (p *Proxy) sessionPooling(r *protocol.Reader) error {
 		}
 
 		if done {
+			p.endStatement(true, 0)
 			continue
 		}
 
-		err = p.requestToServer(server, buf)
+		canceled, err := p.requestToServer(server, buf)
 		if err != nil {
 			return err
 		}
+		p.endStatement(false, server.Conn().PgConn().PID())
+		if canceled {
+			if err := p.confirmCancel(server.Conn().PgConn()); err != nil {
+				// The state of the server connection is unknown, it's closed instead
+				// of returning it to the pool.
+				_ = server.Conn().Close(p.ctx)
+				return err
+			}
+		}
 	}
 }
 
@@ -365,19 +848,30 @@ func (p *Proxy) statementPooling(r *protocol.Reader) error {
 		}
 
 		if done {
+			p.endStatement(true, 0)
 			continue
 		}
 
-		server, err := p.dbconn.Pool.Acquire(p.ctx)
+		server, err := p.acquire()
 		if err != nil {
 			return err
 		}
-		err = p.requestToServer(server, buf)
+		canceled, err := p.requestToServer(server, buf)
 		if err != nil {
+			// The state of the server connection is unknown, close it instead of
+			// returning it to the pool.
+			_ = server.Conn().Close(p.ctx)
+			p.dbconn.Release(server)
 			return err
 		}
+		p.endStatement(false, server.Conn().PgConn().PID())
+		if canceled {
+			// The backend may handle the cancel request after the query has
+			// finished, don't let it cancel a statement of another client.
+			_ = server.Conn().Close(p.ctx)
+		}
 
-		server.Release()
+		p.dbconn.Release(server)
 	}
 }
 
@@ -387,18 +881,105 @@ func (p *Proxy) clientLoop() error {
 		return err
 	}
 
-	switch p.dbconn.Database.ConnectionPool.Policy {
+	switch p.policy {
 	case config.SessionConnectionPoolPolicy:
 		err = p.sessionPooling(r)
 	case config.StatementConnectionPoolPolicy:
 		err = p.statementPooling(r)
 	default:
-		return fmt.Errorf("unknown connection pool policy: %s", p.dbconn.Database.ConnectionPool.Policy)
+		return fmt.Errorf("unknown connection pool policy: %s", p.policy)
 	}
 
+	if err != nil {
+		// The statement in progress, if any, is abandoned.
+		p.abortStatement(err)
+	}
 	return err
 }
 
+func (p *Proxy) setTxStatus(status byte) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.txStatus = status
+}
+
+func (p *Proxy) transactionStatus() byte {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.txStatus
+}
+
+// idleTimeout terminates the connection of a client that has been idle for longer than
+// client_idle_timeout or idle_transaction_timeout.
+func (p *Proxy) idleTimeout() error {
+	code, timeoutErr := "57P05", ErrIdleSessionTimeout
+	if p.transactionStatus() != IdleTxStatus {
+		code, timeoutErr = "25P03", ErrIdleTransactionTimeout
+	}
+	if err := timeoutResponse(p.client, code, timeoutErr); err != nil {
+		p.log.V(3).Printf("[ERROR] Failed to send timeout error: %v", err)
+	}
+	return timeoutErr
+}
+
+func (p *Proxy) isDraining() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	return p.draining
+}
+
+func (p *Proxy) setBusy() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.idle = false
+}
+
+// waitForRequest marks the proxy as idle before reading the next request of the client.
+// If the proxy is draining and the client is not in a transaction, it terminates the
+// connection instead.
+func (p *Proxy) waitForRequest() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.draining && p.txStatus == IdleTxStatus {
+		return p.terminate()
+	}
+	p.idle = true
+	return nil
+}
+
+// terminate sends an admin_shutdown error to the client. The caller must hold mtx. The
+// client may not read, writing the error has a deadline not to block the shutdown.
+func (p *Proxy) terminate() error {
+	err := p.client.SetWriteDeadline(time.Now().Add(errorWriteTimeout))
+	if err == nil {
+		err = fatalResponse(p.client, "57P01", ErrAdminShutdown.Error())
+	}
+	if err != nil {
+		p.log.V(3).Printf("[ERROR] Failed to send shutdown error: %v", err)
+	}
+	return ErrAdminShutdown
+}
+
+// Drain terminates the connection if the client is idle, otherwise the connection is
+// terminated after the running request or transaction has been completed.
+func (p *Proxy) Drain() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.draining = true
+	if !p.idle || p.txStatus != IdleTxStatus {
+		return
+	}
+
+	_ = p.terminate()
+	_ = p.Close()
+}
+
 func (p *Proxy) Close() error {
 	select {
 	case <-p.ctx.Done():
@@ -0,0 +1,739 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgresql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/buraksezer/olric"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/pgscale/pgscale/audit"
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/dmaps"
+	"github.com/pgscale/pgscale/kontext"
+	"github.com/pgscale/pgscale/postgresql/auth"
+	"github.com/pgscale/pgscale/postgresql/dbconn"
+	"github.com/pgscale/pgscale/postgresql/matcher"
+	"github.com/pgscale/pgscale/postgresql/protocol"
+	"github.com/pgscale/pgscale/testutils"
+	"github.com/pgscale/pgscale/tracing"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestProxy(t *testing.T) (*Proxy, *pgproto3.Frontend) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Proxy{
+		client:   server,
+		log:      testutils.NewLogger(),
+		ctx:      ctx,
+		cancel:   cancel,
+		txStatus: IdleTxStatus,
+	}
+	return p, pgproto3.NewFrontend(pgproto3.NewChunkReader(client), client)
+}
+
+// newTestBackend returns a connection to a fake PostgreSQL server. The server side
+// completes the startup, the test sends the responses.
+func newTestBackend(t *testing.T) (*pgconn.PgConn, *pgproto3.Backend) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	backend := pgproto3.NewBackend(pgproto3.NewChunkReader(server), server)
+	go func() {
+		if _, err := backend.ReceiveStartupMessage(); err != nil {
+			return
+		}
+		_ = backend.Send(&pgproto3.AuthenticationOk{})
+		_ = backend.Send(&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 1})
+		_ = backend.Send(&pgproto3.ReadyForQuery{TxStatus: IdleTxStatus})
+	}()
+
+	cfg, err := pgconn.ParseConfig("postgres://postgres@127.0.0.1/postgres?sslmode=disable")
+	require.NoError(t, err)
+	cfg.DialFunc = func(context.Context, string, string) (net.Conn, error) {
+		return client, nil
+	}
+	conn, err := pgconn.ConnectConfig(context.Background(), cfg)
+	require.NoError(t, err)
+	return conn, backend
+}
+
+func receiveFatal(t *testing.T, frontend *pgproto3.Frontend, code string) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		msg, err := frontend.Receive()
+		require.NoError(t, err)
+		e, ok := msg.(*pgproto3.ErrorResponse)
+		require.True(t, ok)
+		require.Equal(t, "FATAL", e.Severity)
+		require.Equal(t, code, e.Code)
+	}()
+	return done
+}
+
+func receiveAdminShutdown(t *testing.T, frontend *pgproto3.Frontend) <-chan struct{} {
+	return receiveFatal(t, frontend, "57P01")
+}
+
+func TestProxy_Drain_Idle(t *testing.T) {
+	p, frontend := newTestProxy(t)
+	require.NoError(t, p.waitForRequest())
+
+	done := receiveAdminShutdown(t, frontend)
+	p.Drain()
+	<-done
+
+	select {
+	case <-p.ctx.Done():
+	default:
+		require.Fail(t, "proxy has not been closed")
+	}
+}
+
+func TestProxy_Drain_ClientNotReading(t *testing.T) {
+	p, _ := newTestProxy(t)
+	require.NoError(t, p.waitForRequest())
+
+	// The client never reads the error, the write times out.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Drain()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * errorWriteTimeout):
+		require.Fail(t, "Drain is blocked by the client")
+	}
+	require.Error(t, p.ctx.Err())
+}
+
+func TestProxy_Drain_InTransaction(t *testing.T) {
+	p, frontend := newTestProxy(t)
+	p.setTxStatus(InTransactionTxStatus)
+	require.NoError(t, p.waitForRequest())
+
+	// The client is in a transaction, let it finish.
+	p.Drain()
+	require.True(t, p.isDraining())
+	require.NoError(t, p.ctx.Err())
+
+	// A request has been processed and the transaction has been committed.
+	p.setBusy()
+	p.setTxStatus(IdleTxStatus)
+
+	done := receiveAdminShutdown(t, frontend)
+	require.ErrorIs(t, p.waitForRequest(), ErrAdminShutdown)
+	<-done
+}
+
+func TestProxy_ClientIdleTimeout(t *testing.T) {
+	p, frontend := newTestProxy(t)
+	p.timeouts.idle = 10 * time.Millisecond
+	r, err := protocol.New(p.client)
+	require.NoError(t, err)
+
+	done := receiveFatal(t, frontend, "57P05")
+	_, err = p.readFromClient(r, &bytes.Buffer{})
+	require.ErrorIs(t, err, ErrIdleSessionTimeout)
+	<-done
+}
+
+func TestProxy_IdleTransactionTimeout(t *testing.T) {
+	p, frontend := newTestProxy(t)
+	// client_idle_timeout doesn't apply to the clients in a transaction.
+	p.timeouts.idle = time.Hour
+	p.timeouts.idleTransaction = 10 * time.Millisecond
+	p.setTxStatus(InTransactionTxStatus)
+	r, err := protocol.New(p.client)
+	require.NoError(t, err)
+
+	done := receiveFatal(t, frontend, "25P03")
+	_, err = p.readFromClient(r, &bytes.Buffer{})
+	require.ErrorIs(t, err, ErrIdleTransactionTimeout)
+	<-done
+}
+
+func TestProxy_Invalidate(t *testing.T) {
+	p, _ := newTestProxy(t)
+	p.dmaps = dmaps.New(testutils.NewOlricInstance(t))
+	p.dbconn = &dbconn.Conn{Catalog: &matcher.Catalog{}, Database: &config.Database{
+		Caches: []*config.Cache{{
+			Schema: "public",
+			Tables: []*config.Table{
+				{Name: "users", DMapName: "postgres.public.users"},
+				{Name: "profile", DMapName: "postgres.public.profile"},
+			},
+		}},
+	}}
+	p.session = &auth.Session{User: "alice", Database: "postgres"}
+	p.modified = make(map[string]struct{})
+
+	names := []string{"postgres.public.users", "postgres.public.profile"}
+	versions, err := p.dmaps.Versions(names)
+	require.NoError(t, err)
+	query := []byte("SELECT * FROM users JOIN profile ON users.id = profile.user_id")
+	key := p.hashQuery(query, names, versions)
+
+	_, ok, err := p.parseQuery(query)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// The client bypasses the cache after its write until the transaction ends.
+	_, ok, err = p.parseQuery([]byte("UPDATE profile SET bio = ''"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, ok, err = p.parseQuery(query)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	p.invalidate()
+	require.Empty(t, p.modified)
+	_, ok, err = p.parseQuery(query)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	versions, err = p.dmaps.Versions(names)
+	require.NoError(t, err)
+	require.Equal(t, []int{0, 1}, versions)
+	require.NotEqual(t, key, p.hashQuery(query, names, versions))
+}
+
+func TestProxy_SearchPath(t *testing.T) {
+	p, _ := newTestProxy(t)
+	catalog := &matcher.Catalog{SearchPath: []string{"app"}}
+	catalog.AddRelation("app", "users")
+	catalog.AddRelation("public", "users")
+	p.dbconn = &dbconn.Conn{Catalog: catalog, Database: &config.Database{
+		Caches: []*config.Cache{{
+			Schema: "public",
+			Tables: []*config.Table{{Name: "users", DMapName: "postgres.public.users"}},
+		}},
+	}}
+	p.session = &auth.Session{User: "alice", Database: "postgres"}
+	p.modified = make(map[string]struct{})
+
+	cacheable := func(query string) bool {
+		q, ok, err := p.parseQuery([]byte(query))
+		require.NoError(t, err)
+		if !ok {
+			return false
+		}
+		matched, err := q.Match(p.dbconn.Database.Caches, func([]*config.Table) (bool, error) {
+			return true, nil
+		})
+		require.NoError(t, err)
+		return matched
+	}
+
+	// app.users is not a cache table.
+	require.False(t, cacheable("SELECT * FROM users"))
+	require.True(t, cacheable("SELECT * FROM public.users"))
+
+	_, _, err := p.parseQuery([]byte("SET search_path TO public"))
+	require.NoError(t, err)
+	require.True(t, cacheable("SELECT * FROM users"))
+
+	// SET LOCAL is reverted at the end of the transaction.
+	_, _, err = p.parseQuery([]byte("SET LOCAL search_path TO app, public"))
+	require.NoError(t, err)
+	require.False(t, cacheable("SELECT * FROM users"))
+	p.endTransaction(false)
+	require.True(t, cacheable("SELECT * FROM users"))
+
+	_, _, err = p.parseQuery([]byte("RESET search_path"))
+	require.NoError(t, err)
+	require.False(t, cacheable("SELECT * FROM users"))
+}
+
+func TestProxy_CacheKey_SearchPath(t *testing.T) {
+	p, _ := newTestProxy(t)
+	p.dmaps = dmaps.New(testutils.NewOlricInstance(t))
+	p.kontext = kontext.New()
+	p.traceCtx = context.Background()
+	tr, err := tracing.New(nil)
+	require.NoError(t, err)
+	p.tracing = tr
+	catalog := &matcher.Catalog{}
+	catalog.AddRelation("public", "orders")
+	catalog.AddRelation("tenant_a", "users")
+	catalog.AddRelation("tenant_b", "users")
+	p.dbconn = &dbconn.Conn{Catalog: catalog, Database: &config.Database{
+		Caches: []*config.Cache{
+			{
+				Schema: "public",
+				Tables: []*config.Table{{Name: "orders", DMapName: "postgres.public.orders"}},
+			},
+			{
+				Schema: "tenant_a",
+				Tables: []*config.Table{{Name: "users", DMapName: "postgres.tenant_a.users"}},
+			},
+			{
+				Schema: "tenant_b",
+				Tables: []*config.Table{{Name: "users", DMapName: "postgres.tenant_b.users"}},
+			},
+		},
+	}}
+	p.session = &auth.Session{User: "alice", Database: "postgres"}
+	p.modified = make(map[string]struct{})
+
+	query := "SELECT * FROM orders JOIN users ON users.id = orders.user_id"
+	lookup := func() error {
+		q, ok, err := p.parseQuery([]byte(query))
+		require.NoError(t, err)
+		require.True(t, ok)
+		var lookupErr error
+		matched, err := q.Match(p.dbconn.Database.Caches, func(tables []*config.Table) (bool, error) {
+			_, lookupErr = p.loadFromCache(tables, &protocol.DataPacket{Identifier: QueryIdentifier, Payload: []byte(query)})
+			return true, nil
+		})
+		require.NoError(t, err)
+		require.True(t, matched)
+		return lookupErr
+	}
+
+	_, _, err = p.parseQuery([]byte("SET search_path TO public, tenant_a"))
+	require.NoError(t, err)
+	require.ErrorIs(t, lookup(), olric.ErrKeyNotFound)
+	p.cacheDataPacket(&protocol.DataPacket{Identifier: ReadyForQueryIdentifier, Payload: []byte{IdleTxStatus}})
+	require.NoError(t, lookup())
+
+	// The same query reads tenant_b.users, it must not be served the rows of tenant_a.
+	_, _, err = p.parseQuery([]byte("SET search_path TO public, tenant_b"))
+	require.NoError(t, err)
+	require.ErrorIs(t, lookup(), olric.ErrKeyNotFound)
+}
+
+func TestProxy_CacheKey_PassthroughUsers(t *testing.T) {
+	dms := dmaps.New(testutils.NewOlricInstance(t))
+	tr, err := tracing.New(nil)
+	require.NoError(t, err)
+	passthrough := true
+	database := &config.Database{
+		PassthroughAuth: &passthrough,
+		Caches: []*config.Cache{{
+			Schema: "public",
+			Tables: []*config.Table{{Name: "salaries", DMapName: "postgres.public.salaries"}},
+		}},
+	}
+
+	// newProxy returns the proxy of a client that runs its queries as user.
+	newProxy := func(user string) *Proxy {
+		p, _ := newTestProxy(t)
+		p.dmaps = dms
+		p.kontext = kontext.New()
+		p.traceCtx = context.Background()
+		p.tracing = tr
+		cfg, err := pgxpool.ParseConfig("postgres://" + user + "@127.0.0.1/postgres")
+		require.NoError(t, err)
+		p.dbconn = &dbconn.Conn{Catalog: &matcher.Catalog{}, Database: database, Config: cfg}
+		p.hashPrefix = cacheKeyPrefix(p.dbconn)
+		p.session = &auth.Session{User: user, Database: "postgres"}
+		p.modified = make(map[string]struct{})
+		return p
+	}
+	query := "SELECT * FROM salaries"
+	lookup := func(p *Proxy) error {
+		_, ok, err := p.parseQuery([]byte(query))
+		require.NoError(t, err)
+		require.True(t, ok)
+		tables := database.Caches[0].Tables
+		_, err = p.loadFromCache(tables, &protocol.DataPacket{Identifier: QueryIdentifier, Payload: []byte(query)})
+		return err
+	}
+
+	// Only alice has SELECT on salaries.
+	alice := newProxy("alice")
+	require.ErrorIs(t, lookup(alice), olric.ErrKeyNotFound)
+	alice.cacheDataPacket(&protocol.DataPacket{Identifier: ReadyForQueryIdentifier, Payload: []byte{IdleTxStatus}})
+	require.NoError(t, lookup(alice))
+
+	// bob is not served the rows of alice, his query runs on the backend.
+	bob := newProxy("bob")
+	require.ErrorIs(t, lookup(bob), olric.ErrKeyNotFound)
+}
+
+func TestProxy_Hints(t *testing.T) {
+	p, _ := newTestProxy(t)
+	p.dmaps = dmaps.New(testutils.NewOlricInstance(t))
+	p.kontext = kontext.New()
+	p.traceCtx = context.Background()
+	tr, err := tracing.New(nil)
+	require.NoError(t, err)
+	p.tracing = tr
+	p.dbconn = &dbconn.Conn{Catalog: &matcher.Catalog{}, Database: &config.Database{
+		Caches: []*config.Cache{{
+			Schema: "public",
+			Tables: []*config.Table{{Name: "users", DMapName: "postgres.public.users"}},
+		}},
+	}}
+	p.session = &auth.Session{User: "alice", Database: "postgres"}
+	p.modified = make(map[string]struct{})
+	tables := p.dbconn.Database.Caches[0].Tables
+
+	lookup := func(query string) error {
+		_, ok, err := p.parseQuery([]byte(query))
+		require.NoError(t, err)
+		require.True(t, ok)
+		_, err = p.loadFromCache(tables, &protocol.DataPacket{Identifier: QueryIdentifier, Payload: []byte(query)})
+		return err
+	}
+	store := func() {
+		p.cacheDataPacket(&protocol.DataPacket{Identifier: ReadyForQueryIdentifier, Payload: []byte{IdleTxStatus}})
+	}
+
+	_, ok, err := p.parseQuery([]byte("/* pgscale:nocache */ SELECT * FROM users"))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.ErrorIs(t, lookup("/* pgscale:cache ttl=1h */ SELECT * FROM users"), olric.ErrKeyNotFound)
+	store()
+	dm, err := p.dmaps.GetOrCreateDMap("postgres.public.users")
+	require.NoError(t, err)
+	entry, err := dm.GetEntry(strconv.FormatUint(p.kontext.Get("hquery").(uint64), 10))
+	require.NoError(t, err)
+	require.NotZero(t, entry.TTL)
+
+	// The hints are not a part of the key.
+	require.NoError(t, lookup("SELECT * FROM users"))
+	require.ErrorIs(t, lookup("-- pgscale:refresh\nSELECT * FROM users"), olric.ErrKeyNotFound)
+	store()
+	entry, err = dm.GetEntry(strconv.FormatUint(p.kontext.Get("hquery").(uint64), 10))
+	require.NoError(t, err)
+	require.Zero(t, entry.TTL)
+}
+
+func TestProxy_PreparedStatements(t *testing.T) {
+	p, frontend := newTestProxy(t)
+	tr, err := tracing.New(nil)
+	require.NoError(t, err)
+	p.tracing = tr
+	p.traceCtx = context.Background()
+	p.auditor, err = audit.New(nil)
+	require.NoError(t, err)
+	p.dbconn = &dbconn.Conn{Catalog: &matcher.Catalog{}, Database: &config.Database{
+		Caches: []*config.Cache{{
+			Schema: "public",
+			Tables: []*config.Table{
+				{Name: "users", DMapName: "postgres.public.users"},
+				{Name: "profile", DMapName: "postgres.public.profile"},
+			},
+		}},
+	}}
+	p.session = &auth.Session{User: "alice", Database: "postgres"}
+	p.modified = make(map[string]struct{})
+	r, err := protocol.New(p.client)
+	require.NoError(t, err)
+
+	send := func(msgs ...pgproto3.FrontendMessage) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for _, msg := range msgs {
+				require.NoError(t, frontend.Send(msg))
+			}
+		}()
+		servedFromCache, err := p.readFromClient(r, &bytes.Buffer{})
+		require.NoError(t, err)
+		require.False(t, servedFromCache)
+		<-done
+	}
+	modified := func() []string {
+		var names []string
+		for name := range p.modified {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		p.modified = make(map[string]struct{})
+		return names
+	}
+
+	// The statement cache of a driver prepares a named statement.
+	send(
+		&pgproto3.Parse{Name: "stmt_1", Query: "UPDATE profile SET bio = $1 WHERE id = $2"},
+		&pgproto3.Describe{ObjectType: 'S', Name: "stmt_1"},
+		&pgproto3.Sync{},
+	)
+	require.Equal(t, []string{"postgres.public.profile"}, modified())
+
+	// And executes it again without a Parse.
+	send(
+		&pgproto3.Bind{PreparedStatement: "stmt_1", Parameters: [][]byte{[]byte("bio"), []byte("1")}},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	require.Equal(t, []string{"postgres.public.profile"}, modified())
+
+	// The statements in the middle of a batch are tracked too.
+	send(
+		&pgproto3.Parse{Name: "stmt_2", Query: "SELECT * FROM users"},
+		&pgproto3.Parse{Name: "stmt_3", Query: "DELETE FROM users WHERE id = $1"},
+		&pgproto3.Bind{PreparedStatement: "stmt_2"},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	require.Equal(t, []string{"postgres.public.users"}, modified())
+	send(
+		&pgproto3.Bind{PreparedStatement: "stmt_2"},
+		&pgproto3.Execute{},
+		&pgproto3.Bind{PreparedStatement: "stmt_3", Parameters: [][]byte{[]byte("1")}},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	require.Equal(t, []string{"postgres.public.users"}, modified())
+
+	// A Close is relayed on its own, like a Sync.
+	send(&pgproto3.Close{ObjectType: 'S', Name: "stmt_1"})
+	require.NotContains(t, p.prepared, "stmt_1")
+	require.Contains(t, p.prepared, "stmt_3")
+}
+
+func TestProxy_AbortStatement(t *testing.T) {
+	p, _ := newTestProxy(t)
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	p.statement = "SELECT 1"
+	p.statementCtx, p.statementSpan = provider.Tracer("test").Start(context.Background(), "pgscale.query")
+
+	p.abortStatement(ErrClientIsGone)
+	require.Nil(t, p.statementSpan)
+	require.Nil(t, p.statementCtx)
+	require.Empty(t, p.statement)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	require.Equal(t, codes.Error, spans[0].Status().Code)
+	require.Equal(t, ErrClientIsGone.Error(), spans[0].Status().Description)
+
+	// No statement is in progress.
+	p.abortStatement(ErrClientIsGone)
+	require.Len(t, recorder.Ended(), 1)
+}
+
+func TestProxy_SearchPath_Transaction(t *testing.T) {
+	p, frontend := newTestProxy(t)
+	tr, err := tracing.New(nil)
+	require.NoError(t, err)
+	p.tracing = tr
+	p.traceCtx = context.Background()
+	p.auditor, err = audit.New(nil)
+	require.NoError(t, err)
+	p.kontext = kontext.New()
+	catalog := &matcher.Catalog{SearchPath: []string{"app"}}
+	catalog.AddRelation("app", "users")
+	catalog.AddRelation("public", "users")
+	p.dbconn = &dbconn.Conn{Catalog: catalog, Database: &config.Database{
+		Caches: []*config.Cache{{
+			Schema: "public",
+			Tables: []*config.Table{{Name: "users", DMapName: "postgres.public.users"}},
+		}},
+	}}
+	p.session = &auth.Session{User: "alice", Database: "postgres"}
+	p.modified = make(map[string]struct{})
+	r, err := protocol.New(p.client)
+	require.NoError(t, err)
+	server, backend := newTestBackend(t)
+
+	// query sends a query through the proxy, the backend responds with msgs.
+	query := func(sql string, msgs ...pgproto3.BackendMessage) {
+		go func() {
+			require.NoError(t, frontend.Send(&pgproto3.Query{String: sql}))
+		}()
+		servedFromCache, err := p.readFromClient(r, &bytes.Buffer{})
+		require.NoError(t, err)
+		require.False(t, servedFromCache)
+
+		go func() {
+			for _, msg := range msgs {
+				require.NoError(t, backend.Send(msg))
+			}
+		}()
+		received := make(chan struct{})
+		go func() {
+			defer close(received)
+			for {
+				msg, err := frontend.Receive()
+				require.NoError(t, err)
+				if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+					return
+				}
+			}
+		}()
+		_, err = p.streamServerResponse(server)
+		require.NoError(t, err)
+		<-received
+	}
+	complete := func(tag string, txStatus byte) []pgproto3.BackendMessage {
+		return []pgproto3.BackendMessage{
+			&pgproto3.CommandComplete{CommandTag: []byte(tag)},
+			&pgproto3.ReadyForQuery{TxStatus: txStatus},
+		}
+	}
+	cacheable := func() bool {
+		_, ok, err := p.parseQuery([]byte("SELECT * FROM users"))
+		require.NoError(t, err)
+		return ok && p.searchPath(catalog).Schemas[0] == "public"
+	}
+
+	query("SET search_path TO public", complete("SET", IdleTxStatus)...)
+	require.True(t, cacheable())
+
+	// SET LOCAL is reverted by COMMIT.
+	query("BEGIN", complete("BEGIN", InTransactionTxStatus)...)
+	query("SET LOCAL search_path TO app", complete("SET", InTransactionTxStatus)...)
+	require.False(t, cacheable())
+	query("COMMIT", complete("COMMIT", IdleTxStatus)...)
+	require.True(t, cacheable())
+
+	// SET is reverted by ROLLBACK.
+	query("BEGIN", complete("BEGIN", InTransactionTxStatus)...)
+	query("SET search_path TO app", complete("SET", InTransactionTxStatus)...)
+	require.False(t, cacheable())
+	query("ROLLBACK", complete("ROLLBACK", IdleTxStatus)...)
+	require.True(t, cacheable())
+
+	// And by an error in the implicit transaction of the query.
+	query("SET search_path TO app; SELECT 1/0",
+		&pgproto3.CommandComplete{CommandTag: []byte("SET")},
+		&pgproto3.ErrorResponse{Severity: "ERROR", Code: "22012", Message: "division by zero"},
+		&pgproto3.ReadyForQuery{TxStatus: IdleTxStatus},
+	)
+	require.True(t, cacheable())
+
+	// A committed SET is kept.
+	query("BEGIN", complete("BEGIN", InTransactionTxStatus)...)
+	query("SET search_path TO app", complete("SET", InTransactionTxStatus)...)
+	query("COMMIT", complete("COMMIT", IdleTxStatus)...)
+	require.False(t, cacheable())
+}
+
+func TestProxy_TempRelations(t *testing.T) {
+	p, _ := newTestProxy(t)
+	p.dbconn = &dbconn.Conn{Catalog: &matcher.Catalog{}, Database: &config.Database{
+		Caches: []*config.Cache{{
+			Schema: "public",
+			Tables: []*config.Table{{Name: "users", DMapName: "postgres.public.users"}},
+		}},
+	}}
+	p.session = &auth.Session{User: "alice", Database: "postgres"}
+	p.modified = make(map[string]struct{})
+
+	_, ok, err := p.parseQuery([]byte("SELECT * FROM users"))
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// The temporary table shadows public.users.
+	_, _, err = p.parseQuery([]byte("CREATE TEMP TABLE users (id int)"))
+	require.NoError(t, err)
+	_, ok, err = p.parseQuery([]byte("SELECT * FROM users"))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestProxy_AuditPreparedStatements(t *testing.T) {
+	p, frontend := newTestProxy(t)
+	tr, err := tracing.New(nil)
+	require.NoError(t, err)
+	p.tracing = tr
+	p.traceCtx = context.Background()
+	output := filepath.Join(t.TempDir(), "audit.log")
+	p.auditor, err = audit.New(&config.Audit{Output: &output})
+	require.NoError(t, err)
+	defer p.auditor.Close()
+	p.dbconn = &dbconn.Conn{Catalog: &matcher.Catalog{}, Database: &config.Database{}}
+	p.session = &auth.Session{User: "alice", Database: "postgres"}
+	p.modified = make(map[string]struct{})
+	r, err := protocol.New(p.client)
+	require.NoError(t, err)
+
+	send := func(msgs ...pgproto3.FrontendMessage) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for _, msg := range msgs {
+				require.NoError(t, frontend.Send(msg))
+			}
+		}()
+		_, err := p.readFromClient(r, &bytes.Buffer{})
+		require.NoError(t, err)
+		<-done
+	}
+	statements := func() []string {
+		data, err := os.ReadFile(output)
+		require.NoError(t, err)
+		var result []string
+		for _, line := range bytes.Split(bytes.TrimSpace(data), []byte{'\n'}) {
+			if len(line) == 0 {
+				continue
+			}
+			var e audit.Event
+			require.NoError(t, json.Unmarshal(line, &e))
+			result = append(result, e.Statement)
+		}
+		return result
+	}
+	update := "UPDATE profile SET bio = $1 WHERE id = $2"
+	bind := &pgproto3.Bind{PreparedStatement: "stmt_1", Parameters: [][]byte{[]byte("bio"), []byte("1")}}
+
+	// The statement is recorded when it's executed.
+	send(
+		&pgproto3.Parse{Name: "stmt_1", Query: update},
+		&pgproto3.Describe{ObjectType: 'S', Name: "stmt_1"},
+		&pgproto3.Sync{},
+	)
+	require.Empty(t, statements())
+
+	send(bind, &pgproto3.Execute{}, &pgproto3.Sync{})
+	send(bind, &pgproto3.Execute{}, &pgproto3.Sync{})
+	require.Equal(t, []string{update, update}, statements())
+
+	// The unnamed statement of a single execution.
+	send(
+		&pgproto3.Parse{Query: "DELETE FROM profile"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	require.Equal(t, []string{update, update, "DELETE FROM profile"}, statements())
+
+	send(&pgproto3.Close{ObjectType: 'S', Name: "stmt_1"})
+	send(bind, &pgproto3.Execute{}, &pgproto3.Sync{})
+	require.Len(t, statements(), 3)
+}
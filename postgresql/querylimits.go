@@ -0,0 +1,223 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgresql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/logging"
+	"github.com/pgscale/pgscale/postgresql/protocol"
+)
+
+const (
+	// QueryCanceled is the SQLSTATE of query_canceled.
+	QueryCanceled = "57014"
+
+	// ProgramLimitExceeded is the SQLSTATE of program_limit_exceeded.
+	ProgramLimitExceeded = "54000"
+)
+
+var (
+	ErrQueryTimeout       = errors.New("canceling statement due to statement timeout")
+	ErrResultSizeTooLarge = errors.New("result exceeds max_result_bytes")
+)
+
+// cancelTimeout bounds sending a cancel request to the backend.
+const cancelTimeout = 5 * time.Second
+
+// queryLimits are the query_timeout and max_result_bytes of a session. Zero means no
+// limit.
+type queryLimits struct {
+	timeout        time.Duration
+	maxResultBytes int
+}
+
+// parseQueryLimits returns the limits of a database, the settings of the user override
+// them.
+func parseQueryLimits(db *config.Database, credentials map[string]string) (queryLimits, error) {
+	var l queryLimits
+	var err error
+	if value, ok := credentials[config.QueryTimeoutUserKey]; ok {
+		l.timeout, err = time.ParseDuration(value)
+	} else if db.QueryTimeout != nil {
+		l.timeout, err = time.ParseDuration(*db.QueryTimeout)
+	}
+	if err != nil {
+		return l, fmt.Errorf("invalid query_timeout: %w", err)
+	}
+
+	if value, ok := credentials[config.MaxResultBytesUserKey]; ok {
+		l.maxResultBytes, err = strconv.Atoi(value)
+		if err != nil {
+			return l, fmt.Errorf("invalid max_result_bytes: %w", err)
+		}
+	} else {
+		l.maxResultBytes = config.Limit(db.MaxResultBytes)
+	}
+	return l, nil
+}
+
+// queryGuard enforces the limits of a request that's sent to the backend. If the
+// query_timeout is exceeded, the backend is asked to cancel the query and its error is
+// reported as a statement timeout. If the result exceeds max_result_bytes, the query is
+// canceled and the rest of the result is discarded.
+type queryGuard struct {
+	limits        queryLimits
+	cancelRequest func(ctx context.Context) error
+	log           *logging.Logger
+	timer         *time.Timer
+	fired         chan struct{}
+	inflight      sync.WaitGroup
+	timedOut      int32
+	canceled      int32
+	size          int
+	exceeded      bool
+
+	// confirmed is true if the backend has reported the query as canceled.
+	confirmed bool
+}
+
+// newQueryGuard starts the query_timeout of a request. cancelRequest is called to cancel
+// the query on the backend.
+func newQueryGuard(limits queryLimits, cancelRequest func(ctx context.Context) error, lg *logging.Logger) *queryGuard {
+	g := &queryGuard{
+		limits:        limits,
+		cancelRequest: cancelRequest,
+		log:           lg,
+	}
+	if limits.timeout > 0 {
+		g.fired = make(chan struct{})
+		g.timer = time.AfterFunc(limits.timeout, func() {
+			defer close(g.fired)
+			atomic.StoreInt32(&g.timedOut, 1)
+			g.cancel()
+		})
+	}
+	return g
+}
+
+// cancel asks the backend to cancel the running query, once.
+func (g *queryGuard) cancel() {
+	if !atomic.CompareAndSwapInt32(&g.canceled, 0, 1) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+	if err := g.cancelRequest(ctx); err != nil {
+		g.log.V(3).Printf("[ERROR] Failed to send cancel request to the backend: %v", err)
+	}
+}
+
+// stop stops the query_timeout and waits for a cancel request that's in flight. It
+// returns true if a cancel request has been sent to the backend but the query has not
+// been reported as canceled. The backend may handle it after the query has finished,
+// it must not cancel the next statement on the server connection.
+func (g *queryGuard) stop() bool {
+	if g.timer != nil && !g.timer.Stop() {
+		<-g.fired
+	}
+	g.inflight.Wait()
+	return atomic.LoadInt32(&g.canceled) == 1 && !g.confirmed
+}
+
+// filter returns the message that's sent to the client in place of data, or nil if
+// data is discarded.
+func (g *queryGuard) filter(data *protocol.DataPacket) []byte {
+	if data.Identifier == ErrorResponseIdentifier && atomic.LoadInt32(&g.canceled) == 1 {
+		var backendErr pgproto3.ErrorResponse
+		if err := backendErr.Decode(data.Payload); err == nil && backendErr.Code == QueryCanceled {
+			g.confirmed = true
+		}
+	}
+
+	if !g.exceeded && g.limits.maxResultBytes > 0 {
+		g.size += len(data.Header) + len(data.Payload)
+		if g.size > g.limits.maxResultBytes && data.Identifier != ReadyForQueryIdentifier {
+			g.exceeded = true
+			g.inflight.Add(1)
+			go func() {
+				defer g.inflight.Done()
+				g.cancel()
+			}()
+		}
+	}
+
+	if g.exceeded {
+		if data.Identifier != ReadyForQueryIdentifier {
+			return nil
+		}
+		e := &pgproto3.ErrorResponse{
+			Severity: "ERROR",
+			Code:     ProgramLimitExceeded,
+			Message:  ErrResultSizeTooLarge.Error(),
+		}
+		return append(e.Encode(nil), data.Encode()...)
+	}
+
+	if data.Identifier == ErrorResponseIdentifier && atomic.LoadInt32(&g.timedOut) == 1 {
+		var backendErr pgproto3.ErrorResponse
+		if err := backendErr.Decode(data.Payload); err == nil && backendErr.Code == QueryCanceled {
+			e := &pgproto3.ErrorResponse{
+				Severity: "ERROR",
+				Code:     QueryCanceled,
+				Message:  ErrQueryTimeout.Error(),
+			}
+			return e.Encode(nil)
+		}
+	}
+	return data.Encode()
+}
+
+// limited returns true if the response has been changed by the guard. Such responses
+// are not cached.
+func (g *queryGuard) limited() bool {
+	return g.exceeded || atomic.LoadInt32(&g.timedOut) == 1
+}
+
+// confirmCancel makes sure that a cancel request of the query limits doesn't cancel the
+// next statement of the session. The backend ignores a cancel request while it's waiting
+// for a message, it has handled the request after it responds to a Sync.
+func (p *Proxy) confirmCancel(server *pgconn.PgConn) error {
+	conn := server.Conn()
+	if err := conn.SetDeadline(time.Now().Add(cancelTimeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write((&pgproto3.Sync{}).Encode(nil)); err != nil {
+		return err
+	}
+
+	r, err := protocol.New(conn)
+	if err != nil {
+		return err
+	}
+	for {
+		data, err := r.Read()
+		if err != nil {
+			return err
+		}
+		if data.Identifier == ReadyForQueryIdentifier {
+			return conn.SetDeadline(time.Time{})
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgresql
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/postgresql/protocol"
+	"github.com/pgscale/pgscale/testutils"
+	"github.com/stretchr/testify/require"
+)
+
+func toDataPacket(msg pgproto3.BackendMessage) *protocol.DataPacket {
+	buf := msg.Encode(nil)
+	return &protocol.DataPacket{
+		Identifier: buf[0],
+		Header:     buf[:protocol.HeaderLen],
+		Payload:    buf[protocol.HeaderLen:],
+	}
+}
+
+func newTestQueryGuard(limits queryLimits) (*queryGuard, <-chan struct{}) {
+	canceled := make(chan struct{}, 1)
+	cancelRequest := func(context.Context) error {
+		canceled <- struct{}{}
+		return nil
+	}
+	return newQueryGuard(limits, cancelRequest, testutils.NewLogger()), canceled
+}
+
+func TestParseQueryLimits(t *testing.T) {
+	timeout := "30s"
+	db := &config.Database{QueryTimeout: &timeout, MaxResultBytes: intPtr(1024)}
+
+	l, err := parseQueryLimits(db, nil)
+	require.NoError(t, err)
+	require.Equal(t, queryLimits{timeout: 30 * time.Second, maxResultBytes: 1024}, l)
+
+	l, err = parseQueryLimits(db, map[string]string{
+		config.QueryTimeoutUserKey:   "5m",
+		config.MaxResultBytesUserKey: "0",
+	})
+	require.NoError(t, err)
+	require.Equal(t, queryLimits{timeout: 5 * time.Minute}, l)
+
+	_, err = parseQueryLimits(db, map[string]string{config.MaxResultBytesUserKey: "1MB"})
+	require.Error(t, err)
+}
+
+func TestQueryGuard_MaxResultBytes(t *testing.T) {
+	row := toDataPacket(&pgproto3.DataRow{Values: [][]byte{make([]byte, 100)}})
+	g, canceled := newTestQueryGuard(queryLimits{maxResultBytes: 250})
+
+	require.Equal(t, row.Encode(), g.filter(row))
+	require.Equal(t, row.Encode(), g.filter(row))
+	// The third row exceeds the limit, the rest of the result is discarded.
+	require.Nil(t, g.filter(row))
+	<-canceled
+	require.Nil(t, g.filter(toDataPacket(&pgproto3.ErrorResponse{Code: QueryCanceled})))
+	require.True(t, g.limited())
+
+	msg := g.filter(toDataPacket(&pgproto3.ReadyForQuery{TxStatus: IdleTxStatus}))
+	frontend := pgproto3.NewFrontend(pgproto3.NewChunkReader(bytes.NewReader(msg)), nil)
+	e, err := frontend.Receive()
+	require.NoError(t, err)
+	require.Equal(t, ProgramLimitExceeded, e.(*pgproto3.ErrorResponse).Code)
+	rfq, err := frontend.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.ReadyForQuery{}, rfq)
+}
+
+func TestQueryGuard_QueryTimeout(t *testing.T) {
+	g, canceled := newTestQueryGuard(queryLimits{timeout: 10 * time.Millisecond})
+	defer g.stop()
+	<-canceled
+
+	msg := g.filter(toDataPacket(&pgproto3.ErrorResponse{
+		Severity: "ERROR",
+		Code:     QueryCanceled,
+		Message:  "canceling statement due to user request",
+	}))
+	var e pgproto3.ErrorResponse
+	require.Equal(t, ErrorResponseIdentifier, msg[0])
+	require.Equal(t, int(binary.BigEndian.Uint32(msg[1:5])), len(msg)-1)
+	require.NoError(t, e.Decode(msg[protocol.HeaderLen:]))
+	require.Equal(t, QueryCanceled, e.Code)
+	require.Equal(t, ErrQueryTimeout.Error(), e.Message)
+	require.True(t, g.limited())
+}
+
+func TestQueryGuard_StopWaitsForCancel(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	cancelRequest := func(context.Context) error {
+		close(started)
+		<-release
+		return nil
+	}
+	g := newQueryGuard(queryLimits{timeout: time.Millisecond}, cancelRequest, testutils.NewLogger())
+	<-started
+
+	stopped := make(chan bool)
+	go func() {
+		stopped <- g.stop()
+	}()
+
+	select {
+	case <-stopped:
+		require.Fail(t, "stop returned before the cancel request has been sent")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	require.True(t, <-stopped)
+}
+
+func TestQueryGuard_StopNotCanceled(t *testing.T) {
+	g, _ := newTestQueryGuard(queryLimits{timeout: time.Minute})
+	require.False(t, g.stop())
+}
+
+func TestQueryGuard_StopConfirmed(t *testing.T) {
+	g, canceled := newTestQueryGuard(queryLimits{timeout: time.Millisecond})
+	<-canceled
+
+	g.filter(toDataPacket(&pgproto3.ErrorResponse{Severity: "ERROR", Code: QueryCanceled}))
+	// The backend has handled the cancel request.
+	require.False(t, g.stop())
+}
+
+func TestProxy_ConfirmCancel(t *testing.T) {
+	p, _ := newTestProxy(t)
+	server, backend := newTestBackend(t)
+
+	received := make(chan pgproto3.FrontendMessage, 1)
+	go func() {
+		msg, err := backend.Receive()
+		require.NoError(t, err)
+		received <- msg
+		require.NoError(t, backend.Send(&pgproto3.ReadyForQuery{TxStatus: InTransactionTxStatus}))
+	}()
+
+	require.NoError(t, p.confirmCancel(server))
+	require.IsType(t, &pgproto3.Sync{}, <-received)
+}
+
+func TestProxy_ConfirmCancel_ServerGone(t *testing.T) {
+	p, _ := newTestProxy(t)
+	server, _ := newTestBackend(t)
+	require.NoError(t, server.Conn().Close())
+
+	require.Error(t, p.confirmCancel(server))
+}
@@ -19,18 +19,18 @@ import (
 
 	"github.com/buraksezer/olric"
 	"github.com/pgscale/pgscale/config"
-	"github.com/pgscale/pgscale/postgresql/matcher"
+	"github.com/pgscale/pgscale/logging"
 	"github.com/pgscale/pgscale/postgresql/protocol"
 	"github.com/pgscale/pgscale/utils"
 )
 
-func (p *Proxy) cacheSimpleQuery(table *config.Table, data *protocol.DataPacket) (bool, error) {
-	value, err := p.loadFromCache(table, data)
+func (p *Proxy) cacheSimpleQuery(tables []*config.Table, data *protocol.DataPacket) (bool, error) {
+	value, err := p.loadFromCache(tables, data)
 	if errors.Is(err, olric.ErrKeyNotFound) {
 		return false, nil
 	}
 
-	if errors.Is(err, ErrGetOrCreateDMap) {
+	if errors.Is(err, ErrGetOrCreateDMap) || errors.Is(err, ErrTableVersions) {
 		return false, nil
 	}
 
@@ -51,22 +51,21 @@ func (p *Proxy) handleSimpleQuery(data *protocol.DataPacket) (bool, error) {
 		p.log.V(1).Printf("[INFO] Simple query statement: %s", utils.ByteToString(payload))
 	}
 
-	if !utils.StartWithSelect(payload) {
-		return false, nil
-	}
-
-	query, err := matcher.Parse(payload)
-	if err != nil {
+	query, ok, err := p.parseQuery(payload)
+	if err != nil || !ok {
 		return false, err
 	}
 
-	return query.Match(p.dbconn.Database.Caches, func(table *config.Table) (bool, error) {
-		servedFromCache, err = p.cacheSimpleQuery(table, data)
+	return query.Match(p.dbconn.Database.Caches, func(tables []*config.Table) (bool, error) {
+		servedFromCache, err = p.cacheSimpleQuery(tables, data)
 		if err != nil {
 			return false, err
 		}
 		if servedFromCache {
-			p.log.V(4).Printf("[INFO] Simple query result fetched from cache. Statement: %s", utils.ByteToString(payload))
+			p.log.With(
+				logging.F("dmap", tables[0].DMapName),
+				logging.F("duration_ms", p.statementDuration()),
+			).V(4).Printf("[INFO] Simple query result fetched from cache. Statement: %s", utils.ByteToString(payload))
 		}
 		return servedFromCache, nil
 	})
@@ -0,0 +1,182 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgresql
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/pgscale/pgscale/audit"
+	"github.com/pgscale/pgscale/postgresql/protocol"
+	"github.com/pgscale/pgscale/slowlog"
+	"github.com/pgscale/pgscale/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// statementText extracts the SQL text from a Query or Parse message.
+func statementText(data *protocol.DataPacket) string {
+	payload := data.Payload
+	if data.Identifier == ParseIdentifier {
+		// Parse message starts with the name of the prepared statement.
+		idx := bytes.IndexByte(payload, 0)
+		if idx < 0 {
+			return ""
+		}
+		payload = payload[idx+1:]
+	}
+
+	if idx := bytes.IndexByte(payload, 0); idx >= 0 {
+		payload = payload[:idx]
+	}
+	return string(payload)
+}
+
+// spanContext returns the context that the spans of the current statement should
+// be attached to.
+func (p *Proxy) spanContext() context.Context {
+	if p.statementCtx != nil {
+		return p.statementCtx
+	}
+	return p.traceCtx
+}
+
+func (p *Proxy) beginStatement(data *protocol.DataPacket) {
+	p.statement = statementText(data)
+	p.statementStart = time.Now()
+	if data.Identifier == QueryIdentifier {
+		// Prepared statements are recorded when they are executed, see auditExtended.
+		p.auditStatement(p.statement)
+	}
+
+	// Attach the statement to the caller's trace, if the application propagates
+	// its trace context in a SQL comment.
+	parent := tracing.ExtractFromComment(p.traceCtx, p.statement)
+	p.statementCtx, p.statementSpan = p.tracing.Start(parent, "pgscale.query",
+		trace.WithLinks(trace.LinkFromContext(p.traceCtx)),
+		trace.WithAttributes(
+			attribute.String("db.system", "postgresql"),
+			attribute.String("db.name", p.session.Database),
+			attribute.String("db.user", p.session.User),
+		),
+	)
+}
+
+func (p *Proxy) auditStatement(statement string) {
+	if !p.auditor.Enabled() || statement == "" {
+		return
+	}
+
+	e := audit.Event{
+		User:       p.session.User,
+		Database:   p.session.Database,
+		ClientAddr: p.client.RemoteAddr().String(),
+	}
+	if err := p.auditor.RecordStatement(e, statement); err != nil {
+		p.log.V(3).Printf("[ERROR] Failed to write audit record: %v", err)
+	}
+}
+
+// auditExtended records the prepared statements of the client at every Bind. A
+// statement can be executed again without a Parse, such as by the statement cache of
+// a driver.
+func (p *Proxy) auditExtended(data *protocol.DataPacket) {
+	if !p.auditor.Enabled() {
+		return
+	}
+
+	switch data.Identifier {
+	case ParseIdentifier:
+		name, query := splitParse(data.Payload)
+		if p.statements == nil {
+			p.statements = make(map[string]string)
+		}
+		p.statements[name] = string(query)
+	case BindIdentifier:
+		if name, ok := boundStatement(data.Payload); ok {
+			p.auditStatement(p.statements[name])
+		}
+	case CloseIdentifier:
+		if name, ok := closedStatement(data.Payload); ok {
+			delete(p.statements, name)
+		}
+	}
+}
+
+// statementDuration returns the elapsed time since the beginning of the current statement in milliseconds.
+func (p *Proxy) statementDuration() float64 {
+	return float64(time.Since(p.statementStart)) / float64(time.Millisecond)
+}
+
+func (p *Proxy) endStatement(cached bool, backendPID uint32) {
+	if p.statementSpan != nil {
+		p.statementSpan.SetAttributes(
+			attribute.Bool("pgscale.cache.hit", cached),
+			attribute.Int64("pgscale.backend.pid", int64(backendPID)),
+		)
+		p.statementSpan.End()
+		p.statementSpan = nil
+		p.statementCtx = nil
+	}
+
+	statement := p.statement
+	p.statement = ""
+	p.logSlowQuery(statement, cached, backendPID)
+}
+
+// abortStatement ends the span of a statement that's abandoned because of err, such
+// as a failure to acquire a server connection or to relay the response.
+func (p *Proxy) abortStatement(err error) {
+	if p.statementSpan != nil {
+		recordSpanError(p.statementSpan, err)
+		p.statementSpan.End()
+		p.statementSpan = nil
+		p.statementCtx = nil
+	}
+	p.statement = ""
+}
+
+func recordSpanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+func (p *Proxy) logSlowQuery(statement string, cached bool, backendPID uint32) {
+	if p.slowQueryThreshold == 0 || statement == "" {
+		return
+	}
+
+	elapsed := time.Since(p.statementStart)
+	if elapsed < p.slowQueryThreshold {
+		return
+	}
+
+	e := &slowlog.Entry{
+		Time:            p.statementStart,
+		Query:           slowlog.Normalize(statement),
+		DurationMs:      float64(elapsed) / float64(time.Millisecond),
+		Database:        p.session.Database,
+		User:            p.session.User,
+		ApplicationName: p.session.ApplicationName,
+		ClientAddr:      p.client.RemoteAddr().String(),
+		BackendPID:      backendPID,
+		Cached:          cached,
+	}
+	if err := p.slowlog.Log(e); err != nil {
+		p.log.V(3).Printf("[ERROR] Failed to write slow query log: %v", err)
+	}
+}
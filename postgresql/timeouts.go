@@ -0,0 +1,99 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgresql
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/pgscale/pgscale/config"
+)
+
+const defaultClientLoginTimeout = 60 * time.Second
+
+var (
+	ErrLoginTimeout           = errors.New("canceling authentication due to timeout")
+	ErrIdleSessionTimeout     = errors.New("terminating connection due to idle-session timeout")
+	ErrIdleTransactionTimeout = errors.New("terminating connection due to idle-in-transaction timeout")
+)
+
+// errorWriteTimeout bounds writing an error to a client that has timed out or is
+// terminated by a shutdown.
+const errorWriteTimeout = time.Second
+
+// clientTimeouts are the timeouts of reading from a client. Zero means no timeout.
+type clientTimeouts struct {
+	login           time.Duration
+	idle            time.Duration
+	idleTransaction time.Duration
+}
+
+func parseClientTimeouts(c *config.Config) (clientTimeouts, error) {
+	t := clientTimeouts{login: defaultClientLoginTimeout}
+
+	var err error
+	if c.PgScale.ClientLoginTimeout != nil {
+		t.login, err = time.ParseDuration(*c.PgScale.ClientLoginTimeout)
+		if err != nil {
+			return t, fmt.Errorf("invalid client_login_timeout: %w", err)
+		}
+	}
+	if c.PgScale.ClientIdleTimeout != nil {
+		t.idle, err = time.ParseDuration(*c.PgScale.ClientIdleTimeout)
+		if err != nil {
+			return t, fmt.Errorf("invalid client_idle_timeout: %w", err)
+		}
+	}
+	if c.PgScale.IdleTransactionTimeout != nil {
+		t.idleTransaction, err = time.ParseDuration(*c.PgScale.IdleTransactionTimeout)
+		if err != nil {
+			return t, fmt.Errorf("invalid idle_transaction_timeout: %w", err)
+		}
+	}
+	return t, nil
+}
+
+// readTimeout returns the timeout of waiting for the next request of a client with the
+// given transaction status.
+func (t clientTimeouts) readTimeout(txStatus byte) time.Duration {
+	if txStatus == IdleTxStatus {
+		return t.idle
+	}
+	return t.idleTransaction
+}
+
+// fatalResponse sends a FATAL error to the client.
+func fatalResponse(w io.Writer, code, message string) error {
+	e := &pgproto3.ErrorResponse{
+		Severity: "FATAL",
+		Code:     code,
+		Message:  message,
+	}
+	_, err := w.Write(e.Encode(nil))
+	return err
+}
+
+// timeoutResponse sends the error of an exceeded timeout to a client. The client may
+// not read anymore, so writing the error has a deadline too.
+func timeoutResponse(conn net.Conn, code string, timeoutErr error) error {
+	if err := conn.SetDeadline(time.Now().Add(errorWriteTimeout)); err != nil {
+		return err
+	}
+	return fatalResponse(conn, code, timeoutErr.Error())
+}
@@ -0,0 +1,120 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slowlog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	pg_query "github.com/pganalyze/pg_query_go/v2"
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/kontext"
+)
+
+var ErrSlowLogNotFound = errors.New("slow query log not found")
+
+// Entry is a single record in the slow query log.
+type Entry struct {
+	Time            time.Time `json:"time"`
+	Query           string    `json:"query"`
+	DurationMs      float64   `json:"duration_ms"`
+	Database        string    `json:"database"`
+	User            string    `json:"user"`
+	ApplicationName string    `json:"application_name"`
+	ClientAddr      string    `json:"client_addr"`
+	BackendPID      uint32    `json:"backend_pid"`
+	Cached          bool      `json:"cached"`
+}
+
+// SlowLog writes statements that exceed a threshold to a dedicated sink as JSON lines.
+type SlowLog struct {
+	mtx sync.Mutex
+
+	out    io.Writer
+	closer io.Closer
+}
+
+// New creates a new SlowLog. It writes to stderr if c is nil.
+func New(c *config.SlowQueryLog) (*SlowLog, error) {
+	if c == nil {
+		return &SlowLog{out: os.Stderr}, nil
+	}
+
+	switch c.Output {
+	case "", config.Stderr:
+		return &SlowLog{out: os.Stderr}, nil
+	case config.Stdout:
+		return &SlowLog{out: os.Stdout}, nil
+	default:
+		f, err := os.OpenFile(c.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, c.Perm)
+		if err != nil {
+			return nil, err
+		}
+		return &SlowLog{out: f, closer: f}, nil
+	}
+}
+
+// Normalize replaces the constants in a statement with parameter references, so
+// the same statement with different arguments produces the same log line. It
+// returns the query as is, if it cannot be parsed.
+func Normalize(query string) string {
+	normalized, err := pg_query.Normalize(query)
+	if err != nil {
+		return query
+	}
+	return normalized
+}
+
+// Log writes an entry to the underlying sink.
+func (s *SlowLog) Log(e *Entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	_, err = s.out.Write(data)
+	return err
+}
+
+// Close closes the underlying log file, if there is any.
+func (s *SlowLog) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+func FromKontext(k *kontext.Kontext) (*SlowLog, error) {
+	i := k.Get(kontext.SlowLogKey)
+	if i == nil {
+		return nil, ErrSlowLogNotFound
+	}
+
+	s, ok := i.(*SlowLog)
+	if !ok {
+		return nil, fmt.Errorf("slowlog: %w", kontext.ErrInvalidType)
+	}
+
+	return s, nil
+}
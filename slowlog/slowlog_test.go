@@ -0,0 +1,79 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package slowlog
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/kontext"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowLog_Normalize(t *testing.T) {
+	require.Equal(t, "SELECT * FROM users WHERE id = $1", Normalize("SELECT * FROM users WHERE id = 42"))
+	require.Equal(t, "not a query", Normalize("not a query"))
+}
+
+func TestSlowLog_Log(t *testing.T) {
+	output := path.Join(t.TempDir(), "slow.log")
+	s, err := New(&config.SlowQueryLog{Output: output, Perm: 0600})
+	require.NoError(t, err)
+
+	e := &Entry{
+		Time:            time.Now().UTC(),
+		Query:           Normalize("SELECT * FROM users WHERE id = 42"),
+		DurationMs:      1234.5,
+		Database:        "postgres",
+		User:            "dbuser",
+		ApplicationName: "psql",
+		ClientAddr:      "127.0.0.1:54321",
+		BackendPID:      4242,
+		Cached:          true,
+	}
+	require.NoError(t, s.Log(e))
+	require.NoError(t, s.Close())
+
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+
+	var logged Entry
+	require.NoError(t, json.Unmarshal(data, &logged))
+	require.Equal(t, e.Query, logged.Query)
+	require.Equal(t, e.BackendPID, logged.BackendPID)
+	require.Equal(t, e.ClientAddr, logged.ClientAddr)
+	require.True(t, logged.Cached)
+}
+
+func TestSlowLog_FromKontext(t *testing.T) {
+	ktx := kontext.New()
+	_, err := FromKontext(ktx)
+	require.ErrorIs(t, err, ErrSlowLogNotFound)
+
+	ktx.Set(kontext.SlowLogKey, struct{}{})
+	_, err = FromKontext(ktx)
+	require.ErrorIs(t, err, kontext.ErrInvalidType)
+
+	s, err := New(nil)
+	require.NoError(t, err)
+	ktx.Set(kontext.SlowLogKey, s)
+	extracted, err := FromKontext(ktx)
+	require.NoError(t, err)
+	require.Equal(t, s, extracted)
+}
@@ -0,0 +1,214 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout is the time to read the PROXY protocol header after accept.
+const proxyHeaderTimeout = 5 * time.Second
+
+// maxProxyV1Length is the length of the longest v1 header, including CRLF.
+const maxProxyV1Length = 107
+
+var (
+	ErrProxyHeaderMissing   = errors.New("PROXY protocol header is missing")
+	ErrProxyHeaderInvalid   = errors.New("invalid PROXY protocol header")
+	ErrProxyHeaderUntrusted = errors.New("PROXY protocol header from an untrusted source")
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection that's accepted from a load balancer. RemoteAddr returns
+// the source address in the PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		// LOCAL command or UNKNOWN protocol, such as the health checks of the load balancer.
+		return c.Conn.RemoteAddr()
+	}
+	return c.remote
+}
+
+// isTrustedSource returns true if the peer of conn is in one of the trusted networks.
+func isTrustedSource(conn net.Conn, trusted []*net.IPNet) bool {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header at the start of conn. If
+// required is false, the connections without a header are returned as is. If trusted
+// is false, the peer is not a load balancer, a header is rejected and so is the
+// connection in required mode.
+func readProxyHeader(conn net.Conn, required, trusted bool) (net.Conn, error) {
+	if !trusted && required {
+		return nil, ErrProxyHeaderUntrusted
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	var remote net.Addr
+	if !trusted && (first[0] == 'P' || first[0] == proxyV2Signature[0]) {
+		// A StartupMessage cannot start with these bytes, its length is short.
+		return nil, ErrProxyHeaderUntrusted
+	}
+	switch first[0] {
+	case 'P':
+		remote, err = readProxyV1(r)
+	case proxyV2Signature[0]:
+		remote, err = readProxyV2(r)
+	default:
+		// PostgreSQL messages of the client start with the length.
+		if required {
+			return nil, ErrProxyHeaderMissing
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: r, remote: remote}, nil
+}
+
+// readProxyV1 parses a header such as "PROXY TCP4 192.168.0.1 192.168.0.11 56324 6957\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < maxProxyV1Length {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header is not terminated by CRLF", ErrProxyHeaderInvalid)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("%w: %q", ErrProxyHeaderInvalid, line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("%w: unknown protocol %q", ErrProxyHeaderInvalid, fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%w: %q", ErrProxyHeaderInvalid, line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: invalid source address %q", ErrProxyHeaderInvalid, line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses a binary header. The TLVs after the addresses are skipped.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, fmt.Errorf("%w: invalid v2 signature", ErrProxyHeaderInvalid)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unknown version %d", ErrProxyHeaderInvalid, header[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch header[12] & 0x0F {
+	case 0x0:
+		// LOCAL
+		return nil, nil
+	case 0x1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("%w: unknown command %d", ErrProxyHeaderInvalid, header[12]&0x0F)
+	}
+
+	switch header[13] >> 4 {
+	case 0x1:
+		// AF_INET: source and destination addresses, source and destination ports
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 addresses", ErrProxyHeaderInvalid)
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x2:
+		// AF_INET6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 addresses", ErrProxyHeaderInvalid)
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	default:
+		// AF_UNSPEC or AF_UNIX
+		return nil, nil
+	}
+}
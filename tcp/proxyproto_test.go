@@ -0,0 +1,186 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/pgscale/pgscale/config"
+	"github.com/stretchr/testify/require"
+)
+
+// startupPrefix is the start of a StartupMessage, its length and protocol version 3.0.
+var startupPrefix = []byte{0, 0, 0, 8, 0, 3, 0, 0}
+
+func proxyV2Header(command byte, family byte, addrs []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family<<4|0x1, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+// readHeader sends data on a pipe and reads the PROXY protocol header on the other end.
+func readHeader(t *testing.T, data []byte, required bool) (net.Conn, error) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	go func() {
+		_, _ = client.Write(data)
+	}()
+	return readProxyHeader(server, required, true)
+}
+
+func TestProxyProtocol_V1(t *testing.T) {
+	header := []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 6957\r\n")
+	conn, err := readHeader(t, append(header, startupPrefix...), true)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+
+	// The bytes after the header are read by the handler.
+	data := make([]byte, len(startupPrefix))
+	_, err = io.ReadFull(conn, data)
+	require.NoError(t, err)
+	require.Equal(t, startupPrefix, data)
+}
+
+func TestProxyProtocol_V1_TCP6(t *testing.T) {
+	header := []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 6957\r\n")
+	conn, err := readHeader(t, append(header, startupPrefix...), true)
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::1]:56324", conn.RemoteAddr().String())
+}
+
+func TestProxyProtocol_V1_Unknown(t *testing.T) {
+	conn, err := readHeader(t, append([]byte("PROXY UNKNOWN\r\n"), startupPrefix...), true)
+	require.NoError(t, err)
+	require.Equal(t, "pipe", conn.RemoteAddr().String())
+}
+
+func TestProxyProtocol_V1_Invalid(t *testing.T) {
+	_, err := readHeader(t, []byte("PROXY TCP4 192.168.0.1\r\n"), true)
+	require.True(t, errors.Is(err, ErrProxyHeaderInvalid))
+
+	_, err = readHeader(t, []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 6957\n"), true)
+	require.True(t, errors.Is(err, ErrProxyHeaderInvalid))
+}
+
+func TestProxyProtocol_V2_IPv4(t *testing.T) {
+	addrs := []byte{
+		10, 0, 0, 1, // source
+		10, 0, 0, 2, // destination
+		0xDB, 0xFA, // 56314
+		0x1B, 0x2D, // 6957
+	}
+	data := append(proxyV2Header(0x1, 0x1, addrs), startupPrefix...)
+	conn, err := readHeader(t, data, true)
+	require.NoError(t, err)
+	require.Equal(t, "10.0.0.1:56314", conn.RemoteAddr().String())
+
+	buf := make([]byte, len(startupPrefix))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, startupPrefix, buf)
+}
+
+func TestProxyProtocol_V2_IPv6(t *testing.T) {
+	addrs := make([]byte, 36)
+	copy(addrs[0:16], net.ParseIP("2001:db8::1"))
+	copy(addrs[16:32], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(addrs[32:34], 56314)
+	binary.BigEndian.PutUint16(addrs[34:36], 6957)
+
+	conn, err := readHeader(t, append(proxyV2Header(0x1, 0x2, addrs), startupPrefix...), true)
+	require.NoError(t, err)
+	require.Equal(t, "[2001:db8::1]:56314", conn.RemoteAddr().String())
+}
+
+func TestProxyProtocol_V2_Local(t *testing.T) {
+	conn, err := readHeader(t, append(proxyV2Header(0x0, 0x0, nil), startupPrefix...), true)
+	require.NoError(t, err)
+	require.Equal(t, "pipe", conn.RemoteAddr().String())
+}
+
+func TestProxyProtocol_Missing(t *testing.T) {
+	_, err := readHeader(t, startupPrefix, true)
+	require.True(t, errors.Is(err, ErrProxyHeaderMissing))
+
+	conn, err := readHeader(t, startupPrefix, false)
+	require.NoError(t, err)
+	require.Equal(t, "pipe", conn.RemoteAddr().String())
+
+	data := make([]byte, len(startupPrefix))
+	_, err = io.ReadFull(conn, data)
+	require.NoError(t, err)
+	require.Equal(t, startupPrefix, data)
+}
+
+func TestProxyProtocol_Untrusted(t *testing.T) {
+	header := []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 6957\r\n")
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	go func() {
+		_, _ = client.Write(append(header, startupPrefix...))
+	}()
+	_, err := readProxyHeader(server, false, false)
+	require.True(t, errors.Is(err, ErrProxyHeaderUntrusted))
+
+	// The clients that connect directly are accepted without a header in optional mode.
+	client, server = net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	go func() {
+		_, _ = client.Write(startupPrefix)
+	}()
+	conn, err := readProxyHeader(server, false, false)
+	require.NoError(t, err)
+	require.Equal(t, "pipe", conn.RemoteAddr().String())
+
+	_, err = readProxyHeader(server, true, false)
+	require.True(t, errors.Is(err, ErrProxyHeaderUntrusted))
+}
+
+func TestProxyProtocol_IsTrustedSource(t *testing.T) {
+	trusted, err := config.TrustedSources([]string{"10.0.0.0/8", "127.0.0.1"})
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			defer conn.Close()
+		}
+	}()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.True(t, isTrustedSource(conn, trusted))
+	require.False(t, isTrustedSource(conn, trusted[:1]))
+	require.False(t, isTrustedSource(conn, nil))
+}
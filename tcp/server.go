@@ -17,26 +17,42 @@ package tcp
 import (
 	"context"
 	"net"
+	"os"
 	"sync"
 
-	"github.com/buraksezer/olric/pkg/flog"
 	"github.com/pgscale/pgscale/config"
 	"github.com/pgscale/pgscale/kontext"
-	"github.com/pgscale/pgscale/utils"
+	"github.com/pgscale/pgscale/logging"
 )
 
 type Handler func(conn net.Conn) error
 
+// listener is served in addition to the main listener.
+type listener struct {
+	net.Listener
+	handler Handler
+	// proxyProtocol is true if the connections start with a PROXY protocol header.
+	proxyProtocol bool
+}
+
 type Server struct {
 	config   *config.Config
-	log      *flog.Logger
+	log      *logging.Logger
 	addr     string
 	listener net.Listener
-	handler  Handler
-	wg       sync.WaitGroup
-	started  func()
-	ctx      context.Context
-	cancel   context.CancelFunc
+	unixPath string
+	unixMode os.FileMode
+	// proxyProtocol is the mode of the PROXY protocol on the TCP listeners, it's
+	// empty if the protocol is disabled.
+	proxyProtocol string
+	// trustedSources are the load balancers that can send a PROXY protocol header.
+	trustedSources []*net.IPNet
+	extra          []listener
+	handler        Handler
+	wg             sync.WaitGroup
+	started        func()
+	ctx            context.Context
+	cancel         context.CancelFunc
 }
 
 func New(k *kontext.Kontext, started func(), handler Handler) (*Server, error) {
@@ -45,29 +61,69 @@ func New(k *kontext.Kontext, started func(), handler Handler) (*Server, error) {
 		return nil, err
 	}
 
-	lg, err := utils.FlogFromKontext(k)
+	lg, err := logging.FromKontext(k)
+	if err != nil {
+		return nil, err
+	}
+
+	unixMode := DefaultUnixSocketMode
+	if c.PgScale.UnixSocketMode != nil {
+		unixMode, err = config.UnixSocketMode(*c.PgScale.UnixSocketMode)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var unixPath string
+	if c.PgScale.UnixSocketDir != nil {
+		unixPath = UnixSocketPath(*c.PgScale.UnixSocketDir, c.PgScale.BindPort)
+	}
+
+	var proxyProtocol string
+	if c.PgScale.ProxyProtocol != nil {
+		proxyProtocol = *c.PgScale.ProxyProtocol
+	}
+	trustedSources, err := config.TrustedSources(c.PgScale.ProxyProtocolTrustedSources)
 	if err != nil {
 		return nil, err
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
-		config:  c,
-		log:     lg,
-		addr:    net.JoinHostPort(c.PgScale.BindAddr, c.PgScale.BindPort),
-		handler: handler,
-		started: started,
-		ctx:     ctx,
-		cancel:  cancel,
+		config:         c,
+		log:            lg.With(logging.F("component", "tcp")),
+		addr:           net.JoinHostPort(c.PgScale.BindAddr, c.PgScale.BindPort),
+		unixPath:       unixPath,
+		unixMode:       unixMode,
+		proxyProtocol:  proxyProtocol,
+		trustedSources: trustedSources,
+		handler:        handler,
+		started:        started,
+		ctx:            ctx,
+		cancel:         cancel,
 	}, nil
 }
 
-func (s *Server) handleConn(conn net.Conn) {
+func (s *Server) handleConn(conn net.Conn, l listener) {
 	defer s.wg.Done()
 
-	err := s.handler(conn)
+	if l.proxyProtocol {
+		required := s.proxyProtocol == config.RequiredProxyProtocol
+		pc, err := readProxyHeader(conn, required, isTrustedSource(conn, s.trustedSources))
+		if err != nil {
+			s.log.With(logging.F("client_addr", conn.RemoteAddr().String())).V(3).Printf("[ERROR] Failed to read PROXY protocol header: %v", err)
+			_ = conn.Close()
+			return
+		}
+		if pc.RemoteAddr().String() != conn.RemoteAddr().String() {
+			s.log.With(logging.F("client_addr", pc.RemoteAddr().String())).V(3).Printf("[DEBUG] Connection has been proxied by %s", conn.RemoteAddr())
+		}
+		conn = pc
+	}
+
+	err := l.handler(conn)
 	if err != nil {
-		s.log.V(3).Printf("[ERROR] Connection handler returned an error: %v", err)
+		s.log.With(logging.F("client_addr", conn.RemoteAddr().String())).V(3).Printf("[ERROR] Connection handler returned an error: %v", err)
 	}
 }
 
@@ -76,37 +132,93 @@ func (s *Server) ListenAndServe() error {
 	if err != nil {
 		return err
 	}
+	return s.Serve(l)
+}
+
+// AddListener serves the connections on l with handler, in addition to the main
+// listener. It must be called before Serve, the listeners are closed by Shutdown.
+// The connections on l start with a header if the PROXY protocol is enabled.
+func (s *Server) AddListener(l net.Listener, handler Handler) {
+	s.extra = append(s.extra, listener{Listener: l, handler: handler, proxyProtocol: s.proxyProtocol != ""})
+}
 
+// Serve accepts connections on l, such as a listener that's inherited from another process.
+// If unix_socket_dir is set, the connections on the Unix domain socket are served too.
+func (s *Server) Serve(l net.Listener) error {
 	s.listener = l
+	if s.unixPath != "" {
+		ul, err := listenUnix(s.unixPath, s.unixMode)
+		if err != nil {
+			_ = l.Close()
+			for _, el := range s.extra {
+				_ = el.Close()
+			}
+			return err
+		}
+		s.log.V(2).Printf("[INFO] Listening on Unix domain socket %s", s.unixPath)
+		// Local clients connect to the Unix domain socket without a load balancer.
+		s.extra = append(s.extra, listener{Listener: ul, handler: s.handler})
+	}
+
+	for _, el := range s.extra {
+		go func(el listener) {
+			if err := s.accept(el); err != nil && s.ctx.Err() == nil {
+				s.log.V(3).Printf("[ERROR] Failed to accept connection on %s: %v", el.Addr(), err)
+			}
+		}(el)
+	}
+
 	if s.started != nil {
 		s.started()
 	}
+	return s.accept(listener{Listener: l, handler: s.handler, proxyProtocol: s.proxyProtocol != ""})
+}
 
+func (s *Server) accept(l listener) error {
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
 			return err
 		}
 
 		s.wg.Add(1)
-		go s.handleConn(conn)
+		go s.handleConn(conn, l)
 	}
 }
 
-func (s *Server) Shutdown() error {
+// Listener returns the listener of a running server.
+func (s *Server) Listener() net.Listener {
+	return s.listener
+}
+
+// Shutdown stops accepting new connections and waits for the running handlers to
+// return. If ctx is done before that, Shutdown returns ctx.Err(). It can be called
+// again to keep waiting for the handlers.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
 	select {
 	case <-s.ctx.Done():
 		// Already closed
-		return nil
 	default:
+		s.cancel()
+		err = s.listener.Close()
+		for _, el := range s.extra {
+			if closeErr := el.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
 	}
-	s.cancel()
 
-	errCh := make(chan error, 1)
+	done := make(chan struct{})
 	go func() {
-		errCh <- s.listener.Close()
+		s.wg.Wait()
+		close(done)
 	}()
 
-	s.wg.Wait()
-	return <-errCh
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
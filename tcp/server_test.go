@@ -16,7 +16,9 @@ package tcp
 
 import (
 	"context"
+	"io"
 	"net"
+	"os"
 	"strconv"
 	"testing"
 	"time"
@@ -60,7 +62,7 @@ func TestTCP_Server(t *testing.T) {
 
 	k := kontext.New()
 	k.Set(kontext.ConfigKey, c)
-	k.Set(kontext.LoggerKey, testutils.NewFlogLogger())
+	k.Set(kontext.LoggerKey, testutils.NewLogger())
 	s, err := New(k, started, echoHandler)
 	require.NoError(t, err)
 
@@ -92,6 +94,234 @@ func TestTCP_Server(t *testing.T) {
 		require.Equal(t, message, data)
 	})
 
-	err = s.Shutdown()
+	err = s.Shutdown(context.Background())
 	require.NoError(t, err)
 }
+
+func TestTCP_Server_ShutdownTimeout(t *testing.T) {
+	port, err := testutils.GetFreePort()
+	require.NoError(t, err)
+
+	cfg := testutils.NewPgScaleConfig(t)
+	c, err := config.New(cfg)
+	require.NoError(t, err)
+
+	c.PgScale.BindAddr = "127.0.0.1"
+	c.PgScale.BindPort = strconv.Itoa(port)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := func() {
+		cancel()
+	}
+
+	release := make(chan struct{})
+	handling := make(chan struct{})
+	blockingHandler := func(conn net.Conn) error {
+		close(handling)
+		<-release
+		return conn.Close()
+	}
+
+	k := kontext.New()
+	k.Set(kontext.ConfigKey, c)
+	k.Set(kontext.LoggerKey, testutils.NewLogger())
+	s, err := New(k, started, blockingHandler)
+	require.NoError(t, err)
+
+	go func() {
+		_ = s.ListenAndServe()
+	}()
+	<-ctx.Done()
+
+	clientConn, err := net.Dial("tcp", s.addr)
+	require.NoError(t, err)
+	defer clientConn.Close()
+	<-handling
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer shutdownCancel()
+	require.ErrorIs(t, s.Shutdown(shutdownCtx), context.DeadlineExceeded)
+
+	// The listener has been closed
+	_, err = net.Dial("tcp", s.addr)
+	require.Error(t, err)
+
+	close(release)
+	require.NoError(t, s.Shutdown(context.Background()))
+}
+
+func TestTCP_Server_UnixSocket(t *testing.T) {
+	port, err := testutils.GetFreePort()
+	require.NoError(t, err)
+
+	c, err := config.New(testutils.NewPgScaleConfig(t))
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	mode := "0770"
+	c.PgScale.BindAddr = "127.0.0.1"
+	c.PgScale.BindPort = strconv.Itoa(port)
+	c.PgScale.UnixSocketDir = &dir
+	c.PgScale.UnixSocketMode = &mode
+
+	ctx, cancel := context.WithCancel(context.Background())
+	echoHandler := func(conn net.Conn) error {
+		_, err := io.Copy(conn, conn)
+		return err
+	}
+
+	k := kontext.New()
+	k.Set(kontext.ConfigKey, c)
+	k.Set(kontext.LoggerKey, testutils.NewLogger())
+	s, err := New(k, cancel, echoHandler)
+	require.NoError(t, err)
+
+	go func() {
+		_ = s.ListenAndServe()
+	}()
+	<-ctx.Done()
+
+	path := UnixSocketPath(dir, c.PgScale.BindPort)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0770), info.Mode().Perm())
+
+	clientConn, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	_, err = clientConn.Write([]byte("Hello, world!"))
+	require.NoError(t, err)
+	data := make([]byte, 13)
+	_, err = io.ReadFull(clientConn, data)
+	require.NoError(t, err)
+	require.Equal(t, "Hello, world!", string(data))
+	require.NoError(t, clientConn.Close())
+
+	require.NoError(t, s.Shutdown(context.Background()))
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestTCP_UnixListener_Replaced(t *testing.T) {
+	path := UnixSocketPath(t.TempDir(), "6957")
+
+	old, err := listenUnix(path, DefaultUnixSocketMode)
+	require.NoError(t, err)
+
+	// A new process takes over the socket, the old one doesn't remove it on close.
+	next, err := listenUnix(path, DefaultUnixSocketMode)
+	require.NoError(t, err)
+	require.NoError(t, old.Close())
+	_, err = os.Stat(path)
+	require.NoError(t, err)
+
+	require.NoError(t, next.Close())
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestTCP_UnixListener_NotSocket(t *testing.T) {
+	path := UnixSocketPath(t.TempDir(), "6957")
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+
+	_, err := listenUnix(path, DefaultUnixSocketMode)
+	require.Error(t, err)
+}
+
+func TestTCP_Server_AddListener(t *testing.T) {
+	port, err := testutils.GetFreePort()
+	require.NoError(t, err)
+
+	c, err := config.New(testutils.NewPgScaleConfig(t))
+	require.NoError(t, err)
+	c.PgScale.BindAddr = "127.0.0.1"
+	c.PgScale.BindPort = strconv.Itoa(port)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	k := kontext.New()
+	k.Set(kontext.ConfigKey, c)
+	k.Set(kontext.LoggerKey, testutils.NewLogger())
+	s, err := New(k, cancel, func(conn net.Conn) error {
+		defer conn.Close()
+		_, err := conn.Write([]byte("main"))
+		return err
+	})
+	require.NoError(t, err)
+
+	extra, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s.AddListener(extra, func(conn net.Conn) error {
+		defer conn.Close()
+		_, err := conn.Write([]byte("extra"))
+		return err
+	})
+
+	go func() {
+		_ = s.ListenAndServe()
+	}()
+	<-ctx.Done()
+
+	read := func(addr string) string {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		data, err := io.ReadAll(conn)
+		require.NoError(t, err)
+		return string(data)
+	}
+	require.Equal(t, "main", read(s.addr))
+	require.Equal(t, "extra", read(extra.Addr().String()))
+
+	require.NoError(t, s.Shutdown(context.Background()))
+	_, err = net.Dial("tcp", extra.Addr().String())
+	require.Error(t, err)
+}
+
+func TestTCP_Server_ProxyProtocol(t *testing.T) {
+	port, err := testutils.GetFreePort()
+	require.NoError(t, err)
+
+	c, err := config.New(testutils.NewPgScaleConfig(t))
+	require.NoError(t, err)
+	mode := config.RequiredProxyProtocol
+	c.PgScale.BindAddr = "127.0.0.1"
+	c.PgScale.BindPort = strconv.Itoa(port)
+	c.PgScale.ProxyProtocol = &mode
+	c.PgScale.ProxyProtocolTrustedSources = []string{"127.0.0.1"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	k := kontext.New()
+	k.Set(kontext.ConfigKey, c)
+	k.Set(kontext.LoggerKey, testutils.NewLogger())
+	s, err := New(k, cancel, func(conn net.Conn) error {
+		defer conn.Close()
+		_, err := conn.Write([]byte(conn.RemoteAddr().String()))
+		return err
+	})
+	require.NoError(t, err)
+
+	go func() {
+		_ = s.ListenAndServe()
+	}()
+	<-ctx.Done()
+
+	conn, err := net.Dial("tcp", s.addr)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 6957\r\n"))
+	require.NoError(t, err)
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "192.168.0.1:56324", string(data))
+	require.NoError(t, conn.Close())
+
+	// The connection is closed without a header.
+	conn, err = net.Dial("tcp", s.addr)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte{0, 0, 0, 8, 4, 210, 22, 47})
+	require.NoError(t, err)
+	data, err = io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Empty(t, data)
+	require.NoError(t, conn.Close())
+
+	require.NoError(t, s.Shutdown(context.Background()))
+}
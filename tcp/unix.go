@@ -0,0 +1,84 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// DefaultUnixSocketMode is the permissions of the Unix domain socket, like the default
+// unix_socket_permissions of PostgreSQL.
+const DefaultUnixSocketMode os.FileMode = 0777
+
+// UnixSocketPath returns the path of the socket of port in dir, as libpq expects it.
+func UnixSocketPath(dir, port string) string {
+	return filepath.Join(dir, ".s.PGSQL."+port)
+}
+
+// unixListener is a Unix domain socket that removes its file on Close, unless the file
+// has been replaced by another process in the meantime, such as after an upgrade.
+type unixListener struct {
+	*net.UnixListener
+	path string
+	info os.FileInfo
+}
+
+func listenUnix(path string, mode os.FileMode) (*unixListener, error) {
+	info, err := os.Lstat(path)
+	switch {
+	case err == nil && info.Mode()&fs.ModeSocket == 0:
+		return nil, fmt.Errorf("%s exists and is not a socket", path)
+	case err == nil:
+		// A stale socket, or the socket of the process that's being upgraded. It keeps
+		// serving its clients on the unlinked socket until it exits.
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false)
+
+	if err = os.Chmod(path, mode); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	info, err = os.Lstat(path)
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: l, path: path, info: info}, nil
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	if info, statErr := os.Lstat(l.path); statErr == nil && os.SameFile(info, l.info) {
+		if rmErr := os.Remove(l.path); rmErr != nil && err == nil {
+			err = rmErr
+		}
+	}
+	return err
+}
@@ -1,6 +1,7 @@
 pgscale {
   bind_addr = "127.0.0.1"
   bind_port = 6957
+  shutdown_timeout = "30s"
 
   auth {
     users = {
@@ -19,9 +20,20 @@ pgscale {
     verbosity = 6
     level = "DEBUG"
     output = "stderr"
+    format = "text"
     perm = 0644
   }
 
+  slow_query_log {
+    output = "stderr"
+    perm = 0644
+  }
+
+  http {
+    bind_addr = "127.0.0.1"
+    bind_port = 6958
+  }
+
   postgresql {
     database "postgres" {
       parameters = {
@@ -60,6 +72,7 @@ pgscale {
       }
 
       log_statements = true
+      slow_query_threshold = "500ms"
       reset_query = "DISCARD ALL"
 
       cache "public" {
@@ -20,7 +20,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"path"
@@ -31,7 +30,7 @@ import (
 
 	"github.com/buraksezer/olric"
 	"github.com/buraksezer/olric/config"
-	"github.com/buraksezer/olric/pkg/flog"
+	"github.com/pgscale/pgscale/logging"
 	"github.com/stretchr/testify/require"
 )
 
@@ -138,6 +137,15 @@ func NewPgScaleConfig(t *testing.T) string {
 	return f.Name()
 }
 
+// NewPgScaleConfigFormat returns the path of the test configuration in another format,
+// such as json or yaml.
+func NewPgScaleConfigFormat(t *testing.T, format string) string {
+	data := openFixtureFile(fmt.Sprintf("fixtures/formats/pgscale-server.%s", format))
+	f, err := CreateTmpfile(t, fmt.Sprintf("pgscale-server.*.%s", format), data)
+	require.NoError(t, err)
+	return f.Name()
+}
+
 func NewPgScaleJSONConfig(t *testing.T) interface{} {
 	data := openFixtureFile("fixtures/pgscale-server.json")
 	f, err := CreateTmpfile(t, "pgscale-server.*.json", data)
@@ -153,9 +161,11 @@ func NewPgScaleJSONConfig(t *testing.T) interface{} {
 	return value
 }
 
-func NewFlogLogger() *flog.Logger {
-	l := log.New(os.Stdout, "", log.LstdFlags)
-	lg := flog.New(l)
+func NewLogger() *logging.Logger {
+	lg, err := logging.New(os.Stdout, logging.TextFormat, logging.DebugLevel)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create logger: %v", err))
+	}
 	lg.SetLevel(6)
 	lg.ShowLineNumber(1)
 	return lg
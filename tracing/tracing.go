@@ -0,0 +1,190 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/kontext"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DefaultServiceName  = "pgscale"
+	instrumentationName = "github.com/pgscale/pgscale"
+)
+
+var (
+	ErrTracingNotFound      = errors.New("tracing not found")
+	ErrTraceContextNotFound = errors.New("trace context not found")
+)
+
+var propagator = propagation.TraceContext{}
+
+// Tracing wraps the tracer provider of PgScale. It is a no-op if tracing is not configured.
+type Tracing struct {
+	tracer   trace.Tracer
+	shutdown func(ctx context.Context) error
+}
+
+// New creates a new Tracing instance that exports spans to an OTLP/HTTP collector.
+func New(c *config.Tracing) (*Tracing, error) {
+	if c == nil {
+		provider := trace.NewNoopTracerProvider()
+		return &Tracing{
+			tracer:   provider.Tracer(instrumentationName),
+			shutdown: func(context.Context) error { return nil },
+		}, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(c.Endpoint)}
+	if c.URLPath != nil {
+		opts = append(opts, otlptracehttp.WithURLPath(*c.URLPath))
+	}
+	if c.Insecure != nil && *c.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if c.Headers != nil {
+		opts = append(opts, otlptracehttp.WithHeaders(*c.Headers))
+	}
+
+	// The client connects lazily, this doesn't block if the collector is unavailable.
+	exporter, err := otlptrace.New(context.Background(), otlptracehttp.NewClient(opts...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	serviceName := DefaultServiceName
+	if c.ServiceName != nil {
+		serviceName = *c.ServiceName
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if c.SampleRatio != nil {
+		sampler = sdktrace.TraceIDRatioBased(*c.SampleRatio)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName),
+		)),
+	)
+	return &Tracing{
+		tracer:   provider.Tracer(instrumentationName),
+		shutdown: provider.Shutdown,
+	}, nil
+}
+
+// Start creates a span and a context containing the newly-created span.
+func (t *Tracing) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return t.tracer.Start(ctx, name, opts...)
+}
+
+// Shutdown flushes the pending spans and stops the exporter.
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	return t.shutdown(ctx)
+}
+
+// parseSQLComment parses the key/value pairs in a sqlcommenter style comment:
+// /*key='value',key2='value2'*/. Values are URL encoded.
+func parseSQLComment(comment string) map[string]string {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(comment, ",") {
+		idx := strings.IndexByte(pair, '=')
+		if idx < 0 {
+			continue
+		}
+		key := strings.TrimSpace(pair[:idx])
+		value := strings.Trim(strings.TrimSpace(pair[idx+1:]), "'")
+		if unescaped, err := url.QueryUnescape(value); err == nil {
+			value = unescaped
+		}
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		result[key] = value
+	}
+	return result
+}
+
+// ExtractFromComment extracts the W3C trace context from the comments in a query,
+// such as the ones appended by sqlcommenter. It returns ctx as is, if the query
+// has no valid traceparent.
+func ExtractFromComment(ctx context.Context, query string) context.Context {
+	for {
+		start := strings.Index(query, "/*")
+		if start < 0 {
+			return ctx
+		}
+		end := strings.Index(query[start+2:], "*/")
+		if end < 0 {
+			return ctx
+		}
+		comment := query[start+2 : start+2+end]
+		query = query[start+2+end+2:]
+
+		if !strings.Contains(comment, "traceparent") {
+			continue
+		}
+		carrier := propagation.MapCarrier(parseSQLComment(comment))
+		extracted := propagator.Extract(ctx, carrier)
+		if trace.SpanContextFromContext(extracted).IsValid() {
+			return extracted
+		}
+	}
+}
+
+func FromKontext(k *kontext.Kontext) (*Tracing, error) {
+	i := k.Get(kontext.TracingKey)
+	if i == nil {
+		return nil, ErrTracingNotFound
+	}
+
+	t, ok := i.(*Tracing)
+	if !ok {
+		return nil, fmt.Errorf("tracing: %w", kontext.ErrInvalidType)
+	}
+
+	return t, nil
+}
+
+// ContextFromKontext returns the context that carries the span of a client session.
+func ContextFromKontext(k *kontext.Kontext) (context.Context, error) {
+	i := k.Get(kontext.TraceContextKey)
+	if i == nil {
+		return nil, ErrTraceContextNotFound
+	}
+
+	ctx, ok := i.(context.Context)
+	if !ok {
+		return nil, fmt.Errorf("trace context: %w", kontext.ErrInvalidType)
+	}
+
+	return ctx, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/kontext"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing_ExtractFromComment(t *testing.T) {
+	query := "SELECT * FROM users /*action='list',traceparent='00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01'*/"
+	ctx := ExtractFromComment(context.Background(), query)
+
+	sc := trace.SpanContextFromContext(ctx)
+	require.True(t, sc.IsValid())
+	require.True(t, sc.IsRemote())
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID().String())
+	require.Equal(t, "00f067aa0ba902b7", sc.SpanID().String())
+
+	ctx = ExtractFromComment(context.Background(), "SELECT 1 /* no trace context */")
+	require.False(t, trace.SpanContextFromContext(ctx).IsValid())
+}
+
+func TestTracing_Noop(t *testing.T) {
+	tr, err := New(nil)
+	require.NoError(t, err)
+
+	_, span := tr.Start(context.Background(), "pgscale.test")
+	require.False(t, span.SpanContext().IsValid())
+	span.End()
+	require.NoError(t, tr.Shutdown(context.Background()))
+}
+
+func TestTracing_Export(t *testing.T) {
+	var received int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/traces" {
+			_, _ = io.Copy(io.Discard, r.Body)
+			atomic.AddInt32(&received, 1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	insecure := true
+	tr, err := New(&config.Tracing{
+		Endpoint: strings.TrimPrefix(collector.URL, "http://"),
+		Insecure: &insecure,
+	})
+	require.NoError(t, err)
+
+	ctx := ExtractFromComment(context.Background(),
+		"SELECT 1 /*traceparent='00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01'*/")
+	_, span := tr.Start(ctx, "pgscale.query")
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String())
+	span.End()
+
+	require.NoError(t, tr.Shutdown(context.Background()))
+	require.Equal(t, int32(1), atomic.LoadInt32(&received))
+}
+
+func TestTracing_FromKontext(t *testing.T) {
+	ktx := kontext.New()
+	_, err := FromKontext(ktx)
+	require.ErrorIs(t, err, ErrTracingNotFound)
+
+	ktx.Set(kontext.TracingKey, struct{}{})
+	_, err = FromKontext(ktx)
+	require.ErrorIs(t, err, kontext.ErrInvalidType)
+
+	tr, err := New(nil)
+	require.NoError(t, err)
+	ktx.Set(kontext.TracingKey, tr)
+	extracted, err := FromKontext(ktx)
+	require.NoError(t, err)
+	require.Equal(t, tr, extracted)
+}
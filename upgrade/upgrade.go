@@ -0,0 +1,297 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package upgrade implements the zero-downtime binary upgrade. The running process starts
+a new one with the same command line and passes its listening sockets to it. The new
+process joins the Olric cluster on the alternate ports, starts to serve and notifies the
+old one, then the old process drains its connections and quits.
+*/
+package upgrade
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/kontext"
+)
+
+const DefaultTimeout = 60 * time.Second
+
+// Names of the listeners that are passed to the new process
+const (
+	PostgreSQLListener = "postgresql"
+	HTTPListener       = "http"
+)
+
+// ListenerName returns the name of a listener block of the PostgreSQL proxy.
+func ListenerName(name string) string {
+	return PostgreSQLListener + "." + name
+}
+
+const (
+	envPrefix             = "PGSCALE_UPGRADE_"
+	envListeners          = envPrefix + "LISTENERS"
+	envReadyFD            = envPrefix + "READY_FD"
+	envOlricBindPort      = envPrefix + "OLRIC_BIND_PORT"
+	envMemberlistBindPort = envPrefix + "MEMBERLIST_BIND_PORT"
+	envPeer               = envPrefix + "PEER"
+)
+
+var ErrNotConfigured = errors.New("upgrade block is missing in the configuration")
+
+// Olric denotes where the new process binds Olric and the memberlist address of the
+// old process to join the cluster.
+type Olric struct {
+	BindPort           int
+	MemberlistBindPort int
+	Peer               string
+}
+
+// NextOlric returns the Olric settings of the new process. running is the Olric
+// configuration of the current process.
+func NextOlric(c *config.Config, running *config.Olric) (*Olric, error) {
+	if c.PgScale.Upgrade == nil {
+		return nil, ErrNotConfigured
+	}
+
+	o := &Olric{
+		BindPort:           c.PgScale.Upgrade.OlricBindPort,
+		MemberlistBindPort: c.PgScale.Upgrade.MemberlistBindPort,
+	}
+	if running.BindPort != c.Olric.BindPort {
+		// The current process has been started by an upgrade, swap the ports back.
+		o.BindPort = c.Olric.BindPort
+		o.MemberlistBindPort = c.Olric.Memberlist.BindPort
+	}
+
+	host := running.Memberlist.BindAddr
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	o.Peer = net.JoinHostPort(host, strconv.Itoa(running.Memberlist.BindPort))
+	return o, nil
+}
+
+// Timeout returns the time to wait for the new process to be ready.
+func Timeout(c *config.Config) (time.Duration, error) {
+	if c.PgScale.Upgrade == nil {
+		return 0, ErrNotConfigured
+	}
+	if c.PgScale.Upgrade.Timeout == nil {
+		return DefaultTimeout, nil
+	}
+	timeout, err := time.ParseDuration(*c.PgScale.Upgrade.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid upgrade.timeout: %w", err)
+	}
+	return timeout, nil
+}
+
+// Inherited returns true if the process has been started by an upgrade.
+func Inherited() bool {
+	return os.Getenv(envReadyFD) != ""
+}
+
+// ApplyOlric overrides the Olric ports of the configuration and adds the old process
+// to the peers. It does nothing if the process has not been started by an upgrade.
+func ApplyOlric(c *config.Config) error {
+	if !Inherited() {
+		return nil
+	}
+
+	bindPort, err := strconv.Atoi(os.Getenv(envOlricBindPort))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", envOlricBindPort, err)
+	}
+	memberlistBindPort, err := strconv.Atoi(os.Getenv(envMemberlistBindPort))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", envMemberlistBindPort, err)
+	}
+
+	c.Olric.BindPort = bindPort
+	c.Olric.Memberlist.BindPort = memberlistBindPort
+	c.Olric.Memberlist.Peers = append(c.Olric.Memberlist.Peers, os.Getenv(envPeer))
+	return nil
+}
+
+// Listeners returns the listeners that are inherited from the old process by name.
+func Listeners() (map[string]net.Listener, error) {
+	listeners := make(map[string]net.Listener)
+	value := os.Getenv(envListeners)
+	if value == "" {
+		return listeners, nil
+	}
+
+	for _, item := range strings.Split(value, ",") {
+		parsed := strings.SplitN(item, "=", 2)
+		if len(parsed) != 2 {
+			return nil, fmt.Errorf("invalid %s: %s", envListeners, value)
+		}
+		fd, err := strconv.Atoi(parsed[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", envListeners, err)
+		}
+
+		f := os.NewFile(uintptr(fd), parsed[0])
+		// FileListener duplicates the file descriptor.
+		l, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to inherit %s listener: %w", parsed[0], err)
+		}
+		listeners[parsed[0]] = l
+	}
+	return listeners, nil
+}
+
+// ListenersFromKontext returns the inherited listeners. It returns an empty map if
+// there is no inherited listener.
+func ListenersFromKontext(k *kontext.Kontext) (map[string]net.Listener, error) {
+	i := k.Get(kontext.ListenersKey)
+	if i == nil {
+		return map[string]net.Listener{}, nil
+	}
+
+	listeners, ok := i.(map[string]net.Listener)
+	if !ok {
+		return nil, fmt.Errorf("listeners: %w", kontext.ErrInvalidType)
+	}
+	return listeners, nil
+}
+
+// Ready notifies the old process that the new one is ready to serve.
+func Ready() error {
+	fd, err := strconv.Atoi(os.Getenv(envReadyFD))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", envReadyFD, err)
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+
+	_, err = f.Write([]byte{1})
+	return err
+}
+
+func environ(o *Olric, listeners string, readyFD int) []string {
+	var env []string
+	for _, item := range os.Environ() {
+		// Inherited from the previous upgrade
+		if !strings.HasPrefix(item, envPrefix) {
+			env = append(env, item)
+		}
+	}
+	return append(env,
+		fmt.Sprintf("%s=%s", envListeners, listeners),
+		fmt.Sprintf("%s=%d", envReadyFD, readyFD),
+		fmt.Sprintf("%s=%d", envOlricBindPort, o.BindPort),
+		fmt.Sprintf("%s=%d", envMemberlistBindPort, o.MemberlistBindPort),
+		fmt.Sprintf("%s=%s", envPeer, o.Peer),
+	)
+}
+
+type filer interface {
+	File() (*os.File, error)
+}
+
+// Start starts a new process with the same executable and command line arguments,
+// passes the listeners to it and waits until it's ready to serve. The new process is
+// killed if it's not ready before ctx is done.
+func Start(ctx context.Context, listeners map[string]net.Listener, o *Olric) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var files []*os.File
+	closeFiles := func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+		_ = w.Close()
+	}
+
+	var names []string
+	for name, l := range listeners {
+		fl, ok := l.(filer)
+		if !ok {
+			closeFiles()
+			return fmt.Errorf("%s listener cannot be passed to another process", name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			closeFiles()
+			return err
+		}
+		files = append(files, f)
+		// The first extra file is 3 in the new process.
+		names = append(names, fmt.Sprintf("%s=%d", name, 2+len(files)))
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = environ(o, strings.Join(names, ","), 3+len(files))
+
+	err = cmd.Start()
+	// The new process has its own copies.
+	closeFiles()
+	if err != nil {
+		return err
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	ready := make(chan error, 1)
+	go func() {
+		// Read returns io.EOF if the new process quits before it's ready.
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+
+	select {
+	case err = <-ready:
+		if err == nil {
+			return nil
+		}
+		err = fmt.Errorf("new process is not ready: %w", err)
+	case err = <-exited:
+		return fmt.Errorf("new process has quit: %v", err)
+	case <-ctx.Done():
+		err = fmt.Errorf("new process is not ready: %w", ctx.Err())
+	}
+
+	_ = cmd.Process.Kill()
+	return err
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 Burak Sezer
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package upgrade
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pgscale/pgscale/config"
+	"github.com/pgscale/pgscale/kontext"
+	"github.com/stretchr/testify/require"
+)
+
+func newConfig() *config.Config {
+	timeout := "10s"
+	c := &config.Config{}
+	c.PgScale.Upgrade = &config.Upgrade{
+		Timeout:            &timeout,
+		OlricBindPort:      3330,
+		MemberlistBindPort: 3332,
+	}
+	c.Olric.BindAddr = "0.0.0.0"
+	c.Olric.BindPort = 3320
+	c.Olric.Memberlist.BindAddr = "0.0.0.0"
+	c.Olric.Memberlist.BindPort = 3322
+	return c
+}
+
+func TestUpgrade_NextOlric(t *testing.T) {
+	c := newConfig()
+
+	o, err := NextOlric(c, &c.Olric)
+	require.NoError(t, err)
+	require.Equal(t, &Olric{
+		BindPort:           3330,
+		MemberlistBindPort: 3332,
+		Peer:               "127.0.0.1:3322",
+	}, o)
+
+	// The running process has been started by an upgrade.
+	running := c.Olric
+	running.BindPort = 3330
+	running.Memberlist.BindAddr = "10.0.0.1"
+	running.Memberlist.BindPort = 3332
+	o, err = NextOlric(c, &running)
+	require.NoError(t, err)
+	require.Equal(t, &Olric{
+		BindPort:           3320,
+		MemberlistBindPort: 3322,
+		Peer:               "10.0.0.1:3332",
+	}, o)
+}
+
+func TestUpgrade_NotConfigured(t *testing.T) {
+	c := newConfig()
+	c.PgScale.Upgrade = nil
+
+	_, err := NextOlric(c, &c.Olric)
+	require.ErrorIs(t, err, ErrNotConfigured)
+
+	_, err = Timeout(c)
+	require.ErrorIs(t, err, ErrNotConfigured)
+}
+
+func TestUpgrade_Timeout(t *testing.T) {
+	c := newConfig()
+
+	timeout, err := Timeout(c)
+	require.NoError(t, err)
+	require.Equal(t, 10*time.Second, timeout)
+
+	c.PgScale.Upgrade.Timeout = nil
+	timeout, err = Timeout(c)
+	require.NoError(t, err)
+	require.Equal(t, DefaultTimeout, timeout)
+}
+
+func TestUpgrade_ApplyOlric(t *testing.T) {
+	c := newConfig()
+	require.NoError(t, ApplyOlric(c))
+	require.Equal(t, 3320, c.Olric.BindPort)
+
+	t.Setenv(envReadyFD, "4")
+	t.Setenv(envOlricBindPort, "3330")
+	t.Setenv(envMemberlistBindPort, "3332")
+	t.Setenv(envPeer, "127.0.0.1:3322")
+	require.True(t, Inherited())
+
+	require.NoError(t, ApplyOlric(c))
+	require.Equal(t, 3330, c.Olric.BindPort)
+	require.Equal(t, 3332, c.Olric.Memberlist.BindPort)
+	require.Equal(t, []string{"127.0.0.1:3322"}, c.Olric.Memberlist.Peers)
+}
+
+func TestUpgrade_Listeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	f, err := l.(*net.TCPListener).File()
+	require.NoError(t, err)
+	// Listeners closes the inherited file descriptor.
+	fd, err := syscall.Dup(int(f.Fd()))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	t.Setenv(envListeners, fmt.Sprintf("%s=%d", PostgreSQLListener, fd))
+	listeners, err := Listeners()
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+
+	inherited := listeners[PostgreSQLListener]
+	defer inherited.Close()
+	require.Equal(t, l.Addr().String(), inherited.Addr().String())
+
+	k := kontext.New()
+	k.Set(kontext.ListenersKey, listeners)
+	fromKontext, err := ListenersFromKontext(k)
+	require.NoError(t, err)
+	require.Equal(t, listeners, fromKontext)
+}
+
+func TestUpgrade_Listeners_Invalid(t *testing.T) {
+	t.Setenv(envListeners, PostgreSQLListener)
+	_, err := Listeners()
+	require.Error(t, err)
+}
+
+func TestUpgrade_environ(t *testing.T) {
+	t.Setenv(envPeer, "127.0.0.1:3332")
+
+	o := &Olric{
+		BindPort:           3330,
+		MemberlistBindPort: 3332,
+		Peer:               "127.0.0.1:3322",
+	}
+	env := environ(o, "postgresql=3", 4)
+
+	var upgradeEnv []string
+	for _, item := range env {
+		if strings.HasPrefix(item, envPrefix) {
+			upgradeEnv = append(upgradeEnv, item)
+		}
+	}
+	require.Equal(t, []string{
+		"PGSCALE_UPGRADE_LISTENERS=postgresql=3",
+		"PGSCALE_UPGRADE_READY_FD=4",
+		"PGSCALE_UPGRADE_OLRIC_BIND_PORT=3330",
+		"PGSCALE_UPGRADE_MEMBERLIST_BIND_PORT=3332",
+		"PGSCALE_UPGRADE_PEER=127.0.0.1:3322",
+	}, upgradeEnv)
+}
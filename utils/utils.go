@@ -15,12 +15,12 @@
 package utils
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"unsafe"
 
 	"github.com/buraksezer/olric"
-	"github.com/buraksezer/olric/pkg/flog"
 	"github.com/pgscale/pgscale/dmaps"
 	"github.com/pgscale/pgscale/kontext"
 )
@@ -28,9 +28,8 @@ import (
 const NULByte = byte(0)
 
 var (
-	ErrDMapsNotFound  = errors.New("dmaps not found")
-	ErrOlricNotFound  = errors.New("olric not found")
-	ErrLoggerNotFound = errors.New("logger not found")
+	ErrDMapsNotFound = errors.New("dmaps not found")
+	ErrOlricNotFound = errors.New("olric not found")
 )
 
 func OlricFromKontext(k *kontext.Kontext) (*olric.Olric, error) {
@@ -47,20 +46,6 @@ func OlricFromKontext(k *kontext.Kontext) (*olric.Olric, error) {
 	return db, nil
 }
 
-func FlogFromKontext(k *kontext.Kontext) (*flog.Logger, error) {
-	i := k.Get(kontext.LoggerKey)
-	if i == nil {
-		return nil, ErrLoggerNotFound
-	}
-
-	f, ok := i.(*flog.Logger)
-	if !ok {
-		return nil, fmt.Errorf("logger: %w", kontext.ErrInvalidType)
-	}
-
-	return f, nil
-}
-
 func DMapsFromKontext(k *kontext.Kontext) (*dmaps.DMaps, error) {
 	i := k.Get(kontext.DMapsKey)
 	if i == nil {
@@ -87,7 +72,67 @@ func ByteToString(b []byte) string {
 	return *(*string)(unsafe.Pointer(&b))
 }
 
+// LeadingComments returns the bodies of the comments before the first token of a
+// query and the rest of it. Whitespace, line comments and nested block comments are
+// skipped, an unterminated block comment is a part of the rest.
+func LeadingComments(data []byte) ([][]byte, []byte) {
+	var comments [][]byte
+	for {
+		i := 0
+		for i < len(data) && isSpace(data[i]) {
+			i++
+		}
+		data = data[i:]
+
+		switch {
+		case bytes.HasPrefix(data, []byte("--")):
+			end := bytes.IndexByte(data, '\n')
+			if end == -1 {
+				end = len(data)
+			}
+			comments = append(comments, data[2:end])
+			data = data[end:]
+		case bytes.HasPrefix(data, []byte("/*")):
+			end := blockCommentEnd(data)
+			if end == -1 {
+				return comments, data
+			}
+			comments = append(comments, data[2:end-2])
+			data = data[end:]
+		default:
+			return comments, data
+		}
+	}
+}
+
+// blockCommentEnd returns the index after the end of the block comment at the start of
+// data, or -1 if it's not terminated. Block comments nest in PostgreSQL.
+func blockCommentEnd(data []byte) int {
+	depth := 0
+	for i := 0; i+1 < len(data); i++ {
+		switch {
+		case data[i] == '/' && data[i+1] == '*':
+			depth++
+			i++
+		case data[i] == '*' && data[i+1] == '/':
+			depth--
+			i++
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return -1
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f' || b == '\v'
+}
+
+// StartWithSelect returns true if the first token of a query is SELECT, the leading
+// whitespace and comments are skipped.
 func StartWithSelect(data []byte) bool {
+	_, data = LeadingComments(data)
 	if len(data) < 6 {
 		return false
 	}
@@ -19,7 +19,6 @@ import (
 	"testing"
 
 	"github.com/buraksezer/olric"
-	"github.com/buraksezer/olric/pkg/flog"
 	"github.com/pgscale/pgscale/dmaps"
 	"github.com/pgscale/pgscale/kontext"
 	"github.com/stretchr/testify/require"
@@ -34,6 +33,26 @@ func TestUtils_StartWithSelect(t *testing.T) {
 
 	q3 := []byte("SET")
 	require.False(t, StartWithSelect(q3))
+
+	q4 := []byte("\n  /* pgscale:nocache */ -- comment\n select * from users;")
+	require.True(t, StartWithSelect(q4))
+
+	q5 := []byte("/* unterminated SELECT * FROM users")
+	require.False(t, StartWithSelect(q5))
+}
+
+func TestUtils_LeadingComments(t *testing.T) {
+	comments, rest := LeadingComments([]byte(" /* a /* nested */ b */\n-- line\nSELECT 1 /* not leading */"))
+	require.Equal(t, [][]byte{[]byte(" a /* nested */ b "), []byte(" line")}, comments)
+	require.Equal(t, "SELECT 1 /* not leading */", string(rest))
+
+	comments, rest = LeadingComments([]byte("SELECT 1"))
+	require.Nil(t, comments)
+	require.Equal(t, "SELECT 1", string(rest))
+
+	comments, rest = LeadingComments([]byte("-- only a comment"))
+	require.Equal(t, [][]byte{[]byte(" only a comment")}, comments)
+	require.Empty(t, rest)
 }
 
 func TestUtils_ByteToString(t *testing.T) {
@@ -71,22 +90,6 @@ func TestUtils_DMapsFromKontext(t *testing.T) {
 	require.Equal(t, dms, extracted)
 }
 
-func TestUtils_FlogFromKontext(t *testing.T) {
-	ktx := kontext.New()
-	_, err := FlogFromKontext(ktx)
-	require.Equal(t, ErrLoggerNotFound, err)
-
-	ktx.Set(kontext.LoggerKey, struct{}{})
-	_, err = FlogFromKontext(ktx)
-	require.ErrorIs(t, err, kontext.ErrInvalidType)
-
-	f := flog.New(nil)
-	ktx.Set(kontext.LoggerKey, f)
-	extracted, err := FlogFromKontext(ktx)
-	require.NoError(t, err)
-	require.Equal(t, f, extracted)
-}
-
 func TestUtils_OlricFromKontext(t *testing.T) {
 	ktx := kontext.New()
 	_, err := OlricFromKontext(ktx)